@@ -0,0 +1,103 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VaultConnectionSpec defines the desired state of VaultConnection
+type VaultConnectionSpec struct {
+	// VaultAddress is the address of the Vault
+	//+kubebuilder:validation:MinLength=1
+	VaultAddress string `json:"vaultAddress"`
+
+	// VaultNamespace is the Vault Enterprise namespace of the logins and the
+	// reads
+	VaultNamespace string `json:"vaultNamespace,omitempty"`
+
+	// AuthMethod is the Vault auth method the VaultSecrets log in with, as
+	// their own AuthMethod
+	//+kubebuilder:validation:Enum=kubernetes;jwt;approle;userpass;ldap;aws;gcp;token_file
+	AuthMethod string `json:"authMethod,omitempty"`
+
+	// AuthPath is the mount of the AuthMethod, the name of the method when
+	// empty
+	AuthPath string `json:"authPath,omitempty"`
+
+	// Role is the Vault role the VaultSecrets log in with. It gives way to
+	// the role of their ServiceAccountName.
+	Role string `json:"role,omitempty"`
+
+	// TLSSecret is the Secret whose ca.crt key holds the CA bundle the Vault
+	// server certificate is verified with, instead of the system roots. The
+	// connection being cluster-scoped, the Secret names its namespace.
+	TLSSecret *core.SecretReference `json:"tlsSecret,omitempty"`
+
+	// TLSServerName is the name the Vault server certificate is verified
+	// against, and sent as SNI
+	TLSServerName string `json:"tlsServerName,omitempty"`
+}
+
+// VaultConnectionStatus defines the observed state of VaultConnection
+type VaultConnectionStatus struct {
+	// Conditions represent the latest observations of the VaultConnection
+	// state
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Ready reports whether the last check reached an initialized and
+	// unsealed Vault
+	Ready bool `json:"ready"`
+
+	// LastCheckTime is the time of the last check of the Vault
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Address",type=string,JSONPath=`.spec.vaultAddress`
+//+kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
+//+kubebuilder:printcolumn:name="Last Check",type=date,JSONPath=`.status.lastCheckTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VaultConnection is the Schema for the vaultconnections API. It holds the
+// connection settings of a Vault shared by the VaultSecrets of all the
+// namespaces referencing it with their ConnectionRef.
+type VaultConnection struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VaultConnectionSpec   `json:"spec,omitempty"`
+	Status VaultConnectionStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VaultConnectionList contains a list of VaultConnection
+type VaultConnectionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VaultConnection `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VaultConnection{}, &VaultConnectionList{})
+}
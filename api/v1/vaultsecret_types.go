@@ -17,6 +17,8 @@ limitations under the License.
 package v1
 
 import (
+	"strings"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -29,19 +31,660 @@ type VaultSecretSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	VaultAddress string `json:"vaultAddress,omitempty"`
-	Path         string `json:"path,omitempty"`
-	AuthPath     string `json:"authPath,omitempty"`
-	Role         string `json:"role"`
+
+	// Path is the Vault path read into the Secret. A path holding "{{" is a
+	// Go template of the metadata of the VaultSecret, its .Name, .Namespace,
+	// .Labels and .Annotations, e.g. secret/data/{{ .Namespace }}/config.
+	Path string `json:"path,omitempty"`
+
+	AuthPath string `json:"authPath,omitempty"`
+	Role     string `json:"role,omitempty"`
+
+	// Paths are more Vault paths whose keys are merged into the ones of Path,
+	// in order. A key set by several paths takes the value of the last one,
+	// and the KeysOverridden condition lists it.
+	Paths []VaultPath `json:"paths,omitempty"`
+
+	// KeyPrefix is prepended to the keys of Path, as the KeyPrefix of Paths
+	// is to theirs, so that the keys of the merged paths don't collide
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+
+	// PathPrefix replaces Path with a Vault path listed for a Secret per
+	// child, e.g. secret/apps/ holding a secret per app. The child Secrets
+	// are named <secretName>-<child>, the child lowercased and its characters
+	// other than alphanumerics, dots and dashes replaced by dashes. The
+	// Secrets of the children removed from the Vault are deleted. The KV v2
+	// prefixes are given without their metadata/ segment, inserted as for
+	// Path.
+	PathPrefix string `json:"pathPrefix,omitempty"`
+
+	// Recursive lists the folders under the PathPrefix as well, their
+	// children named by their whole path under the prefix
+	Recursive bool `json:"recursive,omitempty"`
+
+	// FailOnKeyCollision fails the sync when Paths set a key twice, rather
+	// than the last path winning
+	FailOnKeyCollision bool `json:"failOnKeyCollision,omitempty"`
+
+	// ConfigRef is the name of a ConfigMap of the namespace holding the
+	// connection settings shared by VaultSecrets, under the vaultAddress,
+	// vaultNamespace, authMethod, authPath, role, tlsSecret and tlsServerName
+	// keys. The fields set on the VaultSecret override them.
+	ConfigRef string `json:"configRef,omitempty"`
+
+	// ConnectionRef is the name of a cluster-scoped VaultConnection holding
+	// the connection settings of the Vault, such as its address, TLS and
+	// auth method. The fields set on the VaultSecret and the keys of its
+	// ConfigRef override them.
+	ConnectionRef string `json:"connectionRef,omitempty"`
+
+	// AuthMethod is the Vault auth method the operator logs in with,
+	// kubernetes by default. The kubernetes and jwt methods log in with the
+	// ServiceAccount JWT of the operator, the approle method with the role_id
+	// and secret_id keys of SecretRef, the userpass and ldap methods with its
+	// username and password keys, the aws method with a signed
+	// sts:GetCallerIdentity request of the AWS credentials of the operator,
+	// the gcp method with an identity token of the GCE metadata server. The
+	// token_file method doesn't log in, it uses the token of TokenPath.
+	// AuthPath defaults to the name of the method.
+	//+kubebuilder:validation:Enum=kubernetes;jwt;approle;userpass;ldap;aws;gcp;token_file
+	AuthMethod string `json:"authMethod,omitempty"`
+
+	// SecretRef is the name of a Secret of the namespace holding the login
+	// credentials of the AuthMethod.
+	SecretRef string `json:"secretRef,omitempty"`
+
+	// JWTPath is the file of the projected ServiceAccount token the
+	// kubernetes and jwt AuthMethods log in with, in place of the one of the
+	// operator set by KUBERNETES_SERVICE_ACCOUNT_TOKEN or VAULT_JWT_FILE.
+	// It has to be within the directories of the jwt-dirs flag of the
+	// operator.
+	JWTPath string `json:"jwtPath,omitempty"`
+
+	// Audience has the kubernetes and jwt AuthMethods log in with a token
+	// of the ServiceAccountName, or else of the operator ServiceAccount,
+	// requested for the audience right before the login, in place of the
+	// JWT file. The tokens are short-lived, they aren't kept.
+	Audience string `json:"audience,omitempty"`
+
+	// TokenPath is the file holding the Vault token of the token_file
+	// AuthMethod, such as the sink of a Vault Agent sidecar of the operator.
+	// It's read on every request, VAULT_TOKEN_FILE of the operator when empty.
+	// It has to be within the directories of the token-dirs flag of the
+	// operator.
+	TokenPath string `json:"tokenPath,omitempty"`
+
+	// TLSSecret is the name of a Secret of the namespace whose ca.crt key
+	// holds the CA bundle the Vault server certificate is verified with,
+	// instead of the system roots.
+	TLSSecret string `json:"tlsSecret,omitempty"`
+
+	// TLSServerName is the name the Vault server certificate is verified
+	// against, and sent as SNI, when the Vault is reached through an IP or
+	// a proxy whose name the certificate doesn't hold.
+	TLSServerName string `json:"tlsServerName,omitempty"`
+
+	// ClientCertSecret is the name of a Secret of the namespace whose tls.crt
+	// and tls.key keys hold the client certificate presented to a Vault
+	// requiring mutual TLS. It composes with the CA bundle of TLSSecret.
+	ClientCertSecret string `json:"clientCertSecret,omitempty"`
+
+	// ClientTimeout bounds each Vault request, retries included, 30s when
+	// unset or zero.
+	ClientTimeout *metav1.Duration `json:"clientTimeout,omitempty"`
+
+	// KVVersion is the version of the KV engine mounted at the path, v2 by
+	// default. The payload of KV v1 secrets isn't wrapped in a data field.
+	// Unless v1, the paths of the KV v2 mounts lacking their data/ segment,
+	// such as secret/app, are read with it, as secret/data/app. The auto
+	// version looks the mount of the path up once on
+	// sys/internal/ui/mounts and reads it as per the version found, the
+	// paths whose lookup is denied by the policy are read as KV v2 ones and
+	// need an explicit version otherwise.
+	//+kubebuilder:validation:Enum=v1;v2;auto
+	KVVersion string `json:"kvVersion,omitempty"`
+
+	// Unwrap treats the read of the path as a response-wrapping token, either
+	// the wrap info of the response or its token key, and unwraps the payload
+	// the Secret is made of. The tokens are single-use, the payload of the
+	// last token of the path is kept in memory for the refreshes reading it
+	// again.
+	Unwrap bool `json:"unwrap,omitempty"`
+
+	// ReadAddress is the address of a Vault read replica the secret is read
+	// from, the login still goes to VaultAddress.
+	ReadAddress string `json:"readAddress,omitempty"`
+
+	// VaultNamespace is the Vault Enterprise namespace of the login and the
+	// reads, the VAULT_NAMESPACE of the operator when empty.
+	VaultNamespace string `json:"vaultNamespace,omitempty"`
+
+	// Data lists the keys of the Vault secret projected into the Secret,
+	// renamed when SecretKey is set. All the keys are copied when empty.
+	Data []KeyMapping `json:"data,omitempty"`
+
+	// RequireAllKeys refuses to write the Secret while some VaultKeys of the
+	// Data are missing from the Vault secret, listed by the MissingKeys
+	// condition. True by default, false leaves the missing keys out.
+	RequireAllKeys *bool `json:"requireAllKeys,omitempty"`
+
+	// Optional tolerates a Path missing from the Vault, as in the
+	// environments not holding the secret: the Secret isn't written and the
+	// PathMissing condition tells it, without a sync error. An existing
+	// Secret is left as is.
+	Optional bool `json:"optional,omitempty"`
+
+	// PreserveOnEmpty keeps the Secret as is when the Vault secret turns out
+	// empty, as after the path was deleted or the policy changed, and fails
+	// the sync instead. True by default, false clears the Secret.
+	PreserveOnEmpty *bool `json:"preserveOnEmpty,omitempty"`
+
+	// Template holds the metadata merged onto the Secret, and the templates
+	// of its data. The annotations of the apps.vault.op group are reserved
+	// and ignored.
+	Template *SecretTemplate `json:"template,omitempty"`
+
+	// SecretName is the name of the Secret, or of the ConfigMap or
+	// targetRef object, the data is written into, the name of the
+	// VaultSecret by default. It can't be changed afterwards.
+	SecretName string `json:"secretName,omitempty"`
+
+	// SecretType is the type of the Secret, such as kubernetes.io/tls,
+	// Opaque by default. The keys the type requires must be present.
+	SecretType string `json:"secretType,omitempty"`
+
+	// ChangeDetectionKeys limits the content hash used to decide whether the
+	// child Secret needs an update to the listed keys. All keys are tracked
+	// when empty.
+	ChangeDetectionKeys []string `json:"changeDetectionKeys,omitempty"`
+
+	// AdoptExisting allows taking over a pre-existing Secret with the target
+	// name that isn't owned by this VaultSecret. The Secret may opt in itself
+	// with the apps.vault.op/adopt: "true" annotation instead. The Secrets
+	// controlled by another object are never adopted.
+	AdoptExisting bool `json:"adoptExisting,omitempty"`
+
+	// Paused stops the reconciles of the VaultSecret, nothing is read from
+	// the Vault nor written to the Secret until it's unset. The Ready
+	// condition reports the pause. The finalizer still runs on deletion.
+	Paused bool `json:"paused,omitempty"`
+
+	// Immutable marks the child Secret immutable, sparing the kubelets its
+	// watch. An immutable Secret can't be updated, it's deleted and created
+	// again when the Vault data changes. The chunks and the copies of the
+	// Secret stay mutable.
+	Immutable bool `json:"immutable,omitempty"`
+
+	// DryRun logs in and reads the Vault data without writing the Secret, to
+	// check the Vault policies of the role. The keys the Secret would hold
+	// are reported in the DryRunKeys status.
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Backend selects the secret reader used to fetch the data. Defaults to
+	// "vault".
+	Backend string `json:"backend,omitempty"`
+
+	// AdaptiveRefresh gradually lengthens the refresh interval while Vault
+	// keeps returning identical data, snapping back on any change.
+	AdaptiveRefresh bool `json:"adaptiveRefresh,omitempty"`
+
+	// IncludeVersionHistory stores the last N versions of a KV v2 secret in
+	// the Secret, each key suffixed with ".v<version>".
+	//+kubebuilder:validation:Minimum=0
+	IncludeVersionHistory int `json:"includeVersionHistory,omitempty"`
+
+	// ServiceAccountName references a ServiceAccount in the VaultSecret
+	// namespace whose "vault.hashicorp.com/role" annotation provides the role
+	// when Role is empty. The operator's own ServiceAccount is used otherwise.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// ValidateEnvNames refuses to write the Secret when some of its keys are
+	// not valid environment variable names, e.g. when consumed via envFrom.
+	ValidateEnvNames bool `json:"validateEnvNames,omitempty"`
+
+	// KeyTransform renames the Secret keys. "EnvVar" upper-cases them and
+	// replaces the characters not allowed in environment variables with "_".
+	//+kubebuilder:validation:Enum=EnvVar
+	KeyTransform string `json:"keyTransform,omitempty"`
+
+	// ExplodeKeys lists keys holding a JSON object whose top-level fields are
+	// written as separate "<key>.<field>" keys in place of the original one.
+	ExplodeKeys []string `json:"explodeKeys,omitempty"`
+
+	// PathTemplate overrides Path with a path where "{{namespace}}" and
+	// "{{name}}" expand to the VaultSecret namespace and name, matching Vault
+	// policies templated on the Kubernetes namespace.
+	PathTemplate string `json:"pathTemplate,omitempty"`
+
+	// MaxKeys limits the number of keys written to the Secret. Over the limit
+	// the Secret isn't written, unless ChunkKeys is set.
+	//+kubebuilder:validation:Minimum=0
+	MaxKeys int `json:"maxKeys,omitempty"`
+
+	// ChunkKeys spreads the keys over the Secret and additional "<name>-<n>"
+	// Secrets holding at most MaxKeys keys each.
+	ChunkKeys bool `json:"chunkKeys,omitempty"`
+
+	// RefreshInterval is the interval the Vault data is re-read at, 5m when
+	// unset or zero. AdaptiveRefresh lengthens it from there.
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+
+	// PostRotationDelay delays the sync of a new KV v2 version by re-reading
+	// it after the delay, in case the first read came from a lagging standby.
+	// The VaultSecret is requeued meanwhile, rounded up to the second.
+	PostRotationDelay *metav1.Duration `json:"postRotationDelay,omitempty"`
+
+	// ForceRotateSchedule is a cron schedule on which the Secret is re-read
+	// and rewritten even when the Vault data appears unchanged.
+	ForceRotateSchedule string `json:"forceRotateSchedule,omitempty"`
+
+	// Format renders the whole Secret into a single key with a Vault Agent
+	// style template or a dotenv, JSON or YAML serialization, replacing the
+	// plain key/value data.
+	Format *SecretFormat `json:"format,omitempty"`
+
+	// IncludePathKey is a Secret key, e.g. "__vault_path", that holds the
+	// resolved Vault path the data was read from.
+	IncludePathKey string `json:"includePathKey,omitempty"`
+
+	// ReadRetries is the number of times a failed Vault login or read is
+	// retried on server side, rate limit and network errors before the
+	// reconcile fails. The denied and missing ones aren't retried. Zero means
+	// the default of the operator, if any, or leaves the retries to the Vault
+	// client.
+	//+kubebuilder:validation:Minimum=0
+	ReadRetries int `json:"readRetries,omitempty"`
+
+	// RetryDelay is the delay between the ReadRetries, 250ms or the default
+	// of the operator when unset
+	RetryDelay *metav1.Duration `json:"retryDelay,omitempty"`
+
+	// ReconcileTimeout bounds a whole reconcile, its logins and reads of the
+	// merged paths and the listed secrets included. A reconcile running past
+	// it is aborted and requeued, with the ReconcileTimedOut reason on the
+	// Ready condition. The default of the operator applies when unset, none
+	// by default.
+	ReconcileTimeout *metav1.Duration `json:"reconcileTimeout,omitempty"`
+
+	// OverlapWindow keeps the lease of replaced dynamic credentials alive for
+	// the window after the Secret is updated with new ones, so that both stay
+	// valid while the apps switch over, then revokes it. Without it replaced
+	// leases are left to expire.
+	OverlapWindow *metav1.Duration `json:"overlapWindow,omitempty"`
+
+	// TargetRef materializes the data into a custom resource of the given
+	// kind, named after the VaultSecret, instead of a Secret. The kind has to
+	// be allowed by the operator.
+	TargetRef *TargetRef `json:"targetRef,omitempty"`
+
+	// TargetNamespaces are more namespaces the Secret is copied into, "*"
+	// copies it into all of them. They have to be allowed by the
+	// copy-namespaces flag of the operator, "*" and the
+	// TargetNamespaceSelector only copy into the allowed ones. The copies can't be owned by the
+	// VaultSecret across namespaces, they carry an apps.vault.op/copy-of
+	// annotation instead and are deleted along with the VaultSecret.
+	TargetNamespaces []string `json:"targetNamespaces,omitempty"`
+
+	// TargetKind is the kind of the object the data is written into, a
+	// Secret by default. A ConfigMap suits the non-sensitive data, its
+	// values are stored as strings, or binaryData when they aren't UTF-8.
+	//+kubebuilder:validation:Enum=Secret;ConfigMap
+	TargetKind string `json:"targetKind,omitempty"`
+
+	// DeletionPolicy is what becomes of the Secret when the VaultSecret is
+	// deleted. Delete, the default, collects it along with its copies and
+	// revokes its Vault leases. Retain keeps the Secret, its copies and its
+	// leases: the owner reference of the Secrets and ConfigMap written by
+	// the VaultSecret is removed and they're annotated with
+	// apps.vault.op/orphaned-from instead. The operator stops managing them
+	// once the VaultSecret is gone, they're no longer refreshed nor deleted,
+	// and a new VaultSecret only takes them over with AdoptExisting.
+	//+kubebuilder:validation:Enum=Delete;Retain
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+
+	// RolloutTargets are the workloads of the namespace restarted when the
+	// data of the Secret changes, as the mounted Secrets don't restart the
+	// pods. Their pod template is annotated with the data hash of the Secret.
+	RolloutTargets []RolloutTarget `json:"rolloutTargets,omitempty"`
+
+	// Split fans the keys out into further Secrets of the namespace, each
+	// getting a subset of the keys of the Secret, such as one Secret per
+	// consuming app. The Secret itself keeps all the keys. The split Secrets
+	// are owned by the VaultSecret and aren't copied to other namespaces.
+	Split []SplitSecret `json:"split,omitempty"`
+
+	// TargetNamespaceSelector copies the Secret into the namespaces matching
+	// the labels as well
+	TargetNamespaceSelector *metav1.LabelSelector `json:"targetNamespaceSelector,omitempty"`
+
+	// IncludeProvenance annotates the Secret with the Vault origin of each key,
+	// as apps.vault.op/key.<name>.source: <path>#<vaultkey>. Values are never
+	// part of the annotations.
+	IncludeProvenance bool `json:"includeProvenance,omitempty"`
+
+	// DropEmptyValues leaves the keys with an empty Vault value out of the
+	// Secret. They are kept by default.
+	DropEmptyValues bool `json:"dropEmptyValues,omitempty"`
+
+	// Templates are Go templates rendered into the Secret keys they're set
+	// for. The dot is the Secret data, keys of the other Secrets managed by
+	// VaultSecrets of the namespace are read with {{ secrets "name" "key" }}.
+	Templates map[string]string `json:"templates,omitempty"`
+
+	// KubeconfigOutput renders a kubeconfig authenticating with the client
+	// certificate issued by a Vault PKI into a Secret key.
+	KubeconfigOutput *KubeconfigOutput `json:"kubeconfigOutput,omitempty"`
+
+	// DockerConfigOutput assembles the registry credentials of the Vault
+	// secret into a kubernetes.io/dockerconfigjson Secret for image pulls,
+	// replacing the plain key/value data.
+	DockerConfigOutput *DockerConfigOutput `json:"dockerConfigOutput,omitempty"`
+
+	// Transit decrypts the transit ciphertexts held by the Vault keys before
+	// they're mapped into the Secret, keeping the plaintext out of the KV
+	// store. A failed decryption fails the sync.
+	Transit *TransitDecryption `json:"transit,omitempty"`
+}
+
+// TransitDecryption describes the decryption of the Vault keys with a key of
+// the transit secrets engine
+type TransitDecryption struct {
+	// Mount is the path the transit engine is mounted at. Defaults to
+	// "transit".
+	Mount string `json:"mount,omitempty"`
+
+	// KeyName is the name of the transit key decrypting the values
+	//+kubebuilder:validation:MinLength=1
+	KeyName string `json:"keyName"`
+
+	// Keys are the Vault keys holding ciphertexts, all of them when empty. A
+	// listed key missing from the Vault secret fails the sync.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// DefaultTransitMount is the mount of the transit engine when Mount is empty
+const DefaultTransitMount = "transit"
+
+// TargetKindConfigMap is the TargetKind writing the data into a ConfigMap
+const TargetKindConfigMap = "ConfigMap"
+
+// DeletionPolicyRetain is the DeletionPolicy keeping the Secret after the
+// VaultSecret is deleted
+const DeletionPolicyRetain = "Retain"
+
+// RolloutTarget is a workload restarted along with the changes of the Secret
+type RolloutTarget struct {
+	// Kind is the kind of the workload
+	//+kubebuilder:validation:Enum=Deployment;StatefulSet
+	Kind string `json:"kind"`
+
+	// Name is the name of the workload in the namespace of the VaultSecret
+	//+kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// SplitSecret is a Secret getting a subset of the keys of the Secret
+type SplitSecret struct {
+	// Name is the name of the Secret in the namespace of the VaultSecret
+	//+kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Keys are the keys of the Secret copied into it, all of them required
+	//+kubebuilder:validation:MinItems=1
+	Keys []string `json:"keys"`
+}
+
+// KubeconfigOutput describes a kubeconfig built from a PKI issued certificate
+type KubeconfigOutput struct {
+	// Key is the Secret key holding the kubeconfig. Defaults to "kubeconfig".
+	Key string `json:"key,omitempty"`
+
+	// Server is the URL of the Kubernetes API server
+	//+kubebuilder:validation:MinLength=1
+	Server string `json:"server"`
+
+	// CertificateAuthority is the PEM encoded CA bundle of the API server
+	CertificateAuthority string `json:"certificateAuthority,omitempty"`
+
+	// Context is the name of the cluster, user and context. Defaults to
+	// "default".
+	Context string `json:"context,omitempty"`
+
+	// CertificateKey is the Secret key of the PEM encoded client certificate.
+	// Defaults to "certificate", as returned by the PKI engine.
+	CertificateKey string `json:"certificateKey,omitempty"`
+
+	// PrivateKeyKey is the Secret key of the PEM encoded client key. Defaults
+	// to "private_key", as returned by the PKI engine.
+	PrivateKeyKey string `json:"privateKeyKey,omitempty"`
+}
+
+// DockerConfigOutput describes a .dockerconfigjson built from the registry
+// credentials of the Vault secret, all of them required
+type DockerConfigOutput struct {
+	// RegistryKey is the Secret key of the registry server, e.g.
+	// registry.example.com. Defaults to "registry".
+	RegistryKey string `json:"registryKey,omitempty"`
+
+	// UsernameKey is the Secret key of the username. Defaults to "username".
+	UsernameKey string `json:"usernameKey,omitempty"`
+
+	// PasswordKey is the Secret key of the password. Defaults to "password".
+	PasswordKey string `json:"passwordKey,omitempty"`
+
+	// EmailKey is the Secret key of the email, left out when empty
+	EmailKey string `json:"emailKey,omitempty"`
+}
+
+// SecretTemplate is the template of the Secret
+type SecretTemplate struct {
+	Metadata SecretTemplateMetadata `json:"metadata,omitempty"`
+
+	// Data are Go templates rendered into the Secret keys they're set for,
+	// their output replaces the data of the Secret. The dot is the Secret
+	// data, e.g. {{ .user }}:{{ .password | base64encode }}. Format can't be
+	// set along.
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// SecretTemplateMetadata are the labels and annotations of the Secret
+type SecretTemplateMetadata struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// VaultPath is a Vault path merged into the Secret
+type VaultPath struct {
+	//+kubebuilder:validation:MinLength=1
+	Path string `json:"path"`
+
+	// KeyPrefix is prepended to the keys of the path
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+}
+
+// KeyMapping projects a key of the Vault secret into the Secret
+type KeyMapping struct {
+	// VaultKey is the key of the Vault secret
+	//+kubebuilder:validation:MinLength=1
+	VaultKey string `json:"vaultKey"`
+
+	// SecretKey is the key of the Secret, VaultKey when empty
+	SecretKey string `json:"secretKey,omitempty"`
+
+	// Decode set to base64 stores the decoded bytes of the base64 value, for
+	// the binary blobs such as keystores. An invalid value fails the sync.
+	//+kubebuilder:validation:Enum=base64
+	Decode string `json:"decode,omitempty"`
+
+	// JSONPath extracts a field of the JSON document held by the Vault key,
+	// after its Decode, e.g. ".database.password" or "{.hosts[0]}". Strings
+	// are stored as is, the other values as JSON. A value that isn't JSON or
+	// an expression matching no value or several fails the sync.
+	JSONPath string `json:"jsonPath,omitempty"`
+}
+
+// KeyDecodeBase64 is the Decode of the base64 encoded Vault values
+const KeyDecodeBase64 = "base64"
+
+// JSONPathTemplate returns the JSONPath as a template of the kubectl
+// JSONPath syntax, in braces
+func (m KeyMapping) JSONPathTemplate() string {
+	if strings.HasPrefix(strings.TrimSpace(m.JSONPath), "{") {
+		return m.JSONPath
+	}
+
+	return "{" + m.JSONPath + "}"
+}
+
+// TargetKey returns the key of the Secret the Vault key is projected into
+func (m KeyMapping) TargetKey() string {
+	if m.SecretKey == "" {
+		return m.VaultKey
+	}
+
+	return m.SecretKey
+}
+
+// The Types of a SecretFormat
+const (
+	SecretFormatTemplate = "template"
+	SecretFormatDotenv   = "dotenv"
+	SecretFormatJSON     = "json"
+	SecretFormatYAML     = "yaml"
+)
+
+// SecretFormat produces a single Secret key, with a Vault Agent style
+// template or by serializing the whole Secret data
+type SecretFormat struct {
+	// Key is the Secret key holding the rendered template, e.g. config.json
+	//+kubebuilder:validation:MinLength=1
+	Key string `json:"key"`
+
+	// Type is template by default. The dotenv, json and yaml types serialize
+	// the keys of the Secret, sorted, as a .env file, a JSON object or a YAML
+	// map.
+	//+kubebuilder:validation:Enum=template;dotenv;json;yaml
+	Type string `json:"type,omitempty"`
+
+	// Template is a Go template with the Vault Agent secret function, e.g.
+	// {{ with secret "secret/data/app" }}{{ .Data.data.password }}{{ end }}.
+	// It's required by the template type only.
+	Template string `json:"template,omitempty"`
+}
+
+// TargetRef is the kind of the object the data is materialized into
+type TargetRef struct {
+	//+kubebuilder:validation:MinLength=1
+	APIVersion string `json:"apiVersion"`
+
+	//+kubebuilder:validation:MinLength=1
+	Kind string `json:"kind"`
+
+	// FieldPath is the dot separated path of the object field holding the
+	// flattened data, "spec.data" by default
+	FieldPath string `json:"fieldPath,omitempty"`
 }
 
 // VaultSecretStatus defines the observed state of VaultSecret
 type VaultSecretStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// Conditions represent the latest observations of the VaultSecret state
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// EffectiveConfig is the config the last reconcile resolved from the spec
+	// and the defaults
+	EffectiveConfig *EffectiveConfig `json:"effectiveConfig,omitempty"`
+
+	// Ready reports whether the last reconcile synced the Vault data
+	Ready bool `json:"ready"`
+
+	// LastSyncTime is the time of the last successful sync from the Vault
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// ForceSyncedValue is the apps.vault.op/force-sync annotation value the
+	// last successful sync was forced by
+	ForceSyncedValue string `json:"forceSyncedValue,omitempty"`
+
+	// SyncedGeneration is the generation of the spec the last successful
+	// sync was made from
+	SyncedGeneration int64 `json:"syncedGeneration,omitempty"`
+
+	// SyncedVaultVersion is the KV v2 version of the last synced data, zero
+	// for unversioned secrets
+	SyncedVaultVersion int `json:"syncedVaultVersion,omitempty"`
+
+	// PendingRotationVersion is the newer KV v2 version held back by the
+	// PostRotationDelay, it's read again to be synced from the
+	// RotationConfirmTime
+	PendingRotationVersion int          `json:"pendingRotationVersion,omitempty"`
+	RotationConfirmTime    *metav1.Time `json:"rotationConfirmTime,omitempty"`
+
+	// SourceCreatedTime is the time the KV v2 version of the last synced data
+	// was written to the Vault
+	SourceCreatedTime *metav1.Time `json:"sourceCreatedTime,omitempty"`
+
+	// NextRefreshTime is the time the next sync is scheduled at, if any
+	NextRefreshTime *metav1.Time `json:"nextRefreshTime,omitempty"`
+
+	// DataKeys is the number of keys in the synced Secret data
+	DataKeys int `json:"dataKeys,omitempty"`
+
+	// DryRunKeys are the keys the Secret of a DryRun VaultSecret would hold,
+	// as of the last read
+	DryRunKeys []string `json:"dryRunKeys,omitempty"`
+
+	// LastError is the error of the last failed reconcile, cleared by the
+	// next successful sync
+	LastError string `json:"lastError,omitempty"`
+
+	// ErrorCount is the number of consecutive reconciles that failed with
+	// the LastError
+	ErrorCount int `json:"errorCount,omitempty"`
+
+	// VaultFailures is the number of consecutive reconciles that failed to
+	// log in to or read from the Vault, the retries back off along with it
+	VaultFailures int `json:"vaultFailures,omitempty"`
+
+	// CopiedNamespaces are the namespaces holding a copy of the Secret
+	CopiedNamespaces []string `json:"copiedNamespaces,omitempty"`
+
+	// SplitSecrets are the names of the Secrets of Split written
+	SplitSecrets []string `json:"splitSecrets,omitempty"`
+
+	// PrefixSecrets are the names of the Secrets of the PathPrefix children
+	// written
+	PrefixSecrets []string `json:"prefixSecrets,omitempty"`
+}
+
+// EffectiveConfig is the resolved, secret-free, config used to read the Vault
+type EffectiveConfig struct {
+	VaultAddress        string           `json:"vaultAddress,omitempty"`
+	ReadAddress         string           `json:"readAddress,omitempty"`
+	VaultNamespace      string           `json:"vaultNamespace,omitempty"`
+	AuthMethod          string           `json:"authMethod,omitempty"`
+	AuthPath            string           `json:"authPath,omitempty"`
+	Role                string           `json:"role,omitempty"`
+	Path                string           `json:"path,omitempty"`
+	Backend             string           `json:"backend,omitempty"`
+	RefreshInterval     *metav1.Duration `json:"refreshInterval,omitempty"`
+	PostRotationDelay   *metav1.Duration `json:"postRotationDelay,omitempty"`
+	ForceRotateSchedule string           `json:"forceRotateSchedule,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
+//+kubebuilder:printcolumn:name="Path",type=string,JSONPath=`.status.effectiveConfig.path`
+//+kubebuilder:printcolumn:name="Version",type=integer,JSONPath=`.status.syncedVaultVersion`
+//+kubebuilder:printcolumn:name="Keys",type=integer,JSONPath=`.status.dataKeys`
+//+kubebuilder:printcolumn:name="Last Sync",type=date,JSONPath=`.status.lastSyncTime`
+//+kubebuilder:printcolumn:name="Next Refresh",type=string,JSONPath=`.status.nextRefreshTime`
+//+kubebuilder:printcolumn:name="Error",type=string,JSONPath=`.status.lastError`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // VaultSecret is the Schema for the vaultsecrets API
 type VaultSecret struct {
@@ -0,0 +1,577 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/util/jsonpath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// DefaultKubeconfigKey is the Secret key of the kubeconfig rendered for a
+// KubeconfigOutput without a key
+const DefaultKubeconfigKey = "kubeconfig"
+
+// dockerConfigJSONType is the type of the Secrets of a DockerConfigOutput
+const dockerConfigJSONType = "kubernetes.io/dockerconfigjson"
+
+// DefaultAuthMethod is the AuthMethod of the VaultSecrets without one
+const DefaultAuthMethod = "kubernetes"
+
+// DefaultAuthPaths are the mount paths of the AuthMethods when AuthPath is
+// empty
+var DefaultAuthPaths = map[string]string{
+	"kubernetes": "kubernetes",
+	"jwt":        "jwt",
+	"approle":    "approle",
+	"userpass":   "userpass",
+	"ldap":       "ldap",
+	"aws":        "aws",
+	"gcp":        "gcp",
+}
+
+// secretRefAuthMethods are the AuthMethods logging in with the keys of the
+// SecretRef
+var secretRefAuthMethods = map[string]string{
+	"approle":  "role_id and secret_id",
+	"userpass": "username and password",
+	"ldap":     "username and password",
+}
+
+// DefaultVaultAddress and DefaultAuthPath are the operator wide fallbacks of
+// VaultAddress and AuthPath, set from the flags of the operator. The webhook
+// doesn't require a vaultAddress when DefaultVaultAddress is set.
+// DefaultAuthPath is the mount of the VaultSecrets without an AuthMethod, the
+// other methods keep their DefaultAuthPaths.
+var (
+	DefaultVaultAddress string
+	DefaultAuthPath     string
+)
+
+// JWTDirs are the directories of the operator the JWTPath of the
+// VaultSecrets may point into, set from the flags of the operator. No JWTPath
+// is allowed without them, the authors of the VaultSecrets would have the
+// operator send any of its files to their Vault otherwise.
+var JWTDirs []string
+
+// TokenDirs are the directories of the operator the TokenPath of the
+// VaultSecrets may point into, as the JWTDirs for the JWTPath
+var TokenDirs []string
+
+// CopyNamespaces are the namespaces the Secrets of the VaultSecrets may be
+// copied into, set from the flags of the operator, "*" allowing all of them.
+// No TargetNamespaces are allowed without them, the authors of the
+// VaultSecrets could write into every watched namespace otherwise. The "*"
+// entry and the TargetNamespaceSelector of a VaultSecret only copy into the
+// allowed namespaces.
+var CopyNamespaces []string
+
+// NamespaceIn reports whether the namespace is one of the namespaces, all of
+// them matching the "*" entry
+func NamespaceIn(ns string, namespaces []string) bool {
+	for _, allowed := range namespaces {
+		if allowed == "*" || allowed == ns {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FileInDirs reports whether the absolute file is within one of the dirs
+func FileInDirs(file string, dirs []string) bool {
+	file = path.Clean(file)
+	for _, dir := range dirs {
+		dir = path.Clean(dir)
+		if dir == "/" || strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedDirs describes the directories, or the namespaces, allowed by the
+// operator
+func allowedDirs(dirs []string) string {
+	if len(dirs) == 0 {
+		return "none"
+	}
+
+	return strings.Join(dirs, ", ")
+}
+
+// AuthMethodOrDefault returns the AuthMethod, DefaultAuthMethod when empty
+func (s *VaultSecretSpec) AuthMethodOrDefault() string {
+	if s.AuthMethod == "" {
+		return DefaultAuthMethod
+	}
+
+	return s.AuthMethod
+}
+
+// AuthPathOrDefault returns the AuthPath, the default mount of the AuthMethod
+// when empty
+func (s *VaultSecretSpec) AuthPathOrDefault() string {
+	if s.AuthPath == "" && s.AuthMethod == "" && DefaultAuthPath != "" {
+		return DefaultAuthPath
+	}
+	if s.AuthPath == "" {
+		return DefaultAuthPaths[s.AuthMethodOrDefault()]
+	}
+
+	return s.AuthPath
+}
+
+// RequiresAllKeys returns the RequireAllKeys, true when unset
+func (s *VaultSecretSpec) RequiresAllKeys() bool {
+	return s.RequireAllKeys == nil || *s.RequireAllKeys
+}
+
+// PreservesOnEmpty returns the PreserveOnEmpty, true when unset
+func (s *VaultSecretSpec) PreservesOnEmpty() bool {
+	return s.PreserveOnEmpty == nil || *s.PreserveOnEmpty
+}
+
+// SecretNameOrDefault returns the SecretName, the name of the VaultSecret
+// when empty
+func (r *VaultSecret) SecretNameOrDefault() string {
+	if r.Spec.SecretName == "" {
+		return r.Name
+	}
+
+	return r.Spec.SecretName
+}
+
+// log is for logging in this package.
+var vaultsecretlog = logf.Log.WithName("vaultsecret-resource")
+
+func (r *VaultSecret) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-apps-vault-op-v1-vaultsecret,mutating=true,failurePolicy=fail,sideEffects=None,groups=apps.vault.op,resources=vaultsecrets,verbs=create;update,versions=v1,name=mvaultsecret.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &VaultSecret{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *VaultSecret) Default() {
+	vaultsecretlog.Info("default", "name", r.Name)
+
+	// The AuthPath of a ConfigRef or a ConnectionRef is resolved at reconcile
+	if r.Spec.ConfigRef == "" && r.Spec.ConnectionRef == "" {
+		r.Spec.AuthPath = r.Spec.AuthPathOrDefault()
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-apps-vault-op-v1-vaultsecret,mutating=false,failurePolicy=fail,sideEffects=None,groups=apps.vault.op,resources=vaultsecrets,verbs=create;update,versions=v1,name=vvaultsecret.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &VaultSecret{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *VaultSecret) ValidateCreate() error {
+	vaultsecretlog.Info("validate create", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *VaultSecret) ValidateUpdate(old runtime.Object) error {
+	vaultsecretlog.Info("validate update", "name", r.Name)
+
+	if old, ok := old.(*VaultSecret); ok && old.SecretNameOrDefault() != r.SecretNameOrDefault() {
+		return apierrors.NewInvalid(GroupVersion.WithKind("VaultSecret").GroupKind(), r.Name, field.ErrorList{
+			field.Forbidden(field.NewPath("spec", "secretName"), "the Secret isn't renamed, it's "+old.SecretNameOrDefault()),
+		})
+	}
+
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *VaultSecret) ValidateDelete() error {
+	return nil
+}
+
+// validate checks the required fields, dry-runs the templates against empty
+// data and checks the Secret keys the spec writes to, so that the errors show
+// up at apply time rather than at reconcile. The role may come from the
+// ServiceAccount, it's resolved at reconcile.
+func (r *VaultSecret) validate() error {
+	spec := field.NewPath("spec")
+	var errs field.ErrorList
+
+	if r.Spec.Path == "" && r.Spec.PathTemplate == "" && r.Spec.PathPrefix == "" {
+		errs = append(errs, field.Required(spec.Child("path"), "the Vault path to read, unless pathTemplate or pathPrefix is set"))
+	}
+	if strings.Contains(r.Spec.Path, "{{") {
+		if _, err := template.New("path").Parse(r.Spec.Path); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("path"), r.Spec.Path, err.Error()))
+		}
+	}
+
+	if r.Spec.PathPrefix != "" {
+		pathPrefix := spec.Child("pathPrefix")
+		forbidden := map[string]bool{
+			"path":                    r.Spec.Path != "",
+			"pathTemplate":            r.Spec.PathTemplate != "",
+			"paths":                   len(r.Spec.Paths) > 0,
+			"targetRef":               r.Spec.TargetRef != nil,
+			"chunkKeys":               r.Spec.ChunkKeys,
+			"targetNamespaces":        len(r.Spec.TargetNamespaces) > 0,
+			"targetNamespaceSelector": r.Spec.TargetNamespaceSelector != nil,
+			"split":                   len(r.Spec.Split) > 0,
+		}
+		for _, name := range []string{"path", "pathTemplate", "paths", "targetRef", "chunkKeys", "targetNamespaces", "targetNamespaceSelector", "split"} {
+			if forbidden[name] {
+				errs = append(errs, field.Forbidden(pathPrefix, "a pathPrefix doesn't take "+name))
+			}
+		}
+		if r.Spec.TargetKind == TargetKindConfigMap {
+			errs = append(errs, field.Forbidden(pathPrefix, "a pathPrefix writes Secrets, not a ConfigMap"))
+		}
+	} else if r.Spec.Recursive {
+		errs = append(errs, field.Forbidden(spec.Child("recursive"), "only a pathPrefix is listed recursively"))
+	}
+
+	if r.Spec.SecretName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(r.Spec.SecretName) {
+			errs = append(errs, field.Invalid(spec.Child("secretName"), r.Spec.SecretName, msg))
+		}
+	}
+
+	vaultAddress := spec.Child("vaultAddress")
+	switch {
+	case r.Spec.VaultAddress == "" && DefaultVaultAddress == "" && r.Spec.ConfigRef == "" && r.Spec.ConnectionRef == "" && (r.Spec.Backend == "" || r.Spec.Backend == "vault"):
+		errs = append(errs, field.Required(vaultAddress, "the address of the Vault"))
+	case r.Spec.VaultAddress != "":
+		errs = append(errs, validateAddress(vaultAddress, r.Spec.VaultAddress)...)
+	}
+	if r.Spec.ReadAddress != "" {
+		errs = append(errs, validateAddress(spec.Child("readAddress"), r.Spec.ReadAddress)...)
+	}
+
+	// targets maps the keys written by the spec to the field writing them
+	targets := map[string]*field.Path{}
+	target := func(path *field.Path, key string) {
+		for _, msg := range validation.IsConfigMapKey(key) {
+			errs = append(errs, field.Invalid(path, key, msg))
+		}
+		if other, ok := targets[key]; ok {
+			errs = append(errs, field.Duplicate(path, key+" is also written by "+other.String()))
+			return
+		}
+		targets[key] = path
+	}
+
+	if r.Spec.KeyPrefix != "" {
+		for _, msg := range validation.IsConfigMapKey(r.Spec.KeyPrefix) {
+			errs = append(errs, field.Invalid(spec.Child("keyPrefix"), r.Spec.KeyPrefix, msg))
+		}
+	}
+	paths := spec.Child("paths")
+	for i, path := range r.Spec.Paths {
+		if path.KeyPrefix == "" {
+			continue
+		}
+		for _, msg := range validation.IsConfigMapKey(path.KeyPrefix) {
+			errs = append(errs, field.Invalid(paths.Index(i).Child("keyPrefix"), path.KeyPrefix, msg))
+		}
+	}
+
+	data := spec.Child("data")
+	for i, mapping := range r.Spec.Data {
+		target(data.Index(i).Child("secretKey"), mapping.TargetKey())
+		if mapping.JSONPath != "" {
+			if err := jsonpath.New(mapping.VaultKey).Parse(mapping.JSONPathTemplate()); err != nil {
+				errs = append(errs, field.Invalid(data.Index(i).Child("jsonPath"), mapping.JSONPath, err.Error()))
+			}
+		}
+	}
+
+	templates := spec.Child("templates")
+	for _, key := range sortedKeys(r.Spec.Templates) {
+		target(templates.Key(key), key)
+		if err := dryRun(key, r.Spec.Templates[key], templateFuncs, map[string]string{}); err != nil {
+			errs = append(errs, field.Invalid(templates.Key(key), r.Spec.Templates[key], err.Error()))
+		}
+	}
+
+	if r.Spec.Template != nil && len(r.Spec.Template.Data) > 0 {
+		templateData := spec.Child("template", "data")
+		for _, key := range sortedKeys(r.Spec.Template.Data) {
+			for _, msg := range validation.IsConfigMapKey(key) {
+				errs = append(errs, field.Invalid(templateData.Key(key), key, msg))
+			}
+			if err := dryRun(key, r.Spec.Template.Data[key], valueFuncs, map[string]string{}); err != nil {
+				errs = append(errs, field.Invalid(templateData.Key(key), r.Spec.Template.Data[key], err.Error()))
+			}
+		}
+		if r.Spec.Format != nil {
+			errs = append(errs, field.Forbidden(spec.Child("format"), "the format replaces the data rendered by template.data"))
+		}
+	}
+
+	if r.Spec.Format != nil {
+		format := spec.Child("format")
+		target(format.Child("key"), r.Spec.Format.Key)
+		switch r.Spec.Format.Type {
+		case "", SecretFormatTemplate:
+			if r.Spec.Format.Template == "" {
+				errs = append(errs, field.Required(format.Child("template"), "the template type needs a template"))
+			} else if err := dryRun(r.Spec.Format.Key, r.Spec.Format.Template, formatFuncs, nil); err != nil {
+				errs = append(errs, field.Invalid(format.Child("template"), r.Spec.Format.Template, err.Error()))
+			}
+		default:
+			if r.Spec.Format.Template != "" {
+				errs = append(errs, field.Forbidden(format.Child("template"), "the "+r.Spec.Format.Type+" type serializes the Secret data"))
+			}
+		}
+	}
+
+	if r.Spec.IncludePathKey != "" {
+		target(spec.Child("includePathKey"), r.Spec.IncludePathKey)
+	}
+
+	if out := r.Spec.KubeconfigOutput; out != nil {
+		key := out.Key
+		if key == "" {
+			key = DefaultKubeconfigKey
+		}
+		target(spec.Child("kubeconfigOutput", "key"), key)
+	}
+
+	if r.Spec.DockerConfigOutput != nil {
+		dockerConfigOutput := spec.Child("dockerConfigOutput")
+		if r.Spec.Format != nil {
+			errs = append(errs, field.Forbidden(dockerConfigOutput, "the format replaces the .dockerconfigjson"))
+		}
+		if r.Spec.SecretType != "" && r.Spec.SecretType != dockerConfigJSONType {
+			errs = append(errs, field.Invalid(spec.Child("secretType"), r.Spec.SecretType, "a dockerConfigOutput writes a "+dockerConfigJSONType+" Secret"))
+		}
+	}
+
+	if path := r.Spec.AuthPath; path != "" {
+		method := r.Spec.AuthMethodOrDefault()
+		authPath := spec.Child("authPath")
+		if strings.HasPrefix(path, "auth/") || strings.HasSuffix(path, "/login") {
+			errs = append(errs, field.Invalid(authPath, path, "the mount path of the auth method, without the auth/ prefix and the /login suffix"))
+		}
+		for other, mount := range DefaultAuthPaths {
+			if other != method && path == mount {
+				errs = append(errs, field.Invalid(authPath, path, "the default mount of the "+other+" auth method, not of "+method))
+			}
+		}
+	}
+
+	if len(r.Spec.TargetNamespaces) > 0 || r.Spec.TargetNamespaceSelector != nil {
+		targetNamespaces := spec.Child("targetNamespaces")
+		if len(CopyNamespaces) == 0 {
+			errs = append(errs, field.Forbidden(targetNamespaces, "the namespaces allowed by the operator, none"))
+		}
+		for i, ns := range r.Spec.TargetNamespaces {
+			if ns == "*" {
+				continue
+			}
+			for _, msg := range validation.IsDNS1123Label(ns) {
+				errs = append(errs, field.Invalid(targetNamespaces.Index(i), ns, msg))
+			}
+			if len(CopyNamespaces) > 0 && !NamespaceIn(ns, CopyNamespaces) {
+				errs = append(errs, field.Forbidden(targetNamespaces.Index(i), "one of the namespaces allowed by the operator, "+allowedDirs(CopyNamespaces)))
+			}
+		}
+		if selector := r.Spec.TargetNamespaceSelector; selector != nil {
+			if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+				errs = append(errs, field.Invalid(spec.Child("targetNamespaceSelector"), selector, err.Error()))
+			}
+		}
+		if r.Spec.ChunkKeys {
+			errs = append(errs, field.Forbidden(targetNamespaces, "the Secret chunks aren't copied to other namespaces"))
+		}
+		if r.Spec.TargetRef != nil {
+			errs = append(errs, field.Forbidden(targetNamespaces, "the data of a targetRef object isn't copied to other namespaces"))
+		}
+	}
+
+	if len(r.Spec.Split) > 0 {
+		split := spec.Child("split")
+		names := map[string]bool{r.SecretNameOrDefault(): true}
+		for i, s := range r.Spec.Split {
+			for _, msg := range validation.IsDNS1123Subdomain(s.Name) {
+				errs = append(errs, field.Invalid(split.Index(i).Child("name"), s.Name, msg))
+			}
+			if names[s.Name] {
+				errs = append(errs, field.Duplicate(split.Index(i).Child("name"), s.Name))
+			}
+			names[s.Name] = true
+		}
+		if r.Spec.TargetRef != nil {
+			errs = append(errs, field.Forbidden(split, "the data of a targetRef object isn't split"))
+		}
+	}
+
+	if r.Spec.TargetKind == TargetKindConfigMap {
+		targetKind := spec.Child("targetKind")
+		forbidden := map[string]bool{
+			"targetRef":               r.Spec.TargetRef != nil,
+			"secretType":              r.Spec.SecretType != "",
+			"chunkKeys":               r.Spec.ChunkKeys,
+			"immutable":               r.Spec.Immutable,
+			"targetNamespaces":        len(r.Spec.TargetNamespaces) > 0,
+			"targetNamespaceSelector": r.Spec.TargetNamespaceSelector != nil,
+			"split":                   len(r.Spec.Split) > 0,
+			"dockerConfigOutput":      r.Spec.DockerConfigOutput != nil,
+		}
+		for _, name := range []string{"targetRef", "secretType", "chunkKeys", "immutable", "targetNamespaces", "targetNamespaceSelector", "split", "dockerConfigOutput"} {
+			if forbidden[name] {
+				errs = append(errs, field.Forbidden(targetKind, "a ConfigMap target doesn't take "+name))
+			}
+		}
+	}
+
+	if r.Spec.JWTPath != "" {
+		jwtPath := spec.Child("jwtPath")
+		if !path.IsAbs(r.Spec.JWTPath) {
+			errs = append(errs, field.Invalid(jwtPath, r.Spec.JWTPath, "an absolute path"))
+		} else if !FileInDirs(r.Spec.JWTPath, JWTDirs) {
+			errs = append(errs, field.Forbidden(jwtPath, "a file of the directories allowed by the operator, "+allowedDirs(JWTDirs)))
+		}
+		if _, ok := secretRefAuthMethods[r.Spec.AuthMethodOrDefault()]; ok {
+			errs = append(errs, field.Forbidden(jwtPath, "the "+r.Spec.AuthMethod+" authMethod logs in without a JWT"))
+		}
+	}
+
+	if r.Spec.Audience != "" {
+		audience := spec.Child("audience")
+		if _, ok := secretRefAuthMethods[r.Spec.AuthMethodOrDefault()]; ok {
+			errs = append(errs, field.Forbidden(audience, "the "+r.Spec.AuthMethod+" authMethod logs in without a JWT"))
+		}
+		if r.Spec.JWTPath != "" {
+			errs = append(errs, field.Forbidden(audience, "the JWT of the jwtPath is logged in with instead"))
+		}
+	}
+
+	if r.Spec.TokenPath != "" {
+		tokenPath := spec.Child("tokenPath")
+		if !path.IsAbs(r.Spec.TokenPath) {
+			errs = append(errs, field.Invalid(tokenPath, r.Spec.TokenPath, "an absolute path"))
+		} else if !FileInDirs(r.Spec.TokenPath, TokenDirs) {
+			errs = append(errs, field.Forbidden(tokenPath, "a file of the directories allowed by the operator, "+allowedDirs(TokenDirs)))
+		}
+		if r.Spec.AuthMethod != "token_file" {
+			errs = append(errs, field.Forbidden(tokenPath, "the token file of the token_file authMethod"))
+		}
+	}
+
+	if keys, ok := secretRefAuthMethods[r.Spec.AuthMethod]; ok && r.Spec.SecretRef == "" {
+		errs = append(errs, field.Required(spec.Child("secretRef"), "the "+r.Spec.AuthMethod+" authMethod logs in with the "+keys+" of a Secret"))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("VaultSecret").GroupKind(), r.Name, errs)
+}
+
+// valueFuncs, templateFuncs and formatFuncs stub the functions the controller
+// provides to Template.Data, Templates and Format, they return empty values
+// for the dry run
+var (
+	valueFuncs = template.FuncMap{
+		"toJSON":       func(v interface{}) (string, error) { return "", nil },
+		"toJson":       func(v interface{}) (string, error) { return "", nil },
+		"toJSONPretty": func(v interface{}) (string, error) { return "", nil },
+		"base64Encode": func(s string) string { return "" },
+		"base64encode": func(s string) string { return "" },
+		"base64Decode": func(s string) (string, error) { return "", nil },
+		"base64decode": func(s string) (string, error) { return "", nil },
+		"toUpper":      func(s string) string { return "" },
+		"toLower":      func(s string) string { return "" },
+		"trimSpace":    func(s string) string { return "" },
+	}
+
+	templateFuncs = withFuncs(valueFuncs, template.FuncMap{
+		"secrets": func(name, key string) (string, error) { return "", nil },
+	})
+
+	formatFuncs = withFuncs(valueFuncs, template.FuncMap{
+		"secret": func(path string) (interface{}, error) { return nil, nil },
+	})
+)
+
+// validateAddress checks that the address is an http or https URL
+func validateAddress(path *field.Path, address string) field.ErrorList {
+	u, err := url.Parse(address)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, address, err.Error())}
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return field.ErrorList{field.Invalid(path, address, "an http or https URL, e.g. https://vault:8200")}
+	}
+
+	return nil
+}
+
+// withFuncs returns the functions of base along with the extra ones
+func withFuncs(base, extra template.FuncMap) template.FuncMap {
+	funcs := template.FuncMap{}
+	for name, f := range base {
+		funcs[name] = f
+	}
+	for name, f := range extra {
+		funcs[name] = f
+	}
+
+	return funcs
+}
+
+// dryRun parses the template and executes it against the data, the keys
+// missing from the data are empty strings
+func dryRun(name, text string, funcs template.FuncMap, data interface{}) error {
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(ioutil.Discard, data)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
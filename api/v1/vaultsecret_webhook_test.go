@@ -0,0 +1,425 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("VaultSecret webhook", func() {
+	newVaultSecret := func(spec VaultSecretSpec) *VaultSecret {
+		if spec.VaultAddress == "" {
+			spec.VaultAddress = "https://vault:8200"
+		}
+		return &VaultSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec:       spec,
+		}
+	}
+
+	It("accepts valid templates and mappings", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path:           "secret/app",
+			Templates:      map[string]string{"url": `postgres://{{ secrets "db" "host" }}`},
+			Format:         &SecretFormat{Key: "config.json", Template: `{{ with secret "secret/app" }}{{ .Data.data | toJSON }}{{ end }}`},
+			IncludePathKey: "path",
+		})
+		Expect(vs.ValidateCreate()).To(Succeed())
+		Expect(vs.ValidateUpdate(vs.DeepCopy())).To(Succeed())
+	})
+
+	It("requires the path and a valid vaultAddress", func() {
+		vs := &VaultSecret{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}}
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.path: Required value"))
+		Expect(err.Error()).To(ContainSubstring("spec.vaultAddress: Required value"))
+
+		vs.Spec.PathTemplate = "secret/data/{{namespace}}/{{name}}"
+		vs.Spec.VaultAddress = "vault:8200"
+		err = vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).NotTo(ContainSubstring("spec.path"))
+		Expect(err.Error()).To(ContainSubstring("spec.vaultAddress: Invalid value"))
+
+		vs.Spec.VaultAddress = "http://vault:8200"
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("parses a templated path", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/data/{{ .Namespace }}/config"})
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.Path = "secret/data/{{ .Namespace }/config"
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.path: Invalid value"))
+	})
+
+	It("takes the operator wide Vault address and auth path", func() {
+		DefaultVaultAddress = "https://vault:8200"
+		DefaultAuthPath = "kubernetes-prod"
+		defer func() {
+			DefaultVaultAddress = ""
+			DefaultAuthPath = ""
+		}()
+
+		vs := &VaultSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec:       VaultSecretSpec{Path: "secret/app"},
+		}
+		Expect(vs.ValidateCreate()).To(Succeed())
+		vs.Default()
+		Expect(vs.Spec.AuthPath).To(Equal("kubernetes-prod"))
+
+		vs = newVaultSecret(VaultSecretSpec{Path: "secret/app", AuthMethod: "approle"})
+		vs.Default()
+		Expect(vs.Spec.AuthPath).To(Equal("approle"))
+	})
+
+	It("defaults the authPath to the mount of the authMethod", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app"})
+		vs.Default()
+		Expect(vs.Spec.AuthPath).To(Equal("kubernetes"))
+
+		vs = newVaultSecret(VaultSecretSpec{Path: "secret/app", AuthMethod: "approle", AuthPath: "approle-prod"})
+		vs.Default()
+		Expect(vs.Spec.AuthPath).To(Equal("approle-prod"))
+	})
+
+	It("rejects a malformed template", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path:      "secret/app",
+			Templates: map[string]string{"url": `{{ secrets "db" "host" `},
+		})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.templates[url]"))
+	})
+
+	It("rejects a template calling an unknown function", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path:   "secret/app",
+			Format: &SecretFormat{Key: "config", Template: `{{ vault "secret/app" }}`},
+		})
+		err := vs.ValidateUpdate(vs.DeepCopy())
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.format.template"))
+	})
+
+	It("checks the template of the format type", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", Format: &SecretFormat{Key: "config.json", Type: SecretFormatJSON}})
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.Format.Template = "x"
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.format.template: Forbidden"))
+
+		vs.Spec.Format = &SecretFormat{Key: "config", Type: SecretFormatTemplate}
+		err = vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.format.template: Required"))
+	})
+
+	It("rejects duplicate mapping targets", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path:             "secret/app",
+			Templates:        map[string]string{"kubeconfig": "x"},
+			IncludePathKey:   "kubeconfig",
+			KubeconfigOutput: &KubeconfigOutput{Server: "https://k8s"},
+		})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.includePathKey: Duplicate value"))
+		Expect(err.Error()).To(ContainSubstring("spec.kubeconfigOutput.key: Duplicate value"))
+	})
+
+	It("restricts the dockerConfigOutput to dockerconfigjson Secrets", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path:               "secret/app",
+			SecretType:         "kubernetes.io/dockerconfigjson",
+			DockerConfigOutput: &DockerConfigOutput{},
+		})
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.SecretType = "kubernetes.io/tls"
+		vs.Spec.Format = &SecretFormat{Key: "config", Type: SecretFormatJSON}
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.secretType: Invalid value"))
+		Expect(err.Error()).To(ContainSubstring("spec.dockerConfigOutput: Forbidden"))
+	})
+
+	It("takes a pathPrefix in place of the path", func() {
+		vs := newVaultSecret(VaultSecretSpec{PathPrefix: "secret/apps/", Recursive: true})
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.Path = "secret/app"
+		vs.Spec.Split = []SplitSecret{{Name: "db", Keys: []string{"password"}}}
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("a pathPrefix doesn't take path"))
+		Expect(err.Error()).To(ContainSubstring("a pathPrefix doesn't take split"))
+
+		vs = newVaultSecret(VaultSecretSpec{Path: "secret/app", Recursive: true})
+		Expect(vs.ValidateCreate()).To(MatchError(ContainSubstring("spec.recursive: Forbidden")))
+	})
+
+	It("checks the template data", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path:     "secret/app",
+			Template: &SecretTemplate{Data: map[string]string{"auth": `{{ .user | base64encode }}`, "config": `{{ . | toJson }}`}},
+		})
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.Template.Data["config"] = `{{ . | toYaml }}`
+		vs.Spec.Format = &SecretFormat{Key: "config", Template: "x"}
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.template.data[config]"))
+		Expect(err.Error()).To(ContainSubstring("spec.format: Forbidden"))
+	})
+
+	It("rejects the approle authMethod without a secretRef", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", AuthMethod: "approle"})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.secretRef"))
+
+		vs.Spec.SecretRef = "approle-creds"
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("rejects the userpass and ldap authMethods without a secretRef", func() {
+		for _, method := range []string{"userpass", "ldap"} {
+			vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", AuthMethod: method})
+			err := vs.ValidateCreate()
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("username and password"))
+
+			vs.Spec.SecretRef = method + "-creds"
+			Expect(vs.ValidateCreate()).To(Succeed())
+		}
+	})
+
+	It("takes a tokenPath with the token_file authMethod only", func() {
+		TokenDirs = []string{"/vault"}
+		defer func() { TokenDirs = nil }()
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", TokenPath: "/vault/token"})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.tokenPath: Forbidden"))
+
+		vs.Spec.AuthMethod = "token_file"
+		vs.Spec.TokenPath = "token"
+		Expect(vs.ValidateCreate()).NotTo(Succeed())
+
+		vs.Spec.TokenPath = "/vault/token"
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.TokenPath = "/etc/token"
+		err = vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("directories allowed by the operator, /vault"))
+	})
+
+	It("refuses the Secret options with the ConfigMap targetKind", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", TargetKind: TargetKindConfigMap})
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.SecretType = "kubernetes.io/tls"
+		vs.Spec.TargetNamespaces = []string{"other"}
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("a ConfigMap target doesn't take secretType"))
+		Expect(err.Error()).To(ContainSubstring("a ConfigMap target doesn't take targetNamespaces"))
+	})
+
+	It("takes the vaultAddress and authPath from a configRef", func() {
+		vs := &VaultSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec:       VaultSecretSpec{Path: "secret/app", ConfigRef: "vault-connection"},
+		}
+		vs.Default()
+		Expect(vs.Spec.AuthPath).To(BeEmpty())
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("takes the vaultAddress and authPath from a connectionRef", func() {
+		vs := &VaultSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec:       VaultSecretSpec{Path: "secret/app", ConnectionRef: "vault"},
+		}
+		vs.Default()
+		Expect(vs.Spec.AuthPath).To(BeEmpty())
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("checks the secretName and refuses to rename the Secret", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", SecretName: "Not_A_Name"})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.secretName: Invalid value"))
+
+		vs.Spec.SecretName = "test"
+		Expect(vs.ValidateUpdate(newVaultSecret(VaultSecretSpec{Path: "secret/app"}))).To(Succeed())
+
+		vs.Spec.SecretName = "app-credentials"
+		err = vs.ValidateUpdate(newVaultSecret(VaultSecretSpec{Path: "secret/app"}))
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("the Secret isn't renamed, it's test"))
+	})
+
+	It("checks the names of the split Secrets", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", Split: []SplitSecret{
+			{Name: "app-db", Keys: []string{"password"}},
+		}})
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.Split = append(vs.Spec.Split, SplitSecret{Name: "test", Keys: []string{"token"}}, SplitSecret{Name: "App_Cache", Keys: []string{"token"}})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring(`spec.split[1].name: Duplicate value: "test"`))
+		Expect(err.Error()).To(ContainSubstring("spec.split[2].name: Invalid value"))
+	})
+
+	It("rejects the default mount of another authMethod", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", AuthMethod: "jwt", AuthPath: "kubernetes"})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("the default mount of the kubernetes auth method"))
+
+		vs.Spec.AuthPath = "auth/jwt/login"
+		Expect(vs.ValidateCreate()).NotTo(Succeed())
+
+		vs.Spec.AuthMethod = ""
+		vs.Spec.AuthPath = "k8s-prod"
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("rejects key mappings into the same Secret key", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path: "secret/app",
+			Data: []KeyMapping{{VaultKey: "user"}, {VaultKey: "login", SecretKey: "user"}},
+		})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.data[1].secretKey"))
+	})
+
+	It("rejects a malformed jsonPath", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path: "secret/app",
+			Data: []KeyMapping{{VaultKey: "config", SecretKey: "password", JSONPath: ".database[0"}},
+		})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.data[0].jsonPath"))
+
+		vs.Spec.Data[0].JSONPath = ".database.password"
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("rejects illegal key names", func() {
+		vs := newVaultSecret(VaultSecretSpec{
+			Path:           "secret/app",
+			KeyPrefix:      "app ",
+			Paths:          []VaultPath{{Path: "secret/db", KeyPrefix: "db "}},
+			IncludePathKey: "vault path",
+		})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.includePathKey"))
+		Expect(err.Error()).To(ContainSubstring("spec.keyPrefix"))
+		Expect(err.Error()).To(ContainSubstring("spec.paths[0].keyPrefix"))
+	})
+
+	It("checks the target namespaces", func() {
+		CopyNamespaces = []string{"*"}
+		defer func() { CopyNamespaces = nil }()
+		vs := newVaultSecret(VaultSecretSpec{
+			Path:             "secret/app",
+			TargetNamespaces: []string{"team-a", "Team_B"},
+			ChunkKeys:        true,
+		})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.targetNamespaces[1]"))
+		Expect(err.Error()).To(ContainSubstring("the Secret chunks aren't copied to other namespaces"))
+
+		vs.Spec.TargetNamespaces = []string{"*"}
+		vs.Spec.ChunkKeys = false
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("requires the target namespaces allowed by the operator", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", TargetNamespaces: []string{"team-a"}})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("the namespaces allowed by the operator, none"))
+
+		CopyNamespaces = []string{"team-a", "team-b"}
+		defer func() { CopyNamespaces = nil }()
+		Expect(vs.ValidateCreate()).To(Succeed())
+
+		vs.Spec.TargetNamespaces = []string{"team-a", "kube-system"}
+		err = vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.targetNamespaces[1]"))
+		Expect(err.Error()).To(ContainSubstring("one of the namespaces allowed by the operator, team-a, team-b"))
+	})
+
+	It("requires an absolute jwtPath", func() {
+		JWTDirs = []string{"/var/run/secrets/vault"}
+		defer func() { JWTDirs = nil }()
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", JWTPath: "token"})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.jwtPath"))
+
+		vs.Spec.JWTPath = "/var/run/secrets/vault/token"
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("requires a jwtPath within the JWTDirs", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", JWTPath: "/var/run/secrets/vault/token"})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("directories allowed by the operator, none"))
+
+		JWTDirs = []string{"/var/run/secrets/vault"}
+		defer func() { JWTDirs = nil }()
+		vs.Spec.JWTPath = "/var/run/secrets/vault/../../../../etc/passwd"
+		Expect(vs.ValidateCreate()).NotTo(Succeed())
+		vs.Spec.JWTPath = "/var/run/secrets/vault/token"
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+
+	It("refuses an audience along with a jwtPath", func() {
+		vs := newVaultSecret(VaultSecretSpec{Path: "secret/app", Audience: "vault", JWTPath: "/var/run/secrets/vault/token"})
+		err := vs.ValidateCreate()
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.audience"))
+
+		vs.Spec.JWTPath = ""
+		Expect(vs.ValidateCreate()).To(Succeed())
+	})
+})
@@ -0,0 +1,93 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// fieldOwner is the field manager of the child Secrets written with a
+// server-side apply
+const fieldOwner = "vault-operator"
+
+// writeSecret creates or updates the child Secret of the VaultSecret. With
+// ServerSideApply, the fields of the operator are applied instead and the
+// ones of the other managers are left to them. A field of the operator that
+// another manager changed since fails the apply with a conflict, the
+// ownership isn't forced.
+func (r *VaultSecretReconciler) writeSecret(ctx context.Context, vs *appsv1.VaultSecret, secret *core.Secret, create bool) (err error) {
+	ctx, span := tracer.Start(ctx, "secret.write", trace.WithAttributes(
+		attribute.String("secret.namespace", secret.Namespace),
+		attribute.String("secret.name", secret.Name),
+	))
+	defer func() { endSpan(span, err) }()
+
+	switch {
+	case r.ServerSideApply:
+		return r.Patch(ctx, appliedSecret(vs, secret), client.Apply, client.FieldOwner(fieldOwner))
+	case create:
+		return r.Create(ctx, secret)
+	default:
+		return r.Update(ctx, secret)
+	}
+}
+
+// appliedSecret returns the fields of the child Secret owned by the operator:
+// its managed keys, its reserved annotations and owner labels, the labels and
+// annotations of the Template, and its controller reference
+func appliedSecret(vs *appsv1.VaultSecret, secret *core.Secret) *core.Secret {
+	applied := &core.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   secret.Namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{},
+		},
+		Type:      secret.Type,
+		Data:      managedData(secret),
+		Immutable: secret.Immutable,
+	}
+	if owner := metav1.GetControllerOf(secret); owner != nil {
+		applied.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+
+	var template appsv1.SecretTemplateMetadata
+	if vs.Spec.Template != nil {
+		template = vs.Spec.Template.Metadata
+	}
+	for k, v := range secret.Labels {
+		if _, ok := template.Labels[k]; ok || isReservedAnnotation(k) || k == managedByLabel {
+			applied.Labels[k] = v
+		}
+	}
+	for k, v := range secret.Annotations {
+		if _, ok := template.Annotations[k]; ok || (isReservedAnnotation(k) && k != adoptAnnotation) {
+			applied.Annotations[k] = v
+		}
+	}
+
+	return applied
+}
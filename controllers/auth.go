@@ -0,0 +1,242 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	kubernetesAuthMethod = "kubernetes"
+	jwtAuthMethod        = "jwt"
+	appRoleAuthMethod    = "approle"
+	userpassAuthMethod   = "userpass"
+	ldapAuthMethod       = "ldap"
+
+	// appRoleIDKey and appRoleSecretIDKey are the keys of the AppRole
+	// credentials in the auth Secret
+	appRoleIDKey       = "role_id"
+	appRoleSecretIDKey = "secret_id"
+
+	// usernameKey and passwordKey are the keys of the userpass and LDAP
+	// credentials in the auth Secret
+	usernameKey = "username"
+	passwordKey = "password"
+)
+
+// Authenticator is a Vault auth method the operator logs in with, mounted at
+// its appsv1.DefaultAuthPaths unless AuthPath is set. The reconciler sends
+// the login to auth/<AuthPath>/login, an Authenticator only provides its
+// body, and its endpoint if it implements loginPather. The AuthMethod enum of the CRD lists the methods VaultSecrets may
+// select.
+type Authenticator interface {
+	// UsesRole reports whether the login needs the Vault role of the
+	// VaultSecret
+	UsesRole() bool
+
+	// LoginData returns the body of the auth/<authPath>/login request
+	LoginData(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (map[string]interface{}, error)
+}
+
+// loginPather is implemented by the Authenticators logging in on another
+// endpoint than auth/<AuthPath>/login. LoginPath returns the endpoint under
+// the auth/<AuthPath>/ mount for the login data.
+type loginPather interface {
+	LoginPath(loginData map[string]interface{}) string
+}
+
+// credentialsForgetter is implemented by the Authenticators remembering the
+// credentials read by LoginData. They're dropped after the login was denied,
+// and the login is retried once.
+type credentialsForgetter interface {
+	ForgetCredentials(r *VaultSecretReconciler, vaultConfig VaultConfig)
+}
+
+// tokenReader is implemented by the Authenticators providing a Vault token
+// rather than a login. The token is read again for every request, it isn't
+// cached.
+type tokenReader interface {
+	ReadToken(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (string, error)
+}
+
+var (
+	authenticatorsMu sync.RWMutex
+	authenticators   = map[string]Authenticator{}
+)
+
+// RegisterAuthenticator makes an auth method available to VaultSecrets under
+// the given AuthMethod name. It's meant to be called from init() by compiled
+// in methods.
+func RegisterAuthenticator(name string, authenticator Authenticator) {
+	authenticatorsMu.Lock()
+	defer authenticatorsMu.Unlock()
+	authenticators[name] = authenticator
+}
+
+// authenticator returns the Authenticator registered for the AuthMethod
+func authenticator(method string) (Authenticator, bool) {
+	authenticatorsMu.RLock()
+	defer authenticatorsMu.RUnlock()
+	authenticator, ok := authenticators[method]
+
+	return authenticator, ok
+}
+
+// The kubernetes and jwt backends take the same login, they differ on the
+// Vault side only
+func init() {
+	RegisterAuthenticator(kubernetesAuthMethod, jwtAuthenticator{})
+	RegisterAuthenticator(jwtAuthMethod, jwtAuthenticator{})
+	RegisterAuthenticator(appRoleAuthMethod, appRoleAuthenticator{})
+	RegisterAuthenticator(userpassAuthMethod, passwordAuthenticator{})
+	RegisterAuthenticator(ldapAuthMethod, passwordAuthenticator{})
+}
+
+// jwtAuthenticator logs in with the ServiceAccount JWT of the operator, or
+// the one of the JWTPath
+type jwtAuthenticator struct{}
+
+func (jwtAuthenticator) UsesRole() bool {
+	return true
+}
+
+// LoginData reads the JWT on every login, projected tokens are short-lived
+// and rotated by the kubelet. The reads are cached until the file changes.
+// With an Audience a token is requested for the login instead.
+func (jwtAuthenticator) LoginData(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (map[string]interface{}, error) {
+	if vaultConfig.Audience != "" {
+		jwt, err := r.serviceAccountToken(ctx, vaultConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"jwt":  jwt,
+			"role": vaultConfig.Role,
+		}, nil
+	}
+
+	if vaultConfig.JWTPath != "" && !appsv1.FileInDirs(vaultConfig.JWTPath, r.JWTDirs) {
+		return nil, fmt.Errorf("the JWT file %s is outside of the directories allowed by the operator", vaultConfig.JWTPath)
+	}
+	file := jwtFile(vaultConfig)
+	jwt, err := r.jwts.read(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the JWT file %s: %w", file, err)
+	}
+
+	return map[string]interface{}{
+		"jwt":  string(jwt),
+		"role": vaultConfig.Role,
+	}, nil
+}
+
+// ForgetCredentials drops the cached JWT logged in with
+func (jwtAuthenticator) ForgetCredentials(r *VaultSecretReconciler, vaultConfig VaultConfig) {
+	r.jwts.forget(jwtFile(vaultConfig))
+}
+
+// appRoleAuthenticator logs in with the role_id and secret_id keys of the
+// auth Secret
+type appRoleAuthenticator struct{}
+
+func (appRoleAuthenticator) UsesRole() bool {
+	return false
+}
+
+func (appRoleAuthenticator) LoginData(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (map[string]interface{}, error) {
+	return r.authSecretData(ctx, vaultConfig, appRoleIDKey, appRoleSecretIDKey)
+}
+
+// passwordAuthenticator logs in with the username and password keys of the
+// auth Secret on auth/<AuthPath>/login/<username>, as the userpass and ldap
+// methods take them
+type passwordAuthenticator struct{}
+
+func (passwordAuthenticator) UsesRole() bool {
+	return false
+}
+
+func (passwordAuthenticator) LoginData(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (map[string]interface{}, error) {
+	return r.authSecretData(ctx, vaultConfig, usernameKey, passwordKey)
+}
+
+func (passwordAuthenticator) LoginPath(loginData map[string]interface{}) string {
+	return "login/" + url.PathEscape(loginData[usernameKey].(string))
+}
+
+// authSecretData returns the keys of the auth Secret of SecretRef, all of
+// them required
+func (r *VaultSecretReconciler) authSecretData(ctx context.Context, vaultConfig VaultConfig, keys ...string) (map[string]interface{}, error) {
+	if vaultConfig.AuthSecret == "" {
+		return nil, fmt.Errorf("the %s auth method needs a secretRef", vaultConfig.AuthMethod)
+	}
+
+	secret, err := r.referencedSecret(ctx, vaultConfig.Namespace, "auth Secret", vaultConfig.AuthSecret)
+	if err != nil {
+		return nil, err
+	}
+	name := types.NamespacedName{Name: vaultConfig.AuthSecret, Namespace: vaultConfig.Namespace}
+
+	loginData := map[string]interface{}{}
+	for _, key := range keys {
+		value, ok := secret.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("the auth Secret %s has no %s key", name, key)
+		}
+		loginData[key] = string(value)
+	}
+
+	return loginData, nil
+}
+
+// loginError is a failed Vault login
+type loginError struct {
+	err error
+}
+
+func (e *loginError) Error() string {
+	return "can't log in to the Vault: " + e.err.Error()
+}
+
+func (e *loginError) Unwrap() error {
+	return e.err
+}
+
+// jwtFile returns the path of the ServiceAccount JWT to log in with, the
+// JWTPath of the VaultSecret or else the one of the operator
+func jwtFile(vaultConfig VaultConfig) string {
+	if vaultConfig.JWTPath != "" {
+		return vaultConfig.JWTPath
+	}
+	if file := os.Getenv("KUBERNETES_SERVICE_ACCOUNT_TOKEN"); file != "" {
+		return file
+	}
+	if file := os.Getenv("VAULT_JWT_FILE"); file != "" {
+		return file
+	}
+
+	return defaultJWTFile
+}
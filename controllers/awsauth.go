@@ -0,0 +1,92 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	awsAuthMethod = "aws"
+
+	// defaultAWSRegion signs the sts:GetCallerIdentity requests without a
+	// configured region, for the global STS endpoint
+	defaultAWSRegion = "us-east-1"
+
+	// awsIAMServerIDEnvVar holds the value of the X-Vault-AWS-IAM-Server-ID
+	// header Vault requires when its aws auth sets iam_server_id_header_value
+	awsIAMServerIDEnvVar = "VAULT_AWS_IAM_SERVER_ID"
+)
+
+func init() {
+	RegisterAuthenticator(awsAuthMethod, awsAuthenticator{})
+}
+
+// awsAuthenticator logs in with the iam type of the aws auth method, a
+// signed sts:GetCallerIdentity request Vault sends on to AWS. The credentials
+// come from the default AWS chain: the environment, the IRSA web identity
+// token, the shared config and the instance profile.
+type awsAuthenticator struct{}
+
+func (awsAuthenticator) UsesRole() bool {
+	return true
+}
+
+func (awsAuthenticator) LoginData(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (map[string]interface{}, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, fmt.Errorf("can't load the AWS credentials: %w", err)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String(defaultAWSRegion)
+	}
+
+	req, _ := sts.New(sess).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	req.SetContext(ctx)
+	if serverID := os.Getenv(awsIAMServerIDEnvVar); serverID != "" {
+		req.HTTPRequest.Header.Set("X-Vault-AWS-IAM-Server-ID", serverID)
+	}
+	if err := req.Sign(); err != nil {
+		return nil, fmt.Errorf("can't sign the sts:GetCallerIdentity request: %w", err)
+	}
+
+	headers, err := json.Marshal(req.HTTPRequest.Header)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(req.HTTPRequest.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"iam_http_request_method": req.HTTPRequest.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(req.HTTPRequest.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+		"role":                    vaultConfig.Role,
+	}, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	// chunksAnnotation on the child Secret holds the number of additional
+	// "<name>-<n>" Secrets its keys are spread over
+	chunksAnnotation = "apps.vault.op/chunks"
+
+	// conditionTooManyKeys is set when the Secret has more keys than MaxKeys
+	// allows and chunking is off
+	conditionTooManyKeys = "TooManyKeys"
+)
+
+// chunkSecret enforces the MaxKeys limit of the VaultSecret on the rendered
+// Secret. Without chunking, a Secret over the limit is refused and reported in
+// the TooManyKeys condition. With chunking, the Secret keeps the first keys in
+// sorted order and the returned "<name>-<n>" Secrets get the rest.
+func (r *VaultSecretReconciler) chunkSecret(ctx context.Context, vs *appsv1.VaultSecret, secret *core.Secret) ([]*core.Secret, bool, error) {
+	max := vs.Spec.MaxKeys
+	if max <= 0 || len(secret.Data) <= max {
+		if meta.IsStatusConditionTrue(vs.Status.Conditions, conditionTooManyKeys) {
+			return nil, true, r.setStatusCondition(ctx, vs, metav1.Condition{
+				Type:    conditionTooManyKeys,
+				Status:  metav1.ConditionFalse,
+				Reason:  "WithinLimit",
+				Message: "the Secret keys are within the limit",
+			})
+		}
+		return nil, true, nil
+	}
+
+	if !vs.Spec.ChunkKeys {
+		msg := fmt.Sprintf("the Secret has %d keys, more than the limit of %d", len(secret.Data), max)
+		log.FromContext(ctx).Info("refusing to write the child Secret", "secret", secret.Name, "reason", msg)
+		return nil, false, r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionTooManyKeys,
+			Status:  metav1.ConditionTrue,
+			Reason:  "OverLimit",
+			Message: msg,
+		})
+	}
+
+	data := secret.Data
+	secret.Data = map[string][]byte{}
+	var chunks []*core.Secret
+	for i, k := range sortedKeys(data) {
+		n := i / max
+		if n == 0 {
+			secret.Data[k] = data[k]
+			continue
+		}
+		if n > len(chunks) {
+			chunk := &core.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        chunkName(secret.Name, n),
+					Namespace:   secret.Namespace,
+					Annotations: map[string]string{dataHashAnnotation: secret.Annotations[dataHashAnnotation]},
+				},
+				Data: map[string][]byte{},
+			}
+			if err := ctrl.SetControllerReference(vs, chunk, r.Scheme); err != nil {
+				return nil, false, err
+			}
+			chunks = append(chunks, chunk)
+		}
+		chunks[n-1].Data[k] = data[k]
+	}
+	secret.Annotations[chunksAnnotation] = strconv.Itoa(len(chunks))
+
+	return chunks, true, nil
+}
+
+// recordedChunks returns the names of the chunk Secrets recorded by the
+// chunksAnnotation of the child Secret, named after it
+func recordedChunks(secret *core.Secret) []string {
+	n, _ := strconv.Atoi(secret.Annotations[chunksAnnotation])
+	names := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		names = append(names, chunkName(secret.Name, i))
+	}
+
+	return names
+}
+
+// applyChunks creates or updates the chunk Secrets and deletes the previous
+// ones, as recorded by recordedChunks, that are left over. The Secrets of
+// these names that aren't controlled by the VaultSecret are left alone.
+func (r *VaultSecretReconciler) applyChunks(ctx context.Context, vs *appsv1.VaultSecret, chunks []*core.Secret, previous []string) error {
+	current := map[string]bool{}
+	for _, chunk := range chunks {
+		current[chunk.Name] = true
+		found := &core.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: chunk.Name, Namespace: chunk.Namespace}, found)
+		if apierrors.IsNotFound(err) {
+			log.FromContext(ctx).Info("deploying a new child Secret chunk", "secret", chunk.Name)
+			if err := r.Create(ctx, chunk); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if !metav1.IsControlledBy(found, vs) {
+			return errors.New("Secret " + found.Name + " already exists and is not managed by this VaultSecret")
+		}
+		found.Annotations = chunk.Annotations
+		found.Data = chunk.Data
+		if err := r.Update(ctx, found); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range previous {
+		if current[name] {
+			continue
+		}
+		stale := &core.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: vs.Namespace}, stale)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !metav1.IsControlledBy(stale, vs) {
+			log.FromContext(ctx).Info("leaving the stale child Secret chunk alone, it isn't managed by this VaultSecret", "secret", name)
+			continue
+		}
+		log.FromContext(ctx).Info("deleting the stale child Secret chunk", "secret", name)
+		if err := r.Delete(ctx, stale, client.Preconditions{UID: &stale.UID}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func chunkName(name string, n int) string {
+	return name + "-" + strconv.Itoa(n)
+}
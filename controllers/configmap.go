@@ -0,0 +1,151 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// reconcileConfigMap writes the Vault data of a VaultSecret with the
+// ConfigMap TargetKind into its owned ConfigMap, rendered as the Secret would
+// be
+func (r *VaultSecretReconciler) reconcileConfigMap(ctx context.Context, reader SecretReader, config VaultConfig, vs *appsv1.VaultSecret) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	found := &core.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: vs.SecretNameOrDefault(), Namespace: vs.Namespace}, found)
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.Error(err, "unable to get the child ConfigMap")
+		return ctrl.Result{}, err
+	}
+	exists := err == nil
+	if exists && !metav1.IsControlledBy(found, vs) {
+		return ctrl.Result{}, errors.New("ConfigMap " + found.Name + " already exists and is not managed by this VaultSecret")
+	}
+
+	rendered, result, err := r.renderSecret(ctx, reader, config, vs, nil)
+	if rendered == nil || err != nil {
+		return result, err
+	}
+	secret := rendered.secret
+	cm := secretConfigMap(secret)
+	if err := ctrl.SetControllerReference(vs, cm, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	hash := secret.Annotations[dataHashAnnotation]
+
+	if !exists {
+		logger.Info("deploying a new child ConfigMap", "configMap", cm.Name)
+		if err := r.Create(ctx, cm); err != nil {
+			logger.Error(err, "failed to deploy the child ConfigMap", "configMap", cm.Name)
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Event(vs, core.EventTypeNormal, "Created", fmt.Sprintf("created the ConfigMap %s with %d keys", cm.Name, rendered.keys))
+		return r.recordSync(ctx, vs, secret, rendered.keys, r.refreshResult(vs, true))
+	}
+
+	changed := found.Annotations[dataHashAnnotation] != hash
+	if !changed && equality.Semantic.DeepEqual(found.Data, cm.Data) && equality.Semantic.DeepEqual(found.BinaryData, cm.BinaryData) {
+		if err := r.rollOut(ctx, vs, hash, false); err != nil {
+			return ctrl.Result{}, err
+		}
+		return r.recordSync(ctx, vs, secret, rendered.keys, r.refreshResult(vs, false))
+	}
+
+	diff := secretDataDiff(configMapData(found), secret.Data)
+	if found.Annotations == nil {
+		found.Annotations = map[string]string{}
+	}
+	for k, v := range cm.Annotations {
+		found.Annotations[k] = v
+	}
+	for k, v := range cm.Labels {
+		if found.Labels == nil {
+			found.Labels = map[string]string{}
+		}
+		found.Labels[k] = v
+	}
+	found.Data = cm.Data
+	found.BinaryData = cm.BinaryData
+
+	logger.Info("updating the child ConfigMap", "configMap", found.Name)
+	if err := r.Update(ctx, found); err != nil {
+		logger.Error(err, "failed to update the child ConfigMap", "configMap", found.Name)
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Event(vs, core.EventTypeNormal, "Updated", diff)
+	if err := r.rollOut(ctx, vs, hash, changed); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return r.recordSync(ctx, vs, secret, rendered.keys, r.refreshResult(vs, true))
+}
+
+// secretConfigMap returns the ConfigMap of the rendered Secret, its values
+// that aren't UTF-8 moved to the binaryData
+func secretConfigMap(secret *core.Secret) *core.ConfigMap {
+	cm := &core.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   secret.Namespace,
+			Labels:      secret.Labels,
+			Annotations: secret.Annotations,
+		},
+	}
+	for k, v := range secret.Data {
+		if utf8.Valid(v) {
+			if cm.Data == nil {
+				cm.Data = map[string]string{}
+			}
+			cm.Data[k] = string(v)
+			continue
+		}
+		if cm.BinaryData == nil {
+			cm.BinaryData = map[string][]byte{}
+		}
+		cm.BinaryData[k] = v
+	}
+
+	return cm
+}
+
+// configMapData returns the data and binaryData of the ConfigMap as Secret
+// data
+func configMapData(cm *core.ConfigMap) map[string][]byte {
+	data := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+	for k, v := range cm.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range cm.BinaryData {
+		data[k] = v
+	}
+
+	return data
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// The keys of the ConfigMap of a ConfigRef, named after the fields of the
+// VaultSecret they stand for
+const (
+	configVaultAddressKey   = "vaultAddress"
+	configVaultNamespaceKey = "vaultNamespace"
+	configAuthMethodKey     = "authMethod"
+	configAuthPathKey       = "authPath"
+	configRoleKey           = "role"
+	configTLSSecretKey      = "tlsSecret"
+	configTLSServerNameKey  = "tlsServerName"
+)
+
+// connectionSpec returns the spec of the VaultSecret with the connection
+// settings it leaves empty taken from the ConfigMap of its ConfigRef, and
+// then from the VaultConnection of its ConnectionRef, along with the
+// namespace of its TLSSecret. The role of the ConfigMap gives way to the one
+// of a ServiceAccountName. The VaultSecret itself isn't changed. A missing
+// ConfigMap is ignored on deletion, so that it doesn't hold the finalizer.
+func (r *VaultSecretReconciler) connectionSpec(ctx context.Context, vs *appsv1.VaultSecret) (appsv1.VaultSecretSpec, string, error) {
+	spec := vs.Spec
+	if spec.ConfigRef == "" {
+		return r.connectionRefSpec(ctx, vs, spec)
+	}
+	if strings.Contains(spec.ConfigRef, "/") {
+		return spec, vs.Namespace, fmt.Errorf("the config ConfigMap %s can't be in another namespace, it's read in the %s namespace of the VaultSecret", spec.ConfigRef, vs.Namespace)
+	}
+
+	cm := &core.ConfigMap{}
+	name := types.NamespacedName{Name: spec.ConfigRef, Namespace: vs.Namespace}
+	if err := r.Get(ctx, name, cm); err != nil {
+		if apierrors.IsNotFound(err) && !vs.DeletionTimestamp.IsZero() {
+			log.FromContext(ctx).Info("the config ConfigMap of the deleted VaultSecret is gone", "configMap", name.Name)
+			return r.connectionRefSpec(ctx, vs, spec)
+		}
+		return spec, vs.Namespace, fmt.Errorf("can't get the config ConfigMap %s: %w", name, err)
+	}
+
+	fields := map[string]*string{
+		configVaultAddressKey:   &spec.VaultAddress,
+		configVaultNamespaceKey: &spec.VaultNamespace,
+		configAuthMethodKey:     &spec.AuthMethod,
+		configAuthPathKey:       &spec.AuthPath,
+		configTLSSecretKey:      &spec.TLSSecret,
+		configTLSServerNameKey:  &spec.TLSServerName,
+	}
+	if spec.ServiceAccountName == "" {
+		fields[configRoleKey] = &spec.Role
+	}
+	for key, field := range fields {
+		if *field == "" {
+			*field = cm.Data[key]
+		}
+	}
+
+	return r.connectionRefSpec(ctx, vs, spec)
+}
+
+// configRefDependents maps a ConfigMap to the VaultSecrets of the namespace
+// taking their connection settings from it, so that they follow its changes
+func (r *VaultSecretReconciler) configRefDependents(obj client.Object) []reconcile.Request {
+	list := &appsv1.VaultSecretList{}
+	if err := r.List(context.TODO(), list, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.Log.Error(err, "unable to list the VaultSecrets of the config ConfigMap", "namespace", obj.GetNamespace(), "configMap", obj.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, vs := range list.Items {
+		if vs.Spec.ConfigRef == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}})
+		}
+	}
+
+	return requests
+}
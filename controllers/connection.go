@@ -0,0 +1,96 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// connectionRefSpec returns the spec with the connection settings it leaves
+// empty taken from the VaultConnection of its ConnectionRef, along with the
+// namespace of its TLSSecret: the one of the VaultConnection when the spec
+// takes its TLSSecret, the one of the VaultSecret otherwise. A missing
+// VaultConnection is ignored on deletion, as a missing ConfigRef.
+func (r *VaultSecretReconciler) connectionRefSpec(ctx context.Context, vs *appsv1.VaultSecret, spec appsv1.VaultSecretSpec) (appsv1.VaultSecretSpec, string, error) {
+	if spec.ConnectionRef == "" {
+		return spec, vs.Namespace, nil
+	}
+
+	conn := &appsv1.VaultConnection{}
+	if err := r.Get(ctx, types.NamespacedName{Name: spec.ConnectionRef}, conn); err != nil {
+		if apierrors.IsNotFound(err) && !vs.DeletionTimestamp.IsZero() {
+			log.FromContext(ctx).Info("the VaultConnection of the deleted VaultSecret is gone", "vaultConnection", spec.ConnectionRef)
+			return spec, vs.Namespace, nil
+		}
+		return spec, vs.Namespace, fmt.Errorf("can't get the VaultConnection %s: %w", spec.ConnectionRef, err)
+	}
+
+	fields := map[*string]string{
+		&spec.VaultAddress:   conn.Spec.VaultAddress,
+		&spec.VaultNamespace: conn.Spec.VaultNamespace,
+		&spec.AuthMethod:     conn.Spec.AuthMethod,
+		&spec.AuthPath:       conn.Spec.AuthPath,
+		&spec.TLSServerName:  conn.Spec.TLSServerName,
+	}
+	if spec.ServiceAccountName == "" {
+		fields[&spec.Role] = conn.Spec.Role
+	}
+	for field, value := range fields {
+		if *field == "" {
+			*field = value
+		}
+	}
+
+	if spec.TLSSecret != "" || conn.Spec.TLSSecret == nil {
+		return spec, vs.Namespace, nil
+	}
+	if conn.Spec.TLSSecret.Namespace == "" {
+		return spec, vs.Namespace, fmt.Errorf("the tlsSecret of the VaultConnection %s names no namespace", conn.Name)
+	}
+	spec.TLSSecret = conn.Spec.TLSSecret.Name
+
+	return spec, conn.Spec.TLSSecret.Namespace, nil
+}
+
+// connectionRefDependents maps a VaultConnection to the VaultSecrets of all
+// the namespaces taking their connection settings from it, so that they
+// follow its changes
+func (r *VaultSecretReconciler) connectionRefDependents(obj client.Object) []reconcile.Request {
+	list := &appsv1.VaultSecretList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		log.Log.Error(err, "unable to list the VaultSecrets of the VaultConnection", "vaultConnection", obj.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, vs := range list.Items {
+		if vs.Spec.ConnectionRef == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}})
+		}
+	}
+
+	return requests
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// copyOfAnnotation marks the copies of a child Secret in the TargetNamespaces
+// with the <namespace>/<name> of their VaultSecret. Owner references don't
+// cross namespaces, the annotation tells our copies apart instead.
+const copyOfAnnotation = "apps.vault.op/copy-of"
+
+// allNamespaces is the TargetNamespaces entry copying the Secret into every
+// namespace
+const allNamespaces = "*"
+
+// copyOf is the copyOfAnnotation value of the copies of the VaultSecret
+func copyOf(vs *appsv1.VaultSecret) string {
+	return vs.Namespace + "/" + vs.Name
+}
+
+// targetNamespaces returns the namespaces, other than its own, the Secret of
+// the VaultSecret is copied into, in order. The terminating namespaces are
+// left out, they don't take new Secrets, and so are the ones the operator
+// doesn't allow.
+func (r *VaultSecretReconciler) targetNamespaces(ctx context.Context, vs *appsv1.VaultSecret) ([]string, error) {
+	targets := map[string]bool{}
+	for _, ns := range vs.Spec.TargetNamespaces {
+		targets[ns] = true
+	}
+	delete(targets, allNamespaces)
+
+	all := copiedToAllNamespaces(vs)
+
+	if all || vs.Spec.TargetNamespaceSelector != nil {
+		var opts []client.ListOption
+		if !all {
+			selector, err := metav1.LabelSelectorAsSelector(vs.Spec.TargetNamespaceSelector)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, client.MatchingLabelsSelector{Selector: selector})
+		}
+		namespaces := &core.NamespaceList{}
+		if err := r.List(ctx, namespaces, opts...); err != nil {
+			return nil, err
+		}
+		for _, ns := range namespaces.Items {
+			if ns.Status.Phase != core.NamespaceTerminating {
+				targets[ns.Name] = true
+			}
+		}
+	}
+	delete(targets, vs.Namespace)
+
+	namespaces := make([]string, 0, len(targets))
+	for ns := range targets {
+		if !r.watched(ns) {
+			log.FromContext(ctx).Info("skipping the target namespace, it isn't watched", "targetNamespace", ns)
+			continue
+		}
+		if !appsv1.NamespaceIn(ns, r.CopyNamespaces) {
+			log.FromContext(ctx).Info("skipping the target namespace, it isn't allowed by the operator", "targetNamespace", ns)
+			continue
+		}
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+// syncCopies copies the child Secret into the TargetNamespaces of the
+// VaultSecret and deletes the copies left in the namespaces no longer
+// targeted. The CopiedNamespaces status follows the copies.
+func (r *VaultSecretReconciler) syncCopies(ctx context.Context, vs *appsv1.VaultSecret, secret *core.Secret) error {
+	namespaces, err := r.targetNamespaces(ctx, vs)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "can't list the target namespaces")
+		return err
+	}
+
+	targeted := map[string]bool{}
+	for _, ns := range namespaces {
+		targeted[ns] = true
+	}
+	if err := r.deleteCopies(ctx, vs, targeted); err != nil {
+		return err
+	}
+
+	for _, ns := range namespaces {
+		if err := r.applyCopy(ctx, vs, secretCopy(vs, secret, ns)); err != nil {
+			log.FromContext(ctx).Error(err, "failed to copy the child Secret", "secret", secret.Name, "targetNamespace", ns)
+			return err
+		}
+		vs.Status.CopiedNamespaces = appendNamespace(vs.Status.CopiedNamespaces, ns)
+	}
+
+	return nil
+}
+
+// secretCopy returns the copy of the child Secret in the namespace
+func secretCopy(vs *appsv1.VaultSecret, secret *core.Secret, ns string) *core.Secret {
+	annotations := map[string]string{copyOfAnnotation: copyOf(vs)}
+	for k, v := range secret.Annotations {
+		annotations[k] = v
+	}
+	var labels map[string]string
+	if secret.Labels != nil {
+		labels = make(map[string]string, len(secret.Labels))
+		for k, v := range secret.Labels {
+			labels[k] = v
+		}
+	}
+
+	return &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   ns,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+}
+
+// applyCopy creates or updates the copy, refusing to overwrite a Secret that
+// isn't a copy of the VaultSecret
+func (r *VaultSecretReconciler) applyCopy(ctx context.Context, vs *appsv1.VaultSecret, secret *core.Secret) error {
+	found := &core.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, found)
+	if apierrors.IsNotFound(err) {
+		log.FromContext(ctx).Info("deploying a new copy of the child Secret", "secret", secret.Name, "targetNamespace", secret.Namespace)
+		return r.Create(ctx, secret)
+	}
+	if err != nil {
+		return err
+	}
+
+	if found.Annotations[copyOfAnnotation] != copyOf(vs) {
+		return errors.New("Secret " + found.Name + " already exists in the " + found.Namespace + " namespace and is not a copy of this VaultSecret")
+	}
+	// The type of a Secret is immutable, the copy is replaced instead
+	if found.Type != secret.Type {
+		log.FromContext(ctx).Info("replacing the copy of the child Secret of another type", "secret", found.Name, "targetNamespace", found.Namespace)
+		if err := r.Delete(ctx, found); err != nil {
+			return err
+		}
+		return r.Create(ctx, secret)
+	}
+	if equality.Semantic.DeepEqual(found.Data, secret.Data) &&
+		equality.Semantic.DeepEqual(found.Labels, secret.Labels) &&
+		equality.Semantic.DeepEqual(found.Annotations, secret.Annotations) {
+		return nil
+	}
+
+	found.Labels = secret.Labels
+	found.Annotations = secret.Annotations
+	found.Data = secret.Data
+	log.FromContext(ctx).Info("updating the copy of the child Secret", "secret", found.Name, "targetNamespace", found.Namespace)
+	return r.Update(ctx, found)
+}
+
+// deleteCopies deletes the copies of the child Secret in the CopiedNamespaces
+// of the VaultSecret but the kept ones. The Secrets that were replaced by
+// someone else than the operator since are left alone.
+func (r *VaultSecretReconciler) deleteCopies(ctx context.Context, vs *appsv1.VaultSecret, keep map[string]bool) error {
+	name := vs.SecretNameOrDefault()
+	var copied []string
+	for i, ns := range vs.Status.CopiedNamespaces {
+		if keep[ns] {
+			copied = append(copied, ns)
+			continue
+		}
+
+		found := &core.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, found)
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.FromContext(ctx).Error(err, "unable to get the copy of the child Secret", "secret", name, "targetNamespace", ns)
+			vs.Status.CopiedNamespaces = append(copied, vs.Status.CopiedNamespaces[i:]...)
+			return err
+		}
+		if err == nil && found.Annotations[copyOfAnnotation] == copyOf(vs) {
+			log.FromContext(ctx).Info("deleting the copy of the child Secret", "secret", name, "targetNamespace", ns)
+			if err := r.Delete(ctx, found); err != nil && !apierrors.IsNotFound(err) {
+				log.FromContext(ctx).Error(err, "failed to delete the copy of the child Secret", "secret", name, "targetNamespace", ns)
+				vs.Status.CopiedNamespaces = append(copied, vs.Status.CopiedNamespaces[i:]...)
+				return err
+			}
+		}
+	}
+	vs.Status.CopiedNamespaces = copied
+
+	return nil
+}
+
+// deleteStrayCopies deletes the copies of the child Secret left out of the
+// CopiedNamespaces, as when the status update recording them failed. They're
+// found by their copyOfAnnotation among the Secrets of the other namespaces,
+// the ones of the namespaces deleted since are gone with them.
+func (r *VaultSecretReconciler) deleteStrayCopies(ctx context.Context, vs *appsv1.VaultSecret) error {
+	secrets := &core.SecretList{}
+	if err := r.List(ctx, secrets); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list the copies of the child Secret")
+		return err
+	}
+
+	for i := range secrets.Items {
+		found := &secrets.Items[i]
+		if found.Namespace == vs.Namespace || found.Annotations[copyOfAnnotation] != copyOf(vs) {
+			continue
+		}
+		log.FromContext(ctx).Info("deleting the stray copy of the child Secret", "secret", found.Name, "targetNamespace", found.Namespace)
+		if err := r.Delete(ctx, found); err != nil && !apierrors.IsNotFound(err) {
+			log.FromContext(ctx).Error(err, "failed to delete the copy of the child Secret", "secret", found.Name, "targetNamespace", found.Namespace)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watched reports whether the namespace is one of the WatchNamespaces, all
+// of them being watched when there are none
+func (r *VaultSecretReconciler) watched(ns string) bool {
+	if len(r.WatchNamespaces) == 0 {
+		return true
+	}
+	for _, watched := range r.WatchNamespaces {
+		if watched == ns {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appendNamespace adds the namespace to the sorted namespaces, once
+func appendNamespace(namespaces []string, ns string) []string {
+	i := sort.SearchStrings(namespaces, ns)
+	if i < len(namespaces) && namespaces[i] == ns {
+		return namespaces
+	}
+
+	return append(namespaces[:i], append([]string{ns}, namespaces[i:]...)...)
+}
+
+// namespaceDependents maps a namespace to the VaultSecrets that may copy
+// their Secret into it, so that new namespaces get their copies right away
+func (r *VaultSecretReconciler) namespaceDependents(obj client.Object) []reconcile.Request {
+	list := &appsv1.VaultSecretList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		log.Log.Error(err, "unable to list the VaultSecrets copied to the namespace", "targetNamespace", obj.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, vs := range list.Items {
+		if vs.Spec.TargetNamespaceSelector == nil && !copiedToAllNamespaces(&vs) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}})
+	}
+
+	return requests
+}
+
+// copiedToAllNamespaces reports whether the TargetNamespaces of the
+// VaultSecret hold the allNamespaces entry
+func copiedToAllNamespaces(vs *appsv1.VaultSecret) bool {
+	for _, ns := range vs.Spec.TargetNamespaces {
+		if ns == allNamespaces {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	core "k8s.io/api/core/v1"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	defaultRegistryKey = "registry"
+	defaultUsernameKey = "username"
+	defaultPasswordKey = "password"
+)
+
+// dockerConfigAuth is the entry of a registry in a .dockerconfigjson
+type dockerConfigAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+// renderDockerConfig builds the .dockerconfigjson of the registry
+// credentials found in the Secret data, which it replaces
+func renderDockerConfig(out *appsv1.DockerConfigOutput, secret *core.Secret) error {
+	value := func(key, def string) (string, error) {
+		key = stringOr(key, def)
+		v, ok := secret.Data[key]
+		if !ok || len(v) == 0 {
+			return "", errors.New("can't render the .dockerconfigjson, " + def + " key not found: " + key)
+		}
+		return string(v), nil
+	}
+
+	registry, err := value(out.RegistryKey, defaultRegistryKey)
+	if err != nil {
+		return err
+	}
+	username, err := value(out.UsernameKey, defaultUsernameKey)
+	if err != nil {
+		return err
+	}
+	password, err := value(out.PasswordKey, defaultPasswordKey)
+	if err != nil {
+		return err
+	}
+	auth := dockerConfigAuth{
+		Username: username,
+		Password: password,
+		Auth:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+	}
+	if out.EmailKey != "" {
+		if auth.Email, err = value(out.EmailKey, "email"); err != nil {
+			return err
+		}
+	}
+
+	dockerConfig, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]dockerConfigAuth{registry: auth},
+	})
+	if err != nil {
+		return err
+	}
+	secret.Data = map[string][]byte{core.DockerConfigJsonKey: dockerConfig}
+	secret.Type = core.SecretTypeDockerConfigJson
+
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// dryRun renders the Secret of a DryRun VaultSecret from a fresh Vault read
+// and records its keys in the status, without writing it. Ready stays false,
+// there's no Secret in sync, while VaultReachable and AuthSucceeded report
+// the outcome of the read. The failures are recorded as for the other syncs.
+func (r *VaultSecretReconciler) dryRun(ctx context.Context, reader SecretReader, config VaultConfig, vs *appsv1.VaultSecret) (ctrl.Result, error) {
+	rendered, result, err := r.renderSecret(ctx, reader, config, vs, nil)
+	if rendered == nil || err != nil {
+		return result, err
+	}
+
+	// The chunks split the data, their keys don't overlap
+	var keys []string
+	for _, secret := range append(rendered.chunks, rendered.secret) {
+		keys = append(keys, sortedKeys(secret.Data)...)
+	}
+	sort.Strings(keys)
+	log.FromContext(ctx).Info("read the Vault secret in dry-run mode, the Secret isn't written", "keys", len(keys))
+
+	result = r.refreshResult(vs, false)
+	vs.Status.Ready = false
+	vs.Status.DryRunKeys = keys
+	vs.Status.NextRefreshTime = &metav1.Time{Time: r.now().Add(result.RequeueAfter)}
+	vs.Status.LastError = ""
+	vs.Status.ErrorCount = 0
+	vs.Status.VaultFailures = 0
+	setCondition(vs, conditionReady, metav1.ConditionFalse, "DryRun", "the Vault data was read, the Secret isn't written in dry-run mode")
+	setCondition(vs, conditionVaultReachable, metav1.ConditionTrue, "Reachable", "the Vault served the secret")
+	setCondition(vs, conditionAuthSucceeded, metav1.ConditionTrue, "LoggedIn", "the Vault login succeeded")
+	if err := r.Status().Update(ctx, vs); err != nil {
+		log.FromContext(ctx).Error(err, "failed to update the status")
+		return ctrl.Result{}, err
+	}
+	if err := r.clearBypassCache(ctx, vs); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
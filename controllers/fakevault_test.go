@@ -0,0 +1,569 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// fakeVault is a minimal in-memory Vault HTTP API used by the controller
+// tests. It accepts any login and serves the responses set per path.
+type fakeVault struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]map[string]interface{}
+	versions  map[string][]map[string]interface{}
+	custom    map[string]map[string]string
+	logins    int
+	reads     int
+
+	// lastToken is the token of the last read
+	lastToken string
+
+	// validJWT, if set, is the only JWT logins are accepted with
+	validJWT string
+
+	// namespace, if set, is the Vault namespace every request must be sent
+	// to, the others aren't found
+	namespace string
+
+	// lastLogin and lastLoginPath are the request body and path of the last
+	// login
+	lastLogin     map[string]interface{}
+	lastLoginPath string
+
+	// revoked tokens are denied
+	revoked map[string]bool
+
+	// numUses limits the uses of the issued tokens, used counts them and
+	// denied counts the requests refused for a spent token
+	numUses int
+	used    map[string]int
+	denied  int
+
+	// dynamic paths issue new leased credentials on every read, the renewed
+	// and revoked leases are recorded
+	dynamic       map[string]int
+	renewedLeases []string
+	revokedLeases []string
+
+	// nonRenewable makes the dynamic leases non-renewable, and maxLeaseTTL,
+	// if set, caps their renewals
+	nonRenewable bool
+	maxLeaseTTL  int
+
+	// renewals counts the token renewals
+	renewals int
+
+	// wrapped are the payloads of the unwrapped wrapping tokens, the paths
+	// of wrapping are read as a new wrapping token of their payload
+	wrapped  map[string]map[string]interface{}
+	wrapping map[string]map[string]interface{}
+
+	// mountLookups counts the lookups of the mount of the paths
+	mountLookups int
+
+	// decrypts counts the transit decryptions
+	decrypts int
+
+	// sealed is the state reported by sys/health
+	sealed bool
+
+	// failReads is the number of the next reads failing with a server error
+	failReads int
+
+	// failLogins is the number of the next logins failing with a server error
+	failLogins int
+
+	// standbyReads is the number of the next reads answered with the 412 of
+	// a performance standby not caught up with the active node
+	standbyReads int
+
+	// lastForward is the X-Vault-Forward header of the last read
+	lastForward string
+
+	// loginDelay slows the logins down
+	loginDelay time.Duration
+
+	// readDelay slows the reads down, set with setReadDelay while requests
+	// may be in flight
+	readDelay time.Duration
+
+	// inflightLogins and maxInflightLogins count the concurrent logins
+	inflightLogins    int32
+	maxInflightLogins int32
+}
+
+var jwtFileOnce sync.Once
+
+func newFakeVault() *fakeVault {
+	return startFakeVault(false, tls.NoClientCert)
+}
+
+// newTLSFakeVault serves the fake Vault over HTTPS with a self-signed
+// certificate, see caPEM
+func newTLSFakeVault() *fakeVault {
+	return startFakeVault(true, tls.NoClientCert)
+}
+
+// newMTLSFakeVault serves the fake Vault over HTTPS, only to the clients
+// presenting a certificate
+func newMTLSFakeVault() *fakeVault {
+	return startFakeVault(true, tls.RequireAnyClientCert)
+}
+
+func startFakeVault(secure bool, clientAuth tls.ClientAuthType) *fakeVault {
+	jwtFileOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "vault-operator-test")
+		if err != nil {
+			panic(err)
+		}
+		file := filepath.Join(dir, "token")
+		if err := ioutil.WriteFile(file, []byte("test-jwt"), 0600); err != nil {
+			panic(err)
+		}
+		os.Setenv("VAULT_JWT_FILE", file)
+	})
+
+	f := &fakeVault{
+		responses: map[string]map[string]interface{}{},
+		versions:  map[string][]map[string]interface{}{},
+		custom:    map[string]map[string]string{},
+		revoked:   map[string]bool{},
+		used:      map[string]int{},
+		dynamic:   map[string]int{},
+		wrapped:   map[string]map[string]interface{}{},
+		wrapping:  map[string]map[string]interface{}{},
+	}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serve))
+	if secure {
+		f.TLS = &tls.Config{ClientAuth: clientAuth}
+		f.StartTLS()
+	} else {
+		f.Start()
+	}
+	return f
+}
+
+// caPEM returns the PEM encoded certificate of a TLS fake Vault
+func (f *fakeVault) caPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw})
+}
+
+// clientCertPEM returns a self-signed client certificate and its key, PEM
+// encoded
+func clientCertPEM() ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vault-operator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// wrap returns a new wrapping token of the payload
+func (f *fakeVault) wrap(payload map[string]interface{}) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.wrapLocked(payload)
+}
+
+func (f *fakeVault) wrapLocked(payload map[string]interface{}) string {
+	token := "wrapping-token-" + strconv.Itoa(len(f.wrapped)+1)
+	f.wrapped[token] = payload
+	return token
+}
+
+// setWrapping wraps every read response of the path
+func (f *fakeVault) setWrapping(path string, payload map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wrapping[strings.Trim(path, "/")] = payload
+}
+
+// setKV2 writes data as a new version of a KV v2 secret
+func (f *fakeVault) setKV2(path string, data map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path = strings.Trim(path, "/")
+	f.versions[path] = append(f.versions[path], data)
+}
+
+// deleteKV2 soft-deletes the current version of a KV v2 secret
+func (f *fakeVault) deleteKV2(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	versions := f.versions[strings.Trim(path, "/")]
+	versions[len(versions)-1] = nil
+}
+
+// setCustomMetadata sets the custom metadata of a KV v2 secret
+func (f *fakeVault) setCustomMetadata(path string, custom map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.custom[strings.Trim(path, "/")] = custom
+}
+
+// setDynamic makes path issue new leased credentials on every read
+func (f *fakeVault) setDynamic(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dynamic[strings.Trim(path, "/")] = 0
+}
+
+// setReadDelay slows the next reads down by the delay
+func (f *fakeVault) setReadDelay(delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readDelay = delay
+}
+
+// setResponse stores the raw "data" field of the response served for path
+func (f *fakeVault) setResponse(path string, data map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[strings.Trim(path, "/")] = data
+}
+
+// revokeTokens revokes all the tokens issued so far
+func (f *fakeVault) revokeTokens() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := 1; i <= f.logins; i++ {
+		f.revoked["test-token-"+strconv.Itoa(i)] = true
+	}
+}
+
+func (f *fakeVault) serve(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v1/")
+	login := strings.HasPrefix(path, "auth/") && (strings.HasSuffix(path, "/login") || strings.Contains(path, "/login/"))
+	if login {
+		n := atomic.AddInt32(&f.inflightLogins, 1)
+		defer atomic.AddInt32(&f.inflightLogins, -1)
+		for max := atomic.LoadInt32(&f.maxInflightLogins); n > max; max = atomic.LoadInt32(&f.maxInflightLogins) {
+			if atomic.CompareAndSwapInt32(&f.maxInflightLogins, max, n) {
+				break
+			}
+		}
+		time.Sleep(f.loginDelay)
+	}
+
+	if !login {
+		f.mu.Lock()
+		delay := f.readDelay
+		f.mu.Unlock()
+		time.Sleep(delay)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if path == "sys/health" {
+		writeJSON(w, 299, map[string]interface{}{"initialized": true, "sealed": f.sealed})
+		return
+	}
+
+	if f.namespace != "" && req.Header.Get("X-Vault-Namespace") != f.namespace {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+		return
+	}
+
+	if login && f.failLogins > 0 {
+		f.failLogins--
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"errors": []string{"standby promoting"}})
+		return
+	}
+	if login {
+		f.logins++
+		f.lastLogin = map[string]interface{}{}
+		f.lastLoginPath = path
+		json.NewDecoder(req.Body).Decode(&f.lastLogin)
+		if jwt, ok := f.lastLogin["jwt"]; ok && f.validJWT != "" && jwt != f.validJWT {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   "test-token-" + strconv.Itoa(f.logins),
+				"lease_duration": 3600,
+				"renewable":      true,
+				"num_uses":       f.numUses,
+			},
+		})
+		return
+	}
+
+	if f.revoked[req.Header.Get("X-Vault-Token")] {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	if f.numUses > 0 {
+		token := req.Header.Get("X-Vault-Token")
+		if f.used[token] >= f.numUses {
+			f.denied++
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		f.used[token]++
+	}
+
+	if path == "auth/token/renew-self" {
+		f.renewals++
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   req.Header.Get("X-Vault-Token"),
+				"lease_duration": 3600,
+				"renewable":      true,
+			},
+		})
+		return
+	}
+
+	if path == "sys/leases/renew" || path == "sys/leases/revoke" {
+		var body struct {
+			LeaseID   string `json:"lease_id"`
+			Increment int    `json:"increment"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		if path == "sys/leases/revoke" {
+			f.revokedLeases = append(f.revokedLeases, body.LeaseID)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"lease_id": body.LeaseID})
+			return
+		}
+		f.renewedLeases = append(f.renewedLeases, body.LeaseID)
+		ttl := body.Increment
+		if f.maxLeaseTTL > 0 && ttl > f.maxLeaseTTL {
+			ttl = f.maxLeaseTTL
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"lease_id": body.LeaseID, "lease_duration": ttl, "renewable": true})
+		return
+	}
+
+	// secret/ is the only mount, a KV v2 one
+	if strings.HasPrefix(path, "sys/internal/ui/mounts/") {
+		f.mountLookups++
+		if strings.HasPrefix(strings.TrimPrefix(path, "sys/internal/ui/mounts/"), "kv/") {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+				"path": "kv/",
+				"type": "kv",
+			}})
+			return
+		}
+		if !strings.HasPrefix(strings.TrimPrefix(path, "sys/internal/ui/mounts/"), "secret/") {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"path":    "secret/",
+			"type":    "kv",
+			"options": map[string]interface{}{"version": "2"},
+		}})
+		return
+	}
+
+	// The fake ciphertexts are the base64 plaintext behind the vault:v1:
+	// prefix
+	if strings.HasPrefix(path, "transit/decrypt/") {
+		var body struct {
+			Ciphertext string `json:"ciphertext"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		f.decrypts++
+		if !strings.HasPrefix(body.Ciphertext, "vault:v1:") {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid ciphertext: no prefix"}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"plaintext": strings.TrimPrefix(body.Ciphertext, "vault:v1:"),
+		}})
+		return
+	}
+
+	if path == "sys/wrapping/unwrap" {
+		var body struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		payload, ok := f.wrapped[body.Token]
+		if !ok || payload == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"wrapping token is not valid or does not exist"}})
+			return
+		}
+		f.wrapped[body.Token] = nil
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": payload})
+		return
+	}
+
+	f.reads++
+	f.lastToken = req.Header.Get("X-Vault-Token")
+	if payload, ok := f.wrapping[path]; ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"wrap_info": map[string]interface{}{
+			"token": f.wrapLocked(payload),
+			"ttl":   300,
+		}})
+		return
+	}
+	f.lastForward = req.Header.Get("X-Vault-Forward")
+	if f.standbyReads > 0 {
+		f.standbyReads--
+		writeJSON(w, http.StatusPreconditionFailed, map[string]interface{}{"errors": []string{"required index state not present"}})
+		return
+	}
+	if f.failReads > 0 {
+		f.failReads--
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"errors": []string{"plugin unavailable"}})
+		return
+	}
+	if versions, ok := f.versions[path]; ok {
+		version := len(versions)
+		if v := req.URL.Query().Get("version"); v != "" {
+			version, _ = strconv.Atoi(v)
+		}
+		if version < 1 || version > len(versions) {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		// The deleted versions are not found, with their metadata
+		if versions[version-1] == nil {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"data": map[string]interface{}{
+				"data": nil,
+				"metadata": map[string]interface{}{
+					"version":       version,
+					"created_time":  "2022-01-01T00:00:00Z",
+					"deletion_time": "2022-01-02T00:00:00Z",
+				},
+			}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"data": versions[version-1],
+			"metadata": map[string]interface{}{
+				"version":         version,
+				"created_time":    fmt.Sprintf("2022-01-%02dT00:00:00.123456Z", version),
+				"custom_metadata": f.custom[path],
+			},
+		}})
+		return
+	}
+
+	if n, ok := f.dynamic[path]; ok {
+		n++
+		f.dynamic[path] = n
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"lease_id":       path + "/" + strconv.Itoa(n),
+			"lease_duration": 60,
+			"renewable":      !f.nonRenewable,
+			"data": map[string]interface{}{"data": map[string]interface{}{
+				"username": "user-" + strconv.Itoa(n),
+				"password": "password-" + strconv.Itoa(n),
+			}},
+		})
+		return
+	}
+
+	data, ok := f.responses[path]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// memoryLogical is an in-memory VaultLogical, it serves the data set per path
+// to the token of its logins
+type memoryLogical struct {
+	data   map[string]map[string]interface{}
+	token  string
+	logins int
+
+	// malformed are the paths whose data the read chokes on, standing for a
+	// response the operator doesn't expect
+	malformed map[string]bool
+}
+
+func (l *memoryLogical) SetToken(token string) {
+	l.token = token
+}
+
+func (l *memoryLogical) ReadWithData(_ context.Context, path string, _ map[string][]string) (*vaultapi.Secret, error) {
+	if l.token != "memory-token" {
+		return nil, &vaultapi.ResponseError{StatusCode: http.StatusForbidden, Errors: []string{"permission denied"}}
+	}
+	data, ok := l.data[path]
+	if !ok {
+		return nil, nil
+	}
+	if l.malformed[path] {
+		_ = data["data"].(map[string]interface{})["value"].(string)
+	}
+	return &vaultapi.Secret{Data: data}, nil
+}
+
+func (l *memoryLogical) Write(_ context.Context, path string, _ map[string]interface{}) (*vaultapi.Secret, error) {
+	return nil, nil
+}
+
+func (l *memoryLogical) Login(_ context.Context, authPath string, _ map[string]interface{}) (*VaultLogin, error) {
+	l.logins++
+	return &VaultLogin{ClientToken: "memory-token", LeaseDuration: 3600}, nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// vaultSecretFinalizer holds the deletion of a VaultSecret until the Vault
+// leases of its child Secret are revoked and its copies, which owner
+// references can't collect across namespaces, are deleted
+const vaultSecretFinalizer = "apps.vault.op/finalizer"
+
+// revokeFailedReason is the reason of the events of the leases of a deleted
+// VaultSecret that couldn't be revoked
+const revokeFailedReason = "RevokeFailed"
+
+// addFinalizer registers the finalizer of the VaultSecret
+func (r *VaultSecretReconciler) addFinalizer(ctx context.Context, vs *appsv1.VaultSecret) error {
+	if controllerutil.ContainsFinalizer(vs, vaultSecretFinalizer) {
+		return nil
+	}
+
+	controllerutil.AddFinalizer(vs, vaultSecretFinalizer)
+	if err := r.Update(ctx, vs); err != nil {
+		log.FromContext(ctx).Error(err, "failed to add the finalizer")
+		return err
+	}
+
+	return nil
+}
+
+// orphanedFromAnnotation marks the Secrets and ConfigMaps retained after the
+// deletion of their VaultSecret with its <namespace>/<name>
+const orphanedFromAnnotation = "apps.vault.op/orphaned-from"
+
+// finalize revokes the Vault leases of the child Secret of the deleted
+// VaultSecret, the current one and the ones pending a revocation, and then
+// removes the finalizer. The Secret itself is garbage collected, its copies
+// in the other namespaces are deleted, the CopiedNamespaces and then the ones
+// missing from them. The Vault tokens are shared by the VaultSecrets of a
+// role, they're left to expire. With the Retain DeletionPolicy the objects
+// of the VaultSecret are released instead, and their leases are left alone.
+//
+// The Vault config is only built when there are leases to revoke, and a
+// lease that can't be revoked doesn't hold the deletion: the Vault expires it
+// by its TTL, a Warning event reports it.
+func (r *VaultSecretReconciler) finalize(ctx context.Context, vs *appsv1.VaultSecret) error {
+	if !controllerutil.ContainsFinalizer(vs, vaultSecretFinalizer) {
+		return nil
+	}
+
+	if vs.Spec.DeletionPolicy == appsv1.DeletionPolicyRetain {
+		if err := r.releaseOwned(ctx, vs); err != nil {
+			return err
+		}
+		return r.removeFinalizer(ctx, vs)
+	}
+
+	secret := &core.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: vs.SecretNameOrDefault(), Namespace: vs.Namespace}, secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.FromContext(ctx).Error(err, "unable to get the child Secret")
+		return err
+	}
+	if err == nil && metav1.IsControlledBy(secret, vs) {
+		r.revokeLeases(ctx, vs, secretLeases(ctx, secret))
+	}
+
+	if err := r.deleteCopies(ctx, vs, nil); err != nil {
+		return err
+	}
+	if err := r.deleteStrayCopies(ctx, vs); err != nil {
+		return err
+	}
+
+	return r.removeFinalizer(ctx, vs)
+}
+
+// revokeLeases revokes the Vault leases of the deleted VaultSecret, the
+// failures are only reported
+func (r *VaultSecretReconciler) revokeLeases(ctx context.Context, vs *appsv1.VaultSecret, leases []string) {
+	if len(leases) == 0 {
+		return
+	}
+
+	config, err := r.vaultConfig(ctx, vs)
+	if err != nil {
+		r.Recorder.Event(vs, core.EventTypeWarning, revokeFailedReason, "the Vault leases are left to expire, "+err.Error())
+		return
+	}
+	for _, lease := range leases {
+		log.FromContext(ctx).Info("revoking the Vault lease of the deleted VaultSecret", "lease", lease)
+		if err := r.vaultWrite(ctx, config, "sys/leases/revoke", map[string]interface{}{"lease_id": lease}); err != nil {
+			log.FromContext(ctx).Error(err, "failed to revoke the Vault lease, it's left to expire", "lease", lease)
+			r.Recorder.Event(vs, core.EventTypeWarning, revokeFailedReason, fmt.Sprintf("the Vault lease %s is left to expire, %s", lease, err))
+		}
+	}
+}
+
+// removeFinalizer lets the deletion of the finalized VaultSecret go on and
+// forgets its reads
+func (r *VaultSecretReconciler) removeFinalizer(ctx context.Context, vs *appsv1.VaultSecret) error {
+	controllerutil.RemoveFinalizer(vs, vaultSecretFinalizer)
+	if err := r.Update(ctx, vs); err != nil {
+		log.FromContext(ctx).Error(err, "failed to remove the finalizer")
+		return err
+	}
+	r.reads.forget(types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace})
+	forgetLastSync(types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace})
+
+	return nil
+}
+
+// releaseOwned removes the owner reference of the VaultSecret from the
+// Secrets and ConfigMaps of its namespace it controls, so that they aren't
+// garbage collected along with it, and annotates them with
+// orphanedFromAnnotation. The copies have no owner reference, they're kept
+// as they are.
+func (r *VaultSecretReconciler) releaseOwned(ctx context.Context, vs *appsv1.VaultSecret) error {
+	secrets := &core.SecretList{}
+	if err := r.List(ctx, secrets, client.InNamespace(vs.Namespace)); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list the Secrets of the VaultSecret")
+		return err
+	}
+	configMaps := &core.ConfigMapList{}
+	if err := r.List(ctx, configMaps, client.InNamespace(vs.Namespace)); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list the ConfigMaps of the VaultSecret")
+		return err
+	}
+
+	var owned []client.Object
+	for i := range secrets.Items {
+		owned = append(owned, &secrets.Items[i])
+	}
+	for i := range configMaps.Items {
+		owned = append(owned, &configMaps.Items[i])
+	}
+
+	for _, obj := range owned {
+		if !metav1.IsControlledBy(obj, vs) {
+			continue
+		}
+		var refs []metav1.OwnerReference
+		for _, ref := range obj.GetOwnerReferences() {
+			if ref.UID != vs.UID {
+				refs = append(refs, ref)
+			}
+		}
+		obj.SetOwnerReferences(refs)
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[orphanedFromAnnotation] = copyOf(vs)
+		obj.SetAnnotations(annotations)
+
+		log.FromContext(ctx).Info("retaining the object of the deleted VaultSecret", "name", obj.GetName())
+		if err := r.Update(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			log.FromContext(ctx).Error(err, "failed to release the object of the deleted VaultSecret", "name", obj.GetName())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// secretLeases returns the Vault leases held by the child Secret in order
+func secretLeases(ctx context.Context, secret *core.Secret) []string {
+	var leases []string
+	if lease := secret.Annotations[leaseAnnotation]; lease != "" {
+		leases = append(leases, lease)
+	}
+	for lease := range pendingRevocations(ctx, secret) {
+		leases = append(leases, lease)
+	}
+	sort.Strings(leases)
+
+	return leases
+}
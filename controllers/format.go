@@ -0,0 +1,93 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"sigs.k8s.io/yaml"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// formatSecret renders the Format template of the VaultSecret, a subset of
+// the Vault Agent template language. As in Vault Agent, the secret function
+// returns the Vault response for a path, so KV v2 values are found under
+// .Data.data. The secret already read for the VaultSecret is reused when its
+// own path is requested.
+func formatSecret(reader SecretReader, config VaultConfig, format *appsv1.SecretFormat, current *vaultapi.Secret) ([]byte, error) {
+	funcs := valueFuncs()
+	funcs["secret"] = func(path string) (*vaultapi.Secret, error) {
+		if strings.Trim(path, "/") == strings.Trim(config.Path, "/") {
+			return current, nil
+		}
+		c := config
+		c.Path = path
+		c.Version = 0
+		return reader.ReadSecret(c)
+	}
+
+	tmpl, err := template.New(format.Key).Funcs(funcs).Option("missingkey=error").Parse(format.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// encodeSecret serializes the Secret data in the dotenv, json or yaml Format
+// type. The values are stored as strings, sorted by key.
+func encodeSecret(data map[string][]byte, formatType string) ([]byte, error) {
+	values := make(map[string]string, len(data))
+	for k, v := range data {
+		values[k] = string(v)
+	}
+
+	switch formatType {
+	case appsv1.SecretFormatDotenv:
+		var out bytes.Buffer
+		for _, k := range sortedKeys(data) {
+			out.WriteString(k + "=" + dotenvQuote(values[k]) + "\n")
+		}
+		return out.Bytes(), nil
+	case appsv1.SecretFormatJSON:
+		return json.Marshal(values)
+	case appsv1.SecretFormatYAML:
+		return yaml.Marshal(values)
+	default:
+		return nil, fmt.Errorf("unsupported format type %q", formatType)
+	}
+}
+
+// dotenvEscaper escapes the characters a double-quoted dotenv value can't
+// hold as is, the multi-line values are kept on a single line
+var dotenvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+
+// dotenvQuote double-quotes the value for a dotenv file
+func dotenvQuote(value string) string {
+	return `"` + dotenvEscaper.Replace(value) + `"`
+}
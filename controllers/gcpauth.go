@@ -0,0 +1,103 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	gcpAuthMethod = "gcp"
+
+	// defaultGCEMetadataHost is the metadata server of the GCE instances and
+	// of the GKE Workload Identity pods
+	defaultGCEMetadataHost = "metadata.google.internal"
+
+	// gceMetadataHostEnvVar overrides the metadata server, as for the Google
+	// client libraries
+	gceMetadataHostEnvVar = "GCE_METADATA_HOST"
+
+	// gceMetadataTimeout bounds the identity token requests
+	gceMetadataTimeout = 10 * time.Second
+)
+
+func init() {
+	RegisterAuthenticator(gcpAuthMethod, gcpAuthenticator{})
+}
+
+// gcpAuthenticator logs in with an identity token of the service account of
+// the operator signed by the metadata server, for the vault/<role> audience
+// the gcp auth method expects. The tokens expire within the hour, one is
+// requested for every login.
+type gcpAuthenticator struct{}
+
+func (gcpAuthenticator) UsesRole() bool {
+	return true
+}
+
+func (gcpAuthenticator) LoginData(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (map[string]interface{}, error) {
+	jwt, err := gceIdentityToken(ctx, "http://vault/"+vaultConfig.Role)
+	if err != nil {
+		return nil, fmt.Errorf("can't get an identity token from the GCE metadata server: %w", err)
+	}
+
+	return map[string]interface{}{
+		"jwt":  jwt,
+		"role": vaultConfig.Role,
+	}, nil
+}
+
+// gceIdentityToken returns an identity token of the default service account
+// signed for the audience, in the full format holding the instance claims
+func gceIdentityToken(ctx context.Context, audience string) (string, error) {
+	host := os.Getenv(gceMetadataHostEnvVar)
+	if host == "" {
+		host = defaultGCEMetadataHost
+	}
+	query := url.Values{"audience": {audience}, "format": {"full"}}
+	endpoint := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/identity?" + query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, gceMetadataTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the metadata server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// healthCheckTimeout bounds the sys/health requests of the readiness checks
+const healthCheckTimeout = 5 * time.Second
+
+// VaultHealthCheck returns a readiness check of the Vault at the address in
+// sys/health. The Vault is ready once initialized and unsealed, a standby
+// forwards the requests to the active node. It's not meant as a liveness
+// check, restarting the operator doesn't help an unreachable Vault.
+func (r *VaultSecretReconciler) VaultHealthCheck(addr string) healthz.Checker {
+	return func(req *http.Request) error {
+		return r.vaultHealth(req.Context(), VaultConfig{Addr: addr, ClientTimeout: healthCheckTimeout})
+	}
+}
+
+// vaultHealth checks the Vault of the config in sys/health, as the
+// VaultHealthCheck does
+func (r *VaultSecretReconciler) vaultHealth(ctx context.Context, config VaultConfig) error {
+	client, err := r.newVaultClient(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	// the standby and uninitialized codes are overridden to read the state
+	// out of the body, like vaultapi.Sys.Health does
+	request := client.NewRequest(http.MethodGet, "/v1/sys/health")
+	for _, param := range []string{"uninitcode", "sealedcode", "standbycode", "drsecondarycode", "performancestandbycode"} {
+		request.Params.Add(param, "299")
+	}
+	resp, err := client.RawRequestWithContext(ctx, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var health vaultapi.HealthResponse
+	if err := resp.DecodeJSON(&health); err != nil {
+		return err
+	}
+	switch {
+	case !health.Initialized:
+		return errors.New("the Vault at " + config.Addr + " is not initialized")
+	case health.Sealed:
+		return errors.New("the Vault at " + config.Addr + " is sealed")
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Vault health check", func() {
+	var vault *fakeVault
+
+	BeforeEach(func() {
+		vault = newFakeVault()
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	check := func(addr string) error {
+		return (&VaultSecretReconciler{}).VaultHealthCheck(addr)(httptest.NewRequest("GET", "/readyz", nil))
+	}
+
+	It("passes for an unsealed Vault", func() {
+		Expect(check(vault.URL)).To(Succeed())
+	})
+
+	It("fails for a sealed Vault", func() {
+		vault.sealed = true
+		Expect(check(vault.URL)).To(MatchError(ContainSubstring("is sealed")))
+	})
+
+	It("fails for an unreachable Vault", func() {
+		addr := vault.URL
+		vault.Close()
+		Expect(check(addr)).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,125 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// jwtCache keeps the ServiceAccount tokens read from disk in memory, so that
+// all the VaultSecrets sharing a token file don't re-read it on every login.
+// The directories of the cached files are watched and their entries dropped
+// on any change, which covers the kubelet rotating projected tokens through
+// symlink swaps. It's safe for concurrent use.
+type jwtCache struct {
+	mu      sync.RWMutex
+	tokens  map[string][]byte
+	watcher *fsnotify.Watcher
+	watched map[string]bool
+}
+
+// read returns the contents of the token file, from memory when possible
+func (c *jwtCache) read(file string) ([]byte, error) {
+	file = filepath.Clean(file)
+
+	c.mu.RLock()
+	jwt, ok := c.tokens[file]
+	c.mu.RUnlock()
+	if ok {
+		return jwt, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Without a working watcher we can't tell when to invalidate, so the file
+	// is read every time
+	if !c.watch(filepath.Dir(file)) {
+		return ioutil.ReadFile(file)
+	}
+
+	jwt, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c.tokens[file] = jwt
+
+	return jwt, nil
+}
+
+// forget drops the cached token of the file, so that the next read goes to
+// the disk even when no change was noticed
+func (c *jwtCache) forget(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, filepath.Clean(file))
+}
+
+// watch starts watching the directory, it must be called with the lock held
+func (c *jwtCache) watch(dir string) bool {
+	if c.watcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Log.Error(err, "can't watch the JWT files, caching is disabled")
+			return false
+		}
+		c.watcher = watcher
+		c.tokens = map[string][]byte{}
+		c.watched = map[string]bool{}
+		go c.invalidate(watcher)
+	}
+
+	if !c.watched[dir] {
+		if err := c.watcher.Add(dir); err != nil {
+			log.Log.Error(err, "can't watch the JWT directory", "dir", dir)
+			return false
+		}
+		c.watched[dir] = true
+	}
+
+	return true
+}
+
+// invalidate drops the cached tokens of a directory whenever it changes
+func (c *jwtCache) invalidate(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			dir := filepath.Dir(event.Name)
+			c.mu.Lock()
+			for file := range c.tokens {
+				if filepath.Dir(file) == dir {
+					delete(c.tokens, file)
+				}
+			}
+			c.mu.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Log.Error(err, "JWT file watcher failed")
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JWT cache", func() {
+	var (
+		dir   string
+		file  string
+		cache *jwtCache
+	)
+
+	// rotate swaps the token the way the kubelet does for projected volumes
+	rotate := func(jwt string) {
+		tmp := filepath.Join(dir, "..tmp")
+		Expect(ioutil.WriteFile(tmp, []byte(jwt), 0600)).To(Succeed())
+		Expect(os.Rename(tmp, file)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "jwt-cache")
+		Expect(err).NotTo(HaveOccurred())
+		file = filepath.Join(dir, "token")
+		Expect(ioutil.WriteFile(file, []byte("first"), 0600)).To(Succeed())
+		cache = &jwtCache{}
+	})
+
+	AfterEach(func() {
+		if cache.watcher != nil {
+			cache.watcher.Close()
+		}
+		os.RemoveAll(dir)
+	})
+
+	It("serves the token from memory until the file is rotated", func() {
+		Expect(cache.read(file)).To(Equal([]byte("first")))
+
+		cache.mu.RLock()
+		Expect(cache.tokens).To(HaveKey(file))
+		cache.mu.RUnlock()
+
+		rotate("second")
+		Eventually(func() ([]byte, error) { return cache.read(file) }).Should(Equal([]byte("second")))
+	})
+
+	It("is safe for concurrent readers", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(cache.read(file)).To(Equal([]byte("first")))
+			}()
+		}
+		wg.Wait()
+	})
+})
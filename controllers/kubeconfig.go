@@ -0,0 +1,76 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	defaultKubeconfigContext = "default"
+	defaultPKICertKey        = "certificate"
+	defaultPKIPrivateKeyKey  = "private_key"
+)
+
+// renderKubeconfig builds a kubeconfig authenticating with the PKI issued
+// client certificate found in the Secret data and stores it in the output key
+func renderKubeconfig(out *appsv1.KubeconfigOutput, data map[string][]byte) error {
+	certKey := stringOr(out.CertificateKey, defaultPKICertKey)
+	privateKeyKey := stringOr(out.PrivateKeyKey, defaultPKIPrivateKeyKey)
+	name := stringOr(out.Context, defaultKubeconfigContext)
+
+	cert, ok := data[certKey]
+	if !ok {
+		return errors.New("can't render the kubeconfig, certificate key not found: " + certKey)
+	}
+	key, ok := data[privateKeyKey]
+	if !ok {
+		return errors.New("can't render the kubeconfig, private key key not found: " + privateKeyKey)
+	}
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters[name] = &clientcmdapi.Cluster{
+		Server:                   out.Server,
+		CertificateAuthorityData: []byte(out.CertificateAuthority),
+	}
+	config.AuthInfos[name] = &clientcmdapi.AuthInfo{
+		ClientCertificateData: cert,
+		ClientKeyData:         key,
+	}
+	config.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+	config.CurrentContext = name
+
+	kubeconfig, err := clientcmd.Write(*config)
+	if err != nil {
+		return err
+	}
+	data[stringOr(out.Key, appsv1.DefaultKubeconfigKey)] = kubeconfig
+
+	return nil
+}
+
+func stringOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	vaultapi "github.com/hashicorp/vault/api"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	// kvVersion1 is the KVVersion of KV v1 mounts, whose payload isn't
+	// wrapped
+	kvVersion1 = "v1"
+	kvVersion2 = "v2"
+
+	// kvVersionAuto is the KVVersion looking the version of the mount up
+	kvVersionAuto = "auto"
+)
+
+// kvSecret is the envelope of a KV v2 read response
+type kvSecret struct {
+	Data     map[string]interface{}
+	Metadata *kvMetadata
+	Warnings []string
+
+	// Nesting is the number of extra nested "data" levels unwrapped to reach
+	// the Data
+	Nesting int
+}
+
+// kvMetadata is the version metadata of a KV v2 secret
+type kvMetadata struct {
+	Version        int               `json:"version"`
+	CreatedTime    string            `json:"created_time"`
+	DeletionTime   string            `json:"deletion_time"`
+	Destroyed      bool              `json:"destroyed"`
+	CustomMetadata map[string]string `json:"custom_metadata"`
+}
+
+// deletedSecretError is a read of a KV v2 version that was soft-deleted or
+// destroyed, its data is gone but its metadata is still served. The child
+// Secret is left as is rather than emptied.
+type deletedSecretError struct {
+	version   int
+	destroyed bool
+}
+
+func (e *deletedSecretError) Error() string {
+	state := "deleted"
+	if e.destroyed {
+		state = "destroyed"
+	}
+
+	return fmt.Sprintf("the version %d of the Vault secret was %s, the Secret is left as is", e.version, state)
+}
+
+// emptySecretError is a read of a Vault secret without data while the child
+// Secret holds some, kept as is unless PreserveOnEmpty is off
+type emptySecretError struct{}
+
+func (e *emptySecretError) Error() string {
+	return "the Vault secret is empty, the Secret is left as is"
+}
+
+// parseKV parses the KV v2 envelope of the Vault secret. A nil secret, as
+// returned for missing paths, parses into an empty envelope.
+//
+// Responses of a KV v2 mount read through the KV v1 API, or written back as
+// is, nest a whole {"data", "metadata"} envelope in the data. Up to
+// maxDataNesting such levels are unwrapped, the metadata is the outermost one.
+func parseKV(secret *vaultapi.Secret) (*kvSecret, error) {
+	kv := &kvSecret{}
+	if secret == nil {
+		return kv, nil
+	}
+	kv.Warnings = secret.Warnings
+
+	envelope := secret.Data
+	if _, ok := envelope["data"]; !ok && len(envelope) > 0 {
+		return nil, errors.New("the Vault secret has no KV v2 data field, KV v1 mounts need the v1 KVVersion")
+	}
+	if raw, ok := envelope["metadata"]; ok && raw != nil {
+		kv.Metadata = &kvMetadata{}
+		if err := remarshal(raw, kv.Metadata); err != nil {
+			return nil, fmt.Errorf("can't parse the KV v2 metadata: %w", err)
+		}
+	}
+
+	for {
+		data, err := kvData(envelope["data"])
+		if err != nil {
+			return nil, err
+		}
+		kv.Data = data
+
+		nested, ok := data["data"].(map[string]interface{})
+		if !ok || kv.Nesting == maxDataNesting || !isEnvelope(data) {
+			return kv, nil
+		}
+		envelope = data
+		kv.Data = nested
+		kv.Nesting++
+	}
+}
+
+// parseKVv1 parses a KV v1 secret, whose data is the payload itself
+func parseKVv1(secret *vaultapi.Secret) *kvSecret {
+	kv := &kvSecret{}
+	if secret == nil {
+		return kv
+	}
+	kv.Warnings = secret.Warnings
+	kv.Data = secret.Data
+
+	return kv
+}
+
+// parseVaultSecret parses the secret read for the VaultSecret as per its
+// KVVersion. The deleted and destroyed KV v2 versions fail with a
+// deletedSecretError.
+func parseVaultSecret(vs *appsv1.VaultSecret, secret *vaultapi.Secret) (*kvSecret, error) {
+	if vs.Spec.KVVersion == kvVersion1 {
+		return parseKVv1(secret), nil
+	}
+
+	kv, err := parseKV(secret)
+	if err != nil {
+		return nil, err
+	}
+	if kv.Data == nil && kv.Metadata != nil && (kv.Metadata.DeletionTime != "" || kv.Metadata.Destroyed) {
+		return nil, &deletedSecretError{version: kv.Metadata.Version, destroyed: kv.Metadata.Destroyed}
+	}
+
+	return kv, nil
+}
+
+// version returns the KV v2 version of the secret, if known
+func (kv *kvSecret) version() (int, bool) {
+	if kv.Metadata == nil || kv.Metadata.Version == 0 {
+		return 0, false
+	}
+
+	return kv.Metadata.Version, true
+}
+
+func kvData(raw interface{}) (map[string]interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	data, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the KV data is a %T, not an object", raw)
+	}
+
+	return data, nil
+}
+
+// isEnvelope reports whether the map only has the fields of a KV v2 envelope
+func isEnvelope(m map[string]interface{}) bool {
+	for k := range m {
+		if k != "data" && k != "metadata" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// remarshal decodes a generic JSON value into a typed one
+func remarshal(in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+var _ = Describe("KV v2 parsing", func() {
+	parse := func(response string) (*kvSecret, error) {
+		secret, err := vaultapi.ParseSecret(strings.NewReader(response))
+		Expect(err).NotTo(HaveOccurred())
+		return parseKV(secret)
+	}
+
+	It("parses a read response", func() {
+		kv, err := parse(`{
+			"request_id": "b5a0c3a4", "lease_id": "", "renewable": false, "lease_duration": 0,
+			"data": {
+				"data": {"password": "s3cr3t"},
+				"metadata": {
+					"created_time": "2022-01-01T00:00:00.000000Z",
+					"custom_metadata": {"owner": "team-a"},
+					"deletion_time": "",
+					"destroyed": false,
+					"version": 3
+				}
+			},
+			"warnings": null
+		}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.Data).To(Equal(map[string]interface{}{"password": "s3cr3t"}))
+		Expect(kv.Metadata).To(Equal(&kvMetadata{
+			Version:        3,
+			CreatedTime:    "2022-01-01T00:00:00.000000Z",
+			CustomMetadata: map[string]string{"owner": "team-a"},
+		}))
+		version, ok := kv.version()
+		Expect(ok).To(BeTrue())
+		Expect(version).To(Equal(3))
+		Expect(kv.Nesting).To(BeZero())
+	})
+
+	It("parses a deleted version without data", func() {
+		kv, err := parse(`{"data": {"data": null, "metadata": {
+			"created_time": "2022-01-01T00:00:00Z", "deletion_time": "2022-01-02T00:00:00Z",
+			"destroyed": false, "version": 2
+		}}}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.Data).To(BeEmpty())
+		Expect(kv.Metadata.DeletionTime).To(Equal("2022-01-02T00:00:00Z"))
+	})
+
+	It("keeps the response warnings", func() {
+		kv, err := parse(`{"data": {"data": {"a": "1"}, "metadata": {"version": 1}},
+			"warnings": ["Invalid path for a versioned K/V secrets engine"]}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.Warnings).To(ConsistOf("Invalid path for a versioned K/V secrets engine"))
+	})
+
+	It("unwraps a nested envelope", func() {
+		kv, err := parse(`{"data": {"data": {"data": {"a": "1"}, "metadata": {"version": 7}}}}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.Data).To(Equal(map[string]interface{}{"a": "1"}))
+		Expect(kv.Nesting).To(Equal(1))
+	})
+
+	It("doesn't unwrap a data key next to other keys", func() {
+		kv, err := parse(`{"data": {"data": {"data": {"a": "1"}, "b": "2"}, "metadata": {"version": 1}}}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.Data).To(HaveKey("b"))
+		Expect(kv.Nesting).To(BeZero())
+	})
+
+	It("rejects data that isn't an object", func() {
+		_, err := parse(`{"data": {"data": "oops", "metadata": {"version": 1}}}`)
+		Expect(err).To(MatchError(ContainSubstring("not an object")))
+	})
+
+	It("rejects a KV v1 payload", func() {
+		_, err := parse(`{"data": {"password": "s3cr3t"}}`)
+		Expect(err).To(MatchError(ContainSubstring("KV v1 mounts need the v1 KVVersion")))
+	})
+
+	It("parses a KV v1 payload as is", func() {
+		secret, err := vaultapi.ParseSecret(strings.NewReader(`{"data": {"password": "s3cr3t", "data": "x"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		kv := parseKVv1(secret)
+		Expect(kv.Data).To(Equal(map[string]interface{}{"password": "s3cr3t", "data": "x"}))
+		_, ok := kv.version()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("fails the sync of a deleted or destroyed version", func() {
+		vs := &appsv1.VaultSecret{}
+		secret, err := vaultapi.ParseSecret(strings.NewReader(`{"data": {"data": null, "metadata": {"version": 3, "deletion_time": "2022-01-02T03:04:05Z", "destroyed": false}}}`))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = parseVaultSecret(vs, secret)
+		Expect(err).To(MatchError("the version 3 of the Vault secret was deleted, the Secret is left as is"))
+
+		secret, err = vaultapi.ParseSecret(strings.NewReader(`{"data": {"data": null, "metadata": {"version": 4, "deletion_time": "", "destroyed": true}}}`))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = parseVaultSecret(vs, secret)
+		Expect(err).To(MatchError("the version 4 of the Vault secret was destroyed, the Secret is left as is"))
+	})
+
+	It("parses a missing secret into an empty envelope", func() {
+		kv, err := parseKV(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.Data).To(BeEmpty())
+		_, ok := kv.version()
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,181 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// mountKey identifies a path of a Vault
+type mountKey struct {
+	addr           string
+	vaultNamespace string
+	path           string
+}
+
+// kvMount is the mount of a path, with the KVVersion of its KV engine, empty
+// for the other engines
+type kvMount struct {
+	path    string
+	version string
+}
+
+// kvMountCache keeps the mount of the paths. The mounts are looked up once
+// per path, a remount isn't seen until the operator restarts. It's safe for
+// concurrent use.
+type kvMountCache struct {
+	mu     sync.Mutex
+	mounts map[mountKey]kvMount
+}
+
+func (c *kvMountCache) get(key mountKey) (kvMount, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mount, ok := c.mounts[key]
+
+	return mount, ok
+}
+
+func (c *kvMountCache) put(key mountKey, mount kvMount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mounts == nil {
+		c.mounts = map[mountKey]kvMount{}
+	}
+	c.mounts[key] = mount
+}
+
+// kvDataPath returns the path to read, with the data/ segment inserted after
+// the mount when the path is on a KV v2 mount and lacks it, e.g. secret/app
+// is read as secret/data/app, or the metadata/ one when the path is listed.
+// The paths holding a data or metadata segment
+// past their first one are taken as is, without a lookup. Only the login
+// errors are returned, the path is read as is when the lookup fails and the
+// read tells what's wrong.
+func (r *VaultSecretReconciler) kvDataPath(ctx context.Context, logical VaultLogical, vaultConfig VaultConfig, tokenKey tokenKey, login func() (vaultToken, error)) (string, error) {
+	if hasDataSegment(vaultConfig.Path) {
+		return vaultConfig.Path, nil
+	}
+
+	mount, err := r.kvMount(ctx, logical, vaultConfig, tokenKey, login)
+	if err != nil {
+		return "", err
+	}
+
+	return mount.dataPath(ctx, vaultConfig.Path, vaultConfig.List), nil
+}
+
+// kvMount returns the mount of the path, looked up on sys/internal/ui/mounts
+// as the Vault CLI does, with a token use of its own. The failed lookups, as
+// denied by policies not granting the endpoint, return an empty mount and
+// aren't cached. Only the login errors are returned.
+func (r *VaultSecretReconciler) kvMount(ctx context.Context, logical VaultLogical, vaultConfig VaultConfig, tokenKey tokenKey, login func() (vaultToken, error)) (kvMount, error) {
+	path := strings.Trim(vaultConfig.Path, "/")
+	key := mountKey{addr: vaultConfig.Addr, vaultNamespace: vaultConfig.VaultNamespace, path: path}
+	if mount, ok := r.mounts.get(key); ok {
+		return mount, nil
+	}
+
+	token, _, err := r.tokens.getOrLogin(tokenKey, login)
+	if err != nil {
+		return kvMount{}, err
+	}
+	logical.SetToken(token)
+	mount, err := lookupKVMount(ctx, logical, path)
+	if err != nil {
+		log.FromContext(ctx).Info("can't look the mount of the path up, reading it as is", "error", err.Error())
+		return kvMount{}, nil
+	}
+	r.mounts.put(key, mount)
+
+	return mount, nil
+}
+
+// dataPath returns the path with the data/ segment, or the metadata/ one of
+// the listed paths, inserted after the mount if it's a KV v2 one and the path
+// lacks it
+func (m kvMount) dataPath(ctx context.Context, path string, list bool) string {
+	trimmed := strings.Trim(path, "/")
+	rel := strings.TrimPrefix(trimmed, m.path+"/")
+	if m.version != kvVersion2 || rel == trimmed || hasDataSegment(path) {
+		return path
+	}
+
+	segment := "data"
+	if list {
+		segment = "metadata"
+	}
+	dataPath := m.path + "/" + segment + "/" + rel
+	log.FromContext(ctx).Info("inserting the "+segment+"/ segment missing from the path of the KV v2 mount", "dataPath", dataPath)
+	return dataPath
+}
+
+// hasDataSegment reports whether the path holds a data or metadata segment
+// past its first one
+func hasDataSegment(path string) bool {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, segment := range segments[1:] {
+		if segment == "data" || segment == "metadata" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupKVMount returns the mount of the path with the version of its KV
+// engine, KV mounts without a version option being v1 ones
+func lookupKVMount(ctx context.Context, logical VaultLogical, path string) (kvMount, error) {
+	secret, err := logical.ReadWithData(ctx, "sys/internal/ui/mounts/"+path, nil)
+	if err != nil {
+		return kvMount{}, err
+	}
+	if secret == nil {
+		return kvMount{}, nil
+	}
+
+	mountType, _ := secret.Data["type"].(string)
+	options, _ := secret.Data["options"].(map[string]interface{})
+	mountPath, _ := secret.Data["path"].(string)
+	if mountType != "kv" || mountPath == "" {
+		return kvMount{}, nil
+	}
+	mount := kvMount{path: strings.Trim(mountPath, "/"), version: kvVersion1}
+	if options["version"] == "2" {
+		mount.version = kvVersion2
+	}
+
+	return mount, nil
+}
+
+// wrapKVv1 returns the secret read on a KV v1 mount with its payload wrapped
+// in a data field, as KV v2 reads return it, so that the auto KVVersion parses
+// both alike
+func wrapKVv1(secret *vaultapi.Secret) *vaultapi.Secret {
+	if secret == nil {
+		return nil
+	}
+	wrapped := *secret
+	wrapped.Data = map[string]interface{}{"data": secret.Data}
+
+	return &wrapped
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	// leaseAnnotation on the child Secret holds the Vault lease of the
+	// dynamic credentials it contains
+	leaseAnnotation = "apps.vault.op/lease-id"
+
+	// pendingRevocationsAnnotation on the child Secret holds the replaced
+	// leases kept alive for the OverlapWindow, mapped to their revocation time
+	pendingRevocationsAnnotation = "apps.vault.op/pending-revocations"
+
+	// leaseDurationAnnotation holds the duration the lease was issued for,
+	// the increment its renewals ask for
+	leaseDurationAnnotation = "apps.vault.op/lease-duration"
+
+	// leaseRenewAtAnnotation holds the time the lease is due for a renewal,
+	// at leaseRenewalFraction of its term
+	leaseRenewAtAnnotation = "apps.vault.op/lease-renew-at"
+
+	// leaseRenewableAnnotation is "true" while the lease can be renewed for
+	// its whole duration, the credentials are read again otherwise
+	leaseRenewableAnnotation = "apps.vault.op/lease-renewable"
+)
+
+// leaseRenewalFraction is the part of the lease term after which it's renewed
+const leaseRenewalFraction = 2.0 / 3
+
+// isLeaseAnnotation reports whether the annotation describes the lease of the
+// credentials of the child Secret
+func isLeaseAnnotation(name string) bool {
+	switch name {
+	case leaseAnnotation, leaseDurationAnnotation, leaseRenewAtAnnotation, leaseRenewableAnnotation:
+		return true
+	}
+
+	return false
+}
+
+// setLease annotates the Secret with the lease of the credentials read from
+// the Vault
+func (r *VaultSecretReconciler) setLease(s *core.Secret, secret *vaultapi.Secret) {
+	s.Annotations[leaseAnnotation] = secret.LeaseID
+	if secret.LeaseDuration <= 0 {
+		return
+	}
+
+	ttl := time.Duration(secret.LeaseDuration) * time.Second
+	s.Annotations[leaseDurationAnnotation] = strconv.Itoa(secret.LeaseDuration)
+	s.Annotations[leaseRenewAtAnnotation] = leaseRenewAt(r.now(), ttl)
+	if secret.Renewable {
+		s.Annotations[leaseRenewableAnnotation] = "true"
+	}
+}
+
+// leaseRenewAt returns the renewal time of a lease term of ttl from now
+func leaseRenewAt(now time.Time, ttl time.Duration) string {
+	return now.Add(time.Duration(float64(ttl) * leaseRenewalFraction)).UTC().Format(time.RFC3339)
+}
+
+// secretLeaseRenewAt returns the time the lease of the child Secret is due
+// for a renewal, zero when the Secret holds no lease
+func secretLeaseRenewAt(secret *core.Secret) time.Time {
+	at, err := time.Parse(time.RFC3339, secret.Annotations[leaseRenewAtAnnotation])
+	if secret.Annotations[leaseAnnotation] == "" || err != nil {
+		return time.Time{}
+	}
+
+	return at
+}
+
+// renewLease keeps the leased credentials of the child Secret rather than
+// reading new ones, as long as the VaultSecret didn't change since they were
+// synced. The lease is renewed once due, and the time of the next renewal is
+// returned. It returns false when the credentials are to be read again: the
+// lease isn't renewable, its renewal failed or was capped by the max TTL of
+// the lease on the previous term.
+func (r *VaultSecretReconciler) renewLease(ctx context.Context, config VaultConfig, vs *appsv1.VaultSecret, found *core.Secret) (time.Time, bool, error) {
+	renewAt := secretLeaseRenewAt(found)
+	ready := meta.FindStatusCondition(vs.Status.Conditions, conditionReady)
+	if renewAt.IsZero() || ready == nil || ready.Status != metav1.ConditionTrue || ready.ObservedGeneration != vs.Generation || specChanged(vs) {
+		return time.Time{}, false, nil
+	}
+	if rotate, _, err := r.rotationDue(vs, found); err != nil || rotate {
+		return time.Time{}, false, nil
+	}
+
+	if r.now().Before(renewAt) {
+		return renewAt, true, nil
+	}
+	if found.Annotations[leaseRenewableAnnotation] != "true" {
+		log.FromContext(ctx).Info("the Vault lease can't be renewed, reading new credentials", "secret", found.Name)
+		return time.Time{}, false, nil
+	}
+
+	lease := found.Annotations[leaseAnnotation]
+	increment, _ := strconv.Atoi(found.Annotations[leaseDurationAnnotation])
+	renewed, err := r.vaultWriteSecret(ctx, config, "sys/leases/renew", map[string]interface{}{
+		"lease_id":  lease,
+		"increment": increment,
+	})
+	if err == nil && (renewed == nil || renewed.LeaseDuration <= 0) {
+		err = errors.New("no lease duration in the renewal response")
+	}
+	if err != nil {
+		log.FromContext(ctx).Error(err, "failed to renew the Vault lease, reading new credentials", "lease", lease)
+		return time.Time{}, false, nil
+	}
+
+	log.FromContext(ctx).Info("renewed the Vault lease", "lease", lease, "secret", found.Name)
+	ttl := time.Duration(renewed.LeaseDuration) * time.Second
+	found.Annotations[leaseRenewAtAnnotation] = leaseRenewAt(r.now(), ttl)
+	// A lease renewed for less than asked is reaching its max TTL, the
+	// credentials are replaced on the next renewal time instead
+	if renewed.LeaseDuration < increment {
+		delete(found.Annotations, leaseRenewableAnnotation)
+	}
+	if err := r.writeSecret(ctx, vs, found, false); err != nil {
+		log.FromContext(ctx).Error(err, "failed to update the lease of the child Secret", "secret", found.Name)
+		return time.Time{}, false, err
+	}
+	r.Recorder.Event(vs, core.EventTypeNormal, "LeaseRenewed", fmt.Sprintf("renewed the Vault lease %s for %s", lease, ttl))
+
+	return secretLeaseRenewAt(found), true, nil
+}
+
+// pendingRevocations returns the leases waiting for their revocation
+func pendingRevocations(ctx context.Context, secret *core.Secret) map[string]time.Time {
+	pending := map[string]time.Time{}
+	if raw, ok := secret.Annotations[pendingRevocationsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &pending); err != nil {
+			log.FromContext(ctx).Error(err, "ignoring the malformed pending revocations", "secret", secret.Name)
+		}
+	}
+
+	return pending
+}
+
+// setPendingRevocations stores the leases waiting for their revocation in the
+// annotation, removed once there are none left
+func setPendingRevocations(secret *core.Secret, pending map[string]time.Time) {
+	if len(pending) == 0 {
+		delete(secret.Annotations, pendingRevocationsAnnotation)
+		return
+	}
+
+	raw, _ := json.Marshal(pending)
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[pendingRevocationsAnnotation] = string(raw)
+}
+
+// revokeDueLeases revokes the replaced leases of the child Secret whose
+// overlap window has ended, and returns the revocation time of the next one
+func (r *VaultSecretReconciler) revokeDueLeases(ctx context.Context, config VaultConfig, vs *appsv1.VaultSecret, secret *core.Secret) (time.Time, error) {
+	pending := pendingRevocations(ctx, secret)
+	if len(pending) == 0 {
+		return time.Time{}, nil
+	}
+
+	leases := make([]string, 0, len(pending))
+	for lease := range pending {
+		leases = append(leases, lease)
+	}
+	sort.Strings(leases)
+
+	now := r.now()
+	var next time.Time
+	revoked := false
+	for _, lease := range leases {
+		at := pending[lease]
+		if now.Before(at) {
+			next = earliest(next, at)
+			continue
+		}
+
+		log.FromContext(ctx).Info("revoking the replaced Vault lease", "lease", lease, "secret", secret.Name)
+		if err := r.vaultWrite(ctx, config, "sys/leases/revoke", map[string]interface{}{"lease_id": lease}); err != nil {
+			log.FromContext(ctx).Error(err, "failed to revoke the Vault lease", "lease", lease)
+			return time.Time{}, err
+		}
+		delete(pending, lease)
+		revoked = true
+	}
+
+	if revoked {
+		setPendingRevocations(secret, pending)
+		if err := r.writeSecret(ctx, vs, secret, false); err != nil {
+			log.FromContext(ctx).Error(err, "failed to update the pending revocations", "secret", secret.Name)
+			return time.Time{}, err
+		}
+	}
+
+	return next, nil
+}
+
+// overlapLease keeps the lease of the credentials found in the child Secret
+// alive for the OverlapWindow when the rendered Secret replaces them, and
+// schedules its revocation at the end of the window, which is returned
+func (r *VaultSecretReconciler) overlapLease(ctx context.Context, config VaultConfig, vs *appsv1.VaultSecret, found, secret *core.Secret) time.Time {
+	old := found.Annotations[leaseAnnotation]
+	if vs.Spec.OverlapWindow == nil || old == "" || old == secret.Annotations[leaseAnnotation] {
+		return time.Time{}
+	}
+
+	window := vs.Spec.OverlapWindow.Duration
+	err := r.vaultWrite(ctx, config, "sys/leases/renew", map[string]interface{}{
+		"lease_id":  old,
+		"increment": int(window.Seconds()),
+	})
+	if err != nil {
+		// The lease may outlive the window anyway, it's revoked all the same
+		log.FromContext(ctx).Error(err, "failed to renew the replaced Vault lease", "lease", old)
+	}
+
+	at := r.now().Add(window)
+	pending := pendingRevocations(ctx, found)
+	pending[old] = at
+	setPendingRevocations(found, pending)
+
+	return at
+}
+
+// vaultWrite writes the data to the path of the Vault with the token of the
+// config
+func (r *VaultSecretReconciler) vaultWrite(ctx context.Context, vaultConfig VaultConfig, path string, data map[string]interface{}) error {
+	_, err := r.vaultWriteSecret(ctx, vaultConfig, path, data)
+	return err
+}
+
+// vaultWriteSecret writes the data to the path like vaultWrite, and returns
+// the response
+func (r *VaultSecretReconciler) vaultWriteSecret(ctx context.Context, vaultConfig VaultConfig, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	client, err := r.newVaultClient(ctx, vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	token, _, err := r.tokens.getOrLogin(configTokenKey(vaultConfig), r.loginFunc(ctx, client, vaultConfig))
+	if err != nil {
+		return nil, err
+	}
+	logical := r.vaultLogical(client)
+	logical.SetToken(token)
+
+	return logical.Write(ctx, path, data)
+}
+
+// earliest returns the earliest of the times, ignoring the zero ones
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+
+	return a
+}
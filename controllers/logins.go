@@ -0,0 +1,62 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// loginWaitTimeout is how long a read waits for a login slot before its
+	// VaultSecret is requeued
+	loginWaitTimeout = 10 * time.Second
+
+	// loginRetryInterval is the requeue delay of a throttled VaultSecret
+	loginRetryInterval = 5 * time.Second
+)
+
+// errLoginThrottled is returned by reads that didn't get a login slot in time
+var errLoginThrottled = errors.New("too many concurrent Vault logins")
+
+// loginLimiter caps the number of concurrent Vault logins across all the
+// reconciles. A zero limit means no cap.
+type loginLimiter struct {
+	once  sync.Once
+	slots chan struct{}
+}
+
+// acquire takes a login slot, waiting up to the timeout for one, and returns
+// the function releasing it
+func (l *loginLimiter) acquire(limit int, timeout time.Duration) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	l.once.Do(func() {
+		l.slots = make(chan struct{}, limit)
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-timer.C:
+		return nil, errLoginThrottled
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Login limiter", func() {
+	It("gives up on a slot after the timeout", func() {
+		limiter := &loginLimiter{}
+		release, err := limiter.acquire(1, time.Second)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = limiter.acquire(1, 10*time.Millisecond)
+		Expect(err).To(MatchError(errLoginThrottled))
+
+		release()
+		release, err = limiter.acquire(1, 10*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+		release()
+	})
+
+	It("doesn't limit without a cap", func() {
+		limiter := &loginLimiter{}
+		for i := 0; i < 10; i++ {
+			_, err := limiter.acquire(0, time.Millisecond)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+})
@@ -0,0 +1,74 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	core "k8s.io/api/core/v1"
+)
+
+// managedKeysAnnotation on the child Secret lists the data keys written by
+// the operator, comma separated. The other keys belong to someone else and
+// are left alone by the updates.
+const managedKeysAnnotation = "apps.vault.op/managed-keys"
+
+// setManagedKeys records the data keys of the rendered Secret as the ones
+// the operator manages
+func setManagedKeys(secret *core.Secret) {
+	secret.Annotations[managedKeysAnnotation] = strings.Join(sortedKeys(secret.Data), ",")
+}
+
+// managedData returns the part of the data of the child Secret the operator
+// manages. The Secrets written before the keys were tracked are managed as a
+// whole.
+func managedData(secret *core.Secret) map[string][]byte {
+	keys, ok := secret.Annotations[managedKeysAnnotation]
+	if !ok {
+		return secret.Data
+	}
+
+	data := map[string][]byte{}
+	if keys == "" {
+		return data
+	}
+	for _, k := range strings.Split(keys, ",") {
+		if v, ok := secret.Data[k]; ok {
+			data[k] = v
+		}
+	}
+
+	return data
+}
+
+// mergeManagedData returns the data of the child Secret with the managed keys
+// replaced by the rendered data: the keys no longer rendered are removed, the
+// ones of others are kept
+func mergeManagedData(found *core.Secret, data map[string][]byte) map[string][]byte {
+	merged := map[string][]byte{}
+	managed := managedData(found)
+	for k, v := range found.Data {
+		if _, ok := managed[k]; !ok {
+			merged[k] = v
+		}
+	}
+	for k, v := range data {
+		merged[k] = v
+	}
+
+	return merged
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// Label values are taken from bounded sets only: the auth methods we support,
+// "kv" and "kv-v2" for the Vault engines, the registered backend names, and
+// the sync results of syncResults. The per-object lastSyncTimestamp is the
+// exception, its series are deleted along with their VaultSecret.
+var (
+	readsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vault_operator_reads_total",
+		Help: "Number of secret reads by auth method, engine and result.",
+	}, []string{"method", "engine", "result"})
+
+	readDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vault_operator_read_duration_seconds",
+		Help:    "Latency of the secret reads, login included, by auth method and engine.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "engine"})
+
+	loginDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vault_operator_login_duration_seconds",
+		Help:    "Latency of the Vault logins by auth method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	syncsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vault_operator_syncs_total",
+		Help: "Number of VaultSecret syncs by result, the failures by their reason.",
+	}, []string{"result"})
+
+	lastSyncTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vault_operator_last_sync_timestamp_seconds",
+		Help: "Unix time of the last successful sync of each VaultSecret, as its lastSyncTime status.",
+	}, []string{"namespace", "name"})
+)
+
+// syncResults are the result labels of the failed syncs by the reason of
+// their event
+var syncResults = map[string]string{
+	"LoginFailed": "auth_error",
+	"ReadFailed":  "read_error",
+	"SyncFailed":  "error",
+}
+
+func init() {
+	metrics.Registry.MustRegister(readsTotal, readDuration, loginDuration, syncsTotal, lastSyncTimestamp)
+}
+
+// recordLastSync sets the last sync gauge of the VaultSecret from its
+// LastSyncTime status, the failing ones keep the time of their last success
+func recordLastSync(vs *appsv1.VaultSecret) {
+	if vs.Status.LastSyncTime == nil {
+		return
+	}
+	lastSyncTimestamp.WithLabelValues(vs.Namespace, vs.Name).Set(float64(vs.Status.LastSyncTime.Unix()))
+}
+
+// forgetLastSync deletes the last sync gauge of the deleted VaultSecret
+func forgetLastSync(vs types.NamespacedName) {
+	lastSyncTimestamp.DeleteLabelValues(vs.Namespace, vs.Name)
+}
+
+// countSync records the outcome of a sync, err is nil for the successful ones
+func countSync(err error) {
+	result := "success"
+	if err != nil {
+		result = syncResults[errorEventReason(err)]
+	}
+	syncsTotal.WithLabelValues(result).Inc()
+}
+
+// instrumentReader records the reads made through the reader of the backend
+func instrumentReader(reader SecretReader, backend string) SecretReader {
+	return SecretReaderFunc(func(config VaultConfig) (*vaultapi.Secret, error) {
+		start := time.Now()
+		secret, err := reader.ReadSecret(config)
+
+		method := metricsAuthMethod(config.AuthMethod)
+		engine := metricsEngine(backend, secret, err)
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		readsTotal.WithLabelValues(method, engine, result).Inc()
+		readDuration.WithLabelValues(method, engine).Observe(time.Since(start).Seconds())
+
+		return secret, err
+	})
+}
+
+func metricsAuthMethod(method string) string {
+	if _, ok := authenticator(method); ok {
+		return method
+	}
+	return "other"
+}
+
+// metricsEngine returns the secrets engine the data came from. Only the
+// registered backend names are used for custom backends, for Vault the engine
+// is told from the response.
+func metricsEngine(backend string, secret *vaultapi.Secret, err error) string {
+	if backend != "" && backend != defaultBackend {
+		return backend
+	}
+	if err != nil || secret == nil {
+		return "unknown"
+	}
+	if kv, err := parseKV(secret); err == nil {
+		if _, ok := kv.version(); ok {
+			return "kv-v2"
+		}
+	}
+	return "kv"
+}
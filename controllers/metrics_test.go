@@ -0,0 +1,143 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+var _ = Describe("Read metrics", func() {
+	var (
+		ctx   context.Context
+		vault *fakeVault
+		r     *VaultSecretReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		vault = newFakeVault()
+		r = &VaultSecretReconciler{Client: k8sClient, Scheme: scheme.Scheme, Recorder: record.NewFakeRecorder(100)}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	reads := func(engine, result string) float64 {
+		return testutil.ToFloat64(readsTotal.WithLabelValues("kubernetes", engine, result))
+	}
+
+	It("labels the reads with the auth method and the engine", func() {
+		RegisterSecretReader("metrics-fake", SecretReaderFunc(func(config VaultConfig) (*vaultapi.Secret, error) {
+			return &vaultapi.Secret{Data: map[string]interface{}{
+				"data": map[string]interface{}{"token": "from-fake"},
+			}}, nil
+		}))
+		vault.setKV2("secret/data/metrics-v2", map[string]interface{}{"password": "one"})
+		vault.setResponse("kv/metrics-v1", map[string]interface{}{
+			"data": map[string]interface{}{"password": "one"},
+		})
+
+		before := map[string]float64{}
+		for _, engine := range []string{"kv-v2", "kv", "metrics-fake"} {
+			before[engine] = reads(engine, "success")
+		}
+		beforeErrors := reads("unknown", "error")
+
+		kv2 := newVaultSecret("metrics-v2", vault.URL, "secret/data/metrics-v2")
+		kv1 := newVaultSecret("metrics-v1", vault.URL, "kv/metrics-v1")
+		fake := newVaultSecret("metrics-fake", "", "custom/app")
+		fake.Spec.Backend = "metrics-fake"
+		missing := newVaultSecret("metrics-missing", "http://127.0.0.1:1", "secret/data/missing")
+		for _, vs := range []*appsv1.VaultSecret{kv2, kv1, fake, missing} {
+			Expect(k8sClient.Create(ctx, vs)).To(Succeed())
+			r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}})
+		}
+
+		for _, engine := range []string{"kv-v2", "kv", "metrics-fake"} {
+			Expect(reads(engine, "success")).To(Equal(before[engine]+1), engine)
+		}
+		Expect(reads("unknown", "error")).To(BeNumerically(">", beforeErrors))
+		Expect(testutil.CollectAndCount(readDuration)).To(BeNumerically(">=", 4))
+	})
+
+	It("counts the syncs by result", func() {
+		syncs := func(result string) float64 {
+			return testutil.ToFloat64(syncsTotal.WithLabelValues(result))
+		}
+		before := map[string]float64{}
+		for _, result := range []string{"success", "auth_error", "read_error"} {
+			before[result] = syncs(result)
+		}
+		vault.setKV2("secret/data/metrics-sync", map[string]interface{}{"password": "one"})
+
+		vs := newVaultSecret("metrics-sync", vault.URL, "secret/data/metrics-sync")
+		vs.Spec.ReadRetries = 1
+		Expect(k8sClient.Create(ctx, vs)).To(Succeed())
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}}
+		_, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncs("success")).To(Equal(before["success"] + 1))
+
+		vault.failReads = 2
+		r.Reconcile(ctx, request)
+		Expect(syncs("read_error")).To(Equal(before["read_error"] + 1))
+
+		r.tokens.invalidate(configTokenKey(VaultConfig{Addr: vault.URL, AuthPath: "kubernetes", Role: "test"}))
+		vault.validJWT = "other-jwt"
+		r.Reconcile(ctx, request)
+		Expect(syncs("auth_error")).To(Equal(before["auth_error"] + 1))
+		Expect(testutil.CollectAndCount(loginDuration)).To(BeNumerically(">=", 1))
+	})
+
+	It("exposes the time of the last successful sync of each VaultSecret", func() {
+		lastSync := func() float64 {
+			return testutil.ToFloat64(lastSyncTimestamp.WithLabelValues("default", "metrics-last-sync"))
+		}
+		vault.setKV2("secret/data/metrics-last-sync", map[string]interface{}{"password": "one"})
+
+		vs := newVaultSecret("metrics-last-sync", vault.URL, "secret/data/metrics-last-sync")
+		vs.Spec.ReadRetries = 1
+		Expect(k8sClient.Create(ctx, vs)).To(Succeed())
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}}
+		_, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, request.NamespacedName, vs)).To(Succeed())
+		synced := float64(vs.Status.LastSyncTime.Unix())
+		Expect(lastSync()).To(Equal(synced))
+
+		// The failed syncs keep the time of the last successful one
+		vault.failReads = 2
+		r.Reconcile(ctx, request)
+		Expect(lastSync()).To(Equal(synced))
+
+		series := testutil.CollectAndCount(lastSyncTimestamp)
+		forgetLastSync(request.NamespacedName)
+		Expect(testutil.CollectAndCount(lastSyncTimestamp)).To(Equal(series - 1))
+	})
+})
@@ -0,0 +1,47 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// panicError is a panic recovered from the reconcile of a VaultSecret
+type panicError struct {
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("the reconcile panicked: %v", e.value)
+}
+
+// recoverReconcile turns a panic of the reconcile into its error, so that a
+// VaultSecret the operator chokes on fails alone rather than crashing the
+// manager and stalling all the others. It must be deferred by Reconcile.
+func recoverReconcile(ctx context.Context, err *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	log.FromContext(ctx).Error(fmt.Errorf("%v", value), "recovered from a panic of the reconcile", "stack", string(debug.Stack()))
+	*err = &panicError{value: value}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// conditionKeysOverridden lists the keys of the Secret set by more than one
+// of the merged Vault paths
+const conditionKeysOverridden = "KeysOverridden"
+
+// pathTemplateData is the metadata of the VaultSecret its templated Path is
+// executed against
+type pathTemplateData struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// renderPath returns the Path of the VaultSecret executed as a Go template of
+// its metadata, the paths without "{{" being taken as is. A label or an
+// annotation missing from the metadata fails the render, as does a rendered
+// path that is empty or has an empty segment, rather than reading another
+// path than meant.
+func renderPath(vs *appsv1.VaultSecret) (string, error) {
+	if !strings.Contains(vs.Spec.Path, "{{") {
+		return vs.Spec.Path, nil
+	}
+
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(vs.Spec.Path)
+	if err != nil {
+		return "", fmt.Errorf("can't parse the path template %q: %w", vs.Spec.Path, err)
+	}
+	var out strings.Builder
+	data := pathTemplateData{Name: vs.Name, Namespace: vs.Namespace, Labels: vs.Labels, Annotations: vs.Annotations}
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("can't render the path template %q: %w", vs.Spec.Path, err)
+	}
+
+	path := out.String()
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" || strings.Contains(trimmed, "//") || strings.TrimSpace(path) != path {
+		return "", fmt.Errorf("the path template %q renders to the invalid path %q", vs.Spec.Path, path)
+	}
+
+	return path, nil
+}
+
+// prefixKeys returns the data with the prefix prepended to its keys
+func prefixKeys(data map[string][]byte, prefix string) map[string][]byte {
+	prefixed := make(map[string][]byte, len(data))
+	for k, v := range data {
+		prefixed[prefix+k] = v
+	}
+
+	return prefixed
+}
+
+// mergePaths merges the keys of the Paths of the VaultSecret into the data
+// read from its Path, in order, recording their origin in sources. A key set
+// twice takes the value of the later path, unless FailOnKeyCollision is set.
+func (r *VaultSecretReconciler) mergePaths(reader SecretReader, config VaultConfig, vs *appsv1.VaultSecret, data map[string][]byte, sources provenance) error {
+	if len(vs.Spec.Paths) == 0 {
+		meta.RemoveStatusCondition(&vs.Status.Conditions, conditionKeysOverridden)
+		return nil
+	}
+
+	var overridden []string
+	for _, path := range vs.Spec.Paths {
+		c := config
+		c.Path = path.Path
+		c.Version = 0
+		secret, err := reader.ReadSecret(c)
+		if err != nil {
+			return err
+		}
+		kv, err := parseVaultSecret(vs, secret)
+		if err != nil {
+			return fmt.Errorf("can't parse the Vault secret %s: %w", path.Path, err)
+		}
+		values, err := secretData(kv)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range sortedKeys(values) {
+			key := path.KeyPrefix + k
+			if previous, ok := sources[key]; ok {
+				if vs.Spec.FailOnKeyCollision {
+					return fmt.Errorf("the key %s of %s collides with %s", key, path.Path, previous)
+				}
+				overridden = append(overridden, key+" of "+previous+" by "+path.Path)
+			}
+			data[key] = values[k]
+			sources[key] = path.Path + "#" + k
+		}
+	}
+
+	if len(overridden) == 0 {
+		setCondition(vs, conditionKeysOverridden, metav1.ConditionFalse, "NoCollision", "the merged paths set distinct keys")
+		return nil
+	}
+	setCondition(vs, conditionKeysOverridden, metav1.ConditionTrue, "LaterPathWins", "overridden "+strings.Join(overridden, ", "))
+
+	return nil
+}
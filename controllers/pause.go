@@ -0,0 +1,55 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// pausedReason is the reason of the Ready condition of the Paused
+// VaultSecrets
+const pausedReason = "Paused"
+
+// recordPaused records the pause of the VaultSecret in its status, once.
+// Nothing is read nor written while it's paused, nor requeued: unpausing it
+// updates the spec, which triggers a reconcile.
+func (r *VaultSecretReconciler) recordPaused(ctx context.Context, vs *appsv1.VaultSecret) (ctrl.Result, error) {
+	if ready := meta.FindStatusCondition(vs.Status.Conditions, conditionReady); ready != nil &&
+		ready.Reason == pausedReason && ready.ObservedGeneration == vs.Generation {
+		return ctrl.Result{}, nil
+	}
+
+	log.FromContext(ctx).Info("the VaultSecret is paused, the Secret isn't kept in sync")
+	vs.Status.Ready = false
+	vs.Status.NextRefreshTime = nil
+	setCondition(vs, conditionReady, metav1.ConditionFalse, pausedReason, "the reconciles are paused, the Secret isn't kept in sync")
+	if err := r.Status().Update(ctx, vs); err != nil {
+		log.FromContext(ctx).Error(err, "failed to update the status")
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Event(vs, core.EventTypeNormal, pausedReason, "the reconciles are paused by spec.paused")
+
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// reconcilePrefix writes a Secret per child of the PathPrefix of the
+// VaultSecret, each rendered as the child Secret of a VaultSecret of the
+// child path would be, and deletes the Secrets of the children gone from the
+// Vault. The VaultSecret has no child Secret of its own.
+func (r *VaultSecretReconciler) reconcilePrefix(ctx context.Context, reader SecretReader, config VaultConfig, vs *appsv1.VaultSecret) (ctrl.Result, error) {
+	prefix := strings.TrimSuffix(vs.Spec.PathPrefix, "/") + "/"
+	children, err := r.listPrefix(ctx, reader, config, prefix, vs.Spec.Recursive)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "can't list the children of the path prefix", "pathPrefix", prefix)
+		return ctrl.Result{}, err
+	}
+
+	names := map[string]string{}
+	var secrets []*core.Secret
+	keys := 0
+	for _, child := range children {
+		name, err := prefixSecretName(vs, child)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if other, ok := names[name]; ok {
+			return ctrl.Result{}, fmt.Errorf("the children %s and %s of the path prefix both take the Secret name %s", other, child, name)
+		}
+		names[name] = child
+
+		childVS := vs.DeepCopy()
+		childVS.Spec.PathPrefix = ""
+		childVS.Spec.Path = prefix + child
+		childVS.Spec.SecretName = name
+		childConfig := config
+		childConfig.Path = childVS.Spec.Path
+		rendered, result, err := r.renderSecret(ctx, reader, childConfig, childVS, nil)
+		// The conditions of the render are written from the copy
+		vs.ResourceVersion = childVS.ResourceVersion
+		vs.Status = childVS.Status
+		if rendered == nil || err != nil {
+			return result, err
+		}
+		secrets = append(secrets, rendered.secret)
+		keys += rendered.keys
+	}
+
+	if err := r.syncOwnedSecrets(ctx, vs, "prefix", secrets, &vs.Status.PrefixSecrets); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return r.recordSync(ctx, vs, &core.Secret{}, keys, r.refreshResult(vs, false))
+}
+
+// listPrefix returns the paths of the secrets under the prefix relative to
+// it, sorted. The folders, the keys ending with a slash, are listed in turn
+// when recursive and left out otherwise.
+func (r *VaultSecretReconciler) listPrefix(ctx context.Context, reader SecretReader, config VaultConfig, prefix string, recursive bool) ([]string, error) {
+	listConfig := config
+	listConfig.Path = prefix
+	listConfig.List = true
+	listConfig.Unwrap = false
+	listConfig.Version = 0
+	listed, err := reader.ReadSecret(listConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []interface{}
+	if listed != nil {
+		keys, _ = listed.Data["keys"].([]interface{})
+	}
+	var children []string
+	for _, key := range keys {
+		child, ok := key.(string)
+		if !ok || child == "" {
+			continue
+		}
+		if !strings.HasSuffix(child, "/") {
+			children = append(children, child)
+			continue
+		}
+		if !recursive {
+			log.FromContext(ctx).Info("skipping the folder of the path prefix, it isn't listed recursively", "folder", prefix+child)
+			continue
+		}
+		nested, err := r.listPrefix(ctx, reader, config, prefix+child, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nested {
+			children = append(children, child+n)
+		}
+	}
+	sort.Strings(children)
+
+	return children, nil
+}
+
+// prefixSecretName returns the name of the Secret of the child of the
+// PathPrefix, <secretName>-<child> with the child lowercased and its
+// characters other than alphanumerics, dots and dashes replaced by dashes
+func prefixSecretName(vs *appsv1.VaultSecret, child string) (string, error) {
+	name := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c - 'A' + 'a'
+		}
+		return '-'
+	}, child)
+	name = vs.SecretNameOrDefault() + "-" + name
+	if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+		return "", fmt.Errorf("the Secret name %s of the child %s of the path prefix is invalid: %s", name, child, strings.Join(msgs, ", "))
+	}
+
+	return name, nil
+}
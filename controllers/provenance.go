@@ -0,0 +1,104 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// provenanceAnnotationPrefix and provenanceAnnotationSuffix surround the
+	// Secret key in the annotations holding the Vault origin of each key,
+	// e.g. apps.vault.op/key.password.source: secret/data/app#password
+	provenanceAnnotationPrefix = "apps.vault.op/key."
+	provenanceAnnotationSuffix = ".source"
+
+	// templateSource is the origin of the keys rendered by Templates
+	templateSource = "template"
+)
+
+// provenance maps the Secret keys to their origin, "<path>#<vaultkey>" for
+// the keys copied from a Vault secret
+type provenance map[string]string
+
+// keySet returns the keys of the Secret data
+func keySet(data map[string][]byte) map[string]bool {
+	keys := make(map[string]bool, len(data))
+	for k := range data {
+		keys[k] = true
+	}
+
+	return keys
+}
+
+// added records the origin of the keys of data missing from before
+func (p provenance) added(before map[string]bool, data map[string][]byte, source func(key string) string) {
+	for k := range data {
+		if !before[k] {
+			p[k] = source(k)
+		}
+	}
+}
+
+// renamed returns the provenance with the keys renamed
+func (p provenance) renamed(rename func(key string) string) provenance {
+	out := make(provenance, len(p))
+	for k, source := range p {
+		out[rename(k)] = source
+	}
+
+	return out
+}
+
+// annotate sets the provenance annotations of the keys of the Secret data.
+// Keys too long for an annotation name are left out.
+func (p provenance) annotate(ctx context.Context, secret *core.Secret) {
+	for k := range secret.Data {
+		source, ok := p[k]
+		if !ok {
+			continue
+		}
+
+		name := provenanceAnnotationPrefix + k + provenanceAnnotationSuffix
+		if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+			log.FromContext(ctx).Info("leaving out the provenance of the key", "key", k, "secret", secret.Name, "reason", strings.Join(errs, ", "))
+			continue
+		}
+		secret.Annotations[name] = source
+	}
+}
+
+// isProvenanceAnnotation reports whether the annotation holds a key origin
+func isProvenanceAnnotation(name string) bool {
+	return strings.HasPrefix(name, provenanceAnnotationPrefix) && strings.HasSuffix(name, provenanceAnnotationSuffix)
+}
+
+// versionedSource returns the origin of a key added by the version history,
+// "<path>?version=<n>#<vaultkey>"
+func versionedSource(path, key string) string {
+	i := strings.LastIndex(key, ".v")
+	if i < 0 {
+		return path + "#" + key
+	}
+
+	return path + "?version=" + key[i+2:] + "#" + key[:i]
+}
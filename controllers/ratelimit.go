@@ -0,0 +1,63 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// vaultRateLimiter is the token bucket shared by the Vault clients of all
+// the reconciles. A zero QPS means no limit.
+type vaultRateLimiter struct {
+	once    sync.Once
+	limiter *rate.Limiter
+}
+
+// get returns the token bucket, created on first use, or nil without a QPS.
+// The burst defaults to the QPS rounded up.
+func (l *vaultRateLimiter) get(qps float64, burst int) *rate.Limiter {
+	if qps <= 0 {
+		return nil
+	}
+	l.once.Do(func() {
+		if burst <= 0 {
+			burst = int(math.Ceil(qps))
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(qps), burst)
+	})
+
+	return l.limiter
+}
+
+// rateLimitTransport waits for a token of the limiter before each Vault
+// request, or until the request is canceled
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	return t.next.RoundTrip(req)
+}
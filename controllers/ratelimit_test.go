@@ -0,0 +1,77 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Vault rate limiter", func() {
+	var (
+		server *httptest.Server
+		client *http.Client
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		limiter := (&vaultRateLimiter{}).get(20, 1)
+		client = &http.Client{Transport: &rateLimitTransport{next: http.DefaultTransport, limiter: limiter}}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	get := func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	It("spaces the requests over the burst out", func() {
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			Expect(get(context.Background())).To(Succeed())
+		}
+		Expect(time.Since(start)).To(BeNumerically(">=", 90*time.Millisecond))
+	})
+
+	It("gives up a throttled request once canceled", func() {
+		Expect(get(context.Background())).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		Expect(get(ctx)).NotTo(Succeed())
+	})
+
+	It("doesn't limit without a QPS", func() {
+		Expect((&vaultRateLimiter{}).get(0, 10)).To(BeNil())
+	})
+
+	It("defaults the burst to the QPS", func() {
+		Expect((&vaultRateLimiter{}).get(2.5, 0).Burst()).To(Equal(3))
+	})
+})
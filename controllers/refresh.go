@@ -0,0 +1,132 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	defaultRefreshInterval = 5 * time.Minute
+	maxRefreshInterval     = time.Hour
+
+	// adaptiveRefreshThreshold is the number of identical reads in a row
+	// after which the refresh interval of AdaptiveRefresh objects grows
+	adaptiveRefreshThreshold = 3
+)
+
+// readTracker counts consecutive Vault reads returning unchanged data per
+// VaultSecret. It's safe for concurrent use by the reconcile workers.
+type readTracker struct {
+	mu        sync.Mutex
+	unchanged map[types.NamespacedName]int
+}
+
+// observe records the outcome of a read and returns the number of unchanged
+// reads in a row, which is reset by any change.
+func (t *readTracker) observe(key types.NamespacedName, changed bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.unchanged == nil {
+		t.unchanged = map[types.NamespacedName]int{}
+	}
+	if changed {
+		t.unchanged[key] = 0
+	} else {
+		t.unchanged[key]++
+	}
+
+	return t.unchanged[key]
+}
+
+func (t *readTracker) forget(key types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.unchanged, key)
+}
+
+// adaptiveRefreshInterval doubles the base interval for every unchanged read
+// past the threshold, up to maxRefreshInterval. A base interval longer than
+// maxRefreshInterval is never shortened.
+func adaptiveRefreshInterval(base time.Duration, unchanged int) time.Duration {
+	limit := maxRefreshInterval
+	if base > limit {
+		limit = base
+	}
+	interval := base
+	for i := adaptiveRefreshThreshold; i <= unchanged && interval < limit; i++ {
+		interval *= 2
+	}
+	if interval > limit {
+		interval = limit
+	}
+
+	return interval
+}
+
+// refreshInterval returns the RefreshInterval of the VaultSecret, or the
+// default one when unset or zero
+func refreshInterval(vs *appsv1.VaultSecret) time.Duration {
+	if vs.Spec.RefreshInterval == nil || vs.Spec.RefreshInterval.Duration <= 0 {
+		return defaultRefreshInterval
+	}
+
+	return vs.Spec.RefreshInterval.Duration
+}
+
+// specChanged reports whether the spec of the VaultSecret changed since its
+// last sync, its data must be read again from the spec rather than checked
+// for a change. The VaultSecrets synced before their generation was recorded
+// are taken as unchanged.
+func specChanged(vs *appsv1.VaultSecret) bool {
+	return vs.Status.SyncedGeneration != 0 && vs.Status.SyncedGeneration != vs.Generation
+}
+
+// refreshResult returns the reconcile result scheduling the next refresh
+// after a successful read of the Vault data, jittered by RefreshJitter
+func (r *VaultSecretReconciler) refreshResult(vs *appsv1.VaultSecret, changed bool) ctrl.Result {
+	interval := refreshInterval(vs)
+	if !vs.Spec.AdaptiveRefresh {
+		return ctrl.Result{RequeueAfter: r.jitterRefresh(interval)}
+	}
+
+	unchanged := r.reads.observe(types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}, changed)
+	return ctrl.Result{RequeueAfter: r.jitterRefresh(adaptiveRefreshInterval(interval, unchanged))}
+}
+
+// jitterRefresh moves the refresh interval by a random amount within
+// RefreshJitter of it either way, so that the VaultSecrets created together
+// drift apart rather than being read again all at once. A RefreshJitter above
+// one half is taken as one half, the refreshes aren't brought to zero.
+func (r *VaultSecretReconciler) jitterRefresh(interval time.Duration) time.Duration {
+	spread := time.Duration(float64(interval) * r.RefreshJitter)
+	if spread <= 0 {
+		return interval
+	}
+	if spread > interval/2 {
+		spread = interval / 2
+	}
+
+	return interval - spread + r.randomDelay(2*spread)
+}
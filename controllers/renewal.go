@@ -0,0 +1,69 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// runTokenRenewals renews the cached tokens every TokenRenewInterval until
+// the manager stops
+func (r *VaultSecretReconciler) runTokenRenewals(ctx context.Context) error {
+	ticker := time.NewTicker(r.TokenRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			r.renewTokens(ctx)
+		}
+	}
+}
+
+// renewTokens renews the cached renewable tokens expiring within the next
+// two TokenRenewIntervals, so that the reconciles keep finding a valid token.
+// A token failing to renew is replaced by a new login, and dropped when the
+// login fails too, the reconciles log in themselves then.
+func (r *VaultSecretReconciler) renewTokens(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("token-renewal")
+
+	for _, due := range r.tokens.dueForRenewal(time.Now().Add(2 * r.TokenRenewInterval)) {
+		logger := logger.WithValues("vaultAddr", due.config.Addr, "authPath", due.config.AuthPath, "role", due.config.Role)
+		client, err := r.newVaultClient(ctx, due.config)
+		if err != nil {
+			logger.Error(err, "can't create the Vault client of the token renewal")
+			continue
+		}
+
+		renewed, err := r.renewToken(ctx, client, due.token)
+		if err == nil {
+			r.tokens.put(due.key, renewed)
+			continue
+		}
+		logger.Info("can't renew the Vault token, logging in again", "error", err.Error())
+		r.tokens.invalidate(due.key)
+		ctx := log.IntoContext(ctx, logger)
+		if _, _, err := r.tokens.getOrLogin(due.key, r.loginFunc(ctx, client, due.config)); err != nil {
+			logger.Error(err, "can't log in again after the failed token renewal")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response size limit", func() {
+	var (
+		server *httptest.Server
+		body   string
+		client *http.Client
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("length") != "" {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			} else {
+				// flushing first makes the body chunked, without a length
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+			}
+			w.Write([]byte(body))
+		}))
+		client = &http.Client{Transport: &limitTransport{next: http.DefaultTransport, max: 10}}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	read := func(url string) error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+
+	It("rejects a declared length over the limit", func() {
+		body = strings.Repeat("x", 11)
+		err := read(server.URL + "?length=1")
+		Expect(errors.Is(err, ErrResponseTooLarge)).To(BeTrue())
+	})
+
+	It("rejects a streamed body over the limit", func() {
+		body = strings.Repeat("x", 11)
+		err := read(server.URL)
+		Expect(errors.Is(err, ErrResponseTooLarge)).To(BeTrue())
+	})
+
+	It("passes a body at the limit", func() {
+		body = strings.Repeat("x", 10)
+		Expect(read(server.URL)).To(Succeed())
+		Expect(read(server.URL + "?length=1")).To(Succeed())
+	})
+})
@@ -0,0 +1,89 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// rolloutHashAnnotation is the pod template annotation of the RolloutTargets
+// holding the data hash of the Secret their pods were started with. Changing
+// it rolls the pods out.
+const rolloutHashAnnotation = "apps.vault.op/secret-data-hash"
+
+// rollOut annotates the pod templates of the RolloutTargets of the VaultSecret
+// with the data hash. When the data hasn't changed, only the targets rolled
+// out with another hash before are, so that a rollout failing along with the
+// update is retried, while the targets never rolled out aren't restarted.
+// Missing targets are skipped.
+func (r *VaultSecretReconciler) rollOut(ctx context.Context, vs *appsv1.VaultSecret, hash string, changed bool) error {
+	for _, target := range vs.Spec.RolloutTargets {
+		workload, template, err := rolloutWorkload(target)
+		if err != nil {
+			return err
+		}
+		name := types.NamespacedName{Name: target.Name, Namespace: vs.Namespace}
+		if err := r.Get(ctx, name, workload); err != nil {
+			if apierrors.IsNotFound(err) {
+				log.FromContext(ctx).Info("the rollout target doesn't exist, skipping it", "kind", target.Kind, "name", target.Name)
+				continue
+			}
+			return err
+		}
+
+		rolled, ok := template.Annotations[rolloutHashAnnotation]
+		if rolled == hash || (!changed && !ok) {
+			continue
+		}
+		patch := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+		metav1.SetMetaDataAnnotation(&template.ObjectMeta, rolloutHashAnnotation, hash)
+		log.FromContext(ctx).Info("rolling the target out", "kind", target.Kind, "name", target.Name)
+		if err := r.Patch(ctx, workload, patch); err != nil {
+			log.FromContext(ctx).Error(err, "failed to roll the target out", "kind", target.Kind, "name", target.Name)
+			return err
+		}
+		r.Recorder.Event(vs, core.EventTypeNormal, "RolledOut", "the "+target.Kind+" "+target.Name+" was rolled out")
+	}
+
+	return nil
+}
+
+// rolloutWorkload returns an empty workload of the kind of the target, and
+// its pod template
+func rolloutWorkload(target appsv1.RolloutTarget) (client.Object, *core.PodTemplateSpec, error) {
+	switch target.Kind {
+	case "Deployment":
+		deployment := &apps.Deployment{}
+		return deployment, &deployment.Spec.Template, nil
+	case "StatefulSet":
+		statefulSet := &apps.StatefulSet{}
+		return statefulSet, &statefulSet.Spec.Template, nil
+	}
+
+	return nil, nil, errors.New("unsupported rollout target kind: " + target.Kind)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	// versionAnnotation on the child Secret holds the KV v2 version of the
+	// Vault secret it was last synced from
+	versionAnnotation = "apps.vault.op/vault-version"
+
+	// createdTimeAnnotation on the child Secret holds the created_time of
+	// that KV v2 version
+	createdTimeAnnotation = "apps.vault.op/vault-created-time"
+
+	// rotateAfterMetadata is the KV v2 custom metadata field holding the time
+	// by which the secret is expected to be rotated
+	rotateAfterMetadata = "rotate_after"
+
+	// conditionRotationOverdue is set when the rotate_after time of the Vault
+	// secret has passed
+	conditionRotationOverdue = "RotationOverdue"
+)
+
+// confirmRotation holds back a Vault secret whose version is newer than the
+// one the child Secret was last synced from for the PostRotationDelay of the
+// VaultSecret, and returns how long the VaultSecret waits still. Right after
+// a rotation a standby may still serve the previous version, the read of the
+// reconcile requeued past the delay is the one written to the Secret. The
+// pending version is kept in the status rather than waited for, so that the
+// reconcile doesn't hold a worker.
+func (r *VaultSecretReconciler) confirmRotation(ctx context.Context, es *appsv1.VaultSecret, found *core.Secret, secData *vaultapi.Secret) (time.Duration, error) {
+	// The version read after a spec change isn't a rotation of the synced
+	// data
+	if es.Spec.PostRotationDelay == nil || es.Spec.PostRotationDelay.Duration <= 0 || specChanged(es) {
+		return 0, nil
+	}
+
+	kv, err := parseVaultSecret(es, secData)
+	if err != nil {
+		return 0, err
+	}
+	version, ok := kv.version()
+	if !ok {
+		return 0, nil
+	}
+	synced, err := strconv.Atoi(found.Annotations[versionAnnotation])
+	if err != nil || version <= synced {
+		return 0, nil
+	}
+
+	now := r.now()
+	if es.Status.PendingRotationVersion > synced && es.Status.RotationConfirmTime != nil {
+		return es.Status.RotationConfirmTime.Sub(now), nil
+	}
+
+	// The status times are stored to the second, the confirmation is
+	// rounded up so that it doesn't come early
+	delay := es.Spec.PostRotationDelay.Duration
+	confirm := now.Add(delay + time.Second - 1).Truncate(time.Second)
+	log.FromContext(ctx).Info("the Vault secret was rotated, confirming it after the delay", "version", version, "delay", delay.String())
+	es.Status.PendingRotationVersion = version
+	es.Status.RotationConfirmTime = &metav1.Time{Time: confirm}
+	if err := r.Status().Update(ctx, es); err != nil {
+		log.FromContext(ctx).Error(err, "failed to record the pending rotation")
+		return 0, err
+	}
+
+	return confirm.Sub(now), nil
+}
+
+// checkRotationDue reports a passed rotate_after time in the custom metadata
+// of the Vault secret in the RotationOverdue condition, with an event when it
+// becomes overdue. The data is synced regardless.
+func (r *VaultSecretReconciler) checkRotationDue(ctx context.Context, es *appsv1.VaultSecret, secData *vaultapi.Secret) error {
+	kv, err := parseVaultSecret(es, secData)
+	if err != nil {
+		return err
+	}
+
+	var rotateAfter time.Time
+	if kv.Metadata != nil && kv.Metadata.CustomMetadata[rotateAfterMetadata] != "" {
+		value := kv.Metadata.CustomMetadata[rotateAfterMetadata]
+		if rotateAfter, err = time.Parse(time.RFC3339, value); err != nil {
+			log.FromContext(ctx).Info("ignoring the invalid "+rotateAfterMetadata+" metadata", "value", value)
+		}
+	}
+
+	if !rotateAfter.IsZero() && r.now().After(rotateAfter) {
+		if meta.IsStatusConditionTrue(es.Status.Conditions, conditionRotationOverdue) {
+			return nil
+		}
+		msg := "the Vault secret was expected to be rotated by " + rotateAfter.Format(time.RFC3339)
+		r.Recorder.Event(es, core.EventTypeWarning, conditionRotationOverdue, msg)
+		return r.setStatusCondition(ctx, es, metav1.Condition{
+			Type:    conditionRotationOverdue,
+			Status:  metav1.ConditionTrue,
+			Reason:  "RotateAfterPassed",
+			Message: msg,
+		})
+	}
+
+	if meta.IsStatusConditionTrue(es.Status.Conditions, conditionRotationOverdue) {
+		return r.setStatusCondition(ctx, es, metav1.Condition{
+			Type:    conditionRotationOverdue,
+			Status:  metav1.ConditionFalse,
+			Reason:  "Rotated",
+			Message: "the Vault secret isn't due for rotation",
+		})
+	}
+
+	return nil
+}
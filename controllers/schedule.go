@@ -0,0 +1,90 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/robfig/cron/v3"
+	core "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// rotatedAtAnnotation on the child Secret holds the time it was last written
+// by a VaultSecret with a ForceRotateSchedule
+const rotatedAtAnnotation = "apps.vault.op/rotated-at"
+
+func (r *VaultSecretReconciler) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+// rotationDue reports whether the ForceRotateSchedule of the VaultSecret has
+// ticked since the child Secret was last written, and returns the next tick
+func (r *VaultSecretReconciler) rotationDue(es *appsv1.VaultSecret, secret *core.Secret) (bool, time.Time, error) {
+	if es.Spec.ForceRotateSchedule == "" {
+		return false, time.Time{}, nil
+	}
+
+	schedule, err := cron.ParseStandard(es.Spec.ForceRotateSchedule)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	last := secret.CreationTimestamp.Time
+	if t, err := time.Parse(time.RFC3339, secret.Annotations[rotatedAtAnnotation]); err == nil {
+		last = t
+	}
+
+	now := r.now()
+	if next := schedule.Next(last); now.Before(next) {
+		return false, next, nil
+	}
+
+	return true, schedule.Next(now), nil
+}
+
+// markRotated records the write time on a child Secret of a VaultSecret with
+// a ForceRotateSchedule
+func (r *VaultSecretReconciler) markRotated(es *appsv1.VaultSecret, secret *core.Secret) {
+	if es.Spec.ForceRotateSchedule == "" {
+		return
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[rotatedAtAnnotation] = r.now().UTC().Format(time.RFC3339)
+}
+
+// scheduleResult requeues the VaultSecret for the next ForceRotateSchedule
+// tick unless the result already requeues it sooner
+func (r *VaultSecretReconciler) scheduleResult(result ctrl.Result, next time.Time) ctrl.Result {
+	if next.IsZero() {
+		return result
+	}
+
+	after := next.Sub(r.now())
+	if result.RequeueAfter == 0 || after < result.RequeueAfter {
+		result.RequeueAfter = after
+	}
+
+	return result
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+const defaultBackend = "vault"
+
+// SecretReader fetches the secret data for a VaultSecret. Custom backends
+// speaking a Vault-like API implement it and return their data in the Vault
+// response format so it can be consumed by SecretMake.
+type SecretReader interface {
+	ReadSecret(config VaultConfig) (*vaultapi.Secret, error)
+}
+
+// SecretReaderFunc adapts a function to the SecretReader interface
+type SecretReaderFunc func(config VaultConfig) (*vaultapi.Secret, error)
+
+// ReadSecret calls f(config)
+func (f SecretReaderFunc) ReadSecret(config VaultConfig) (*vaultapi.Secret, error) {
+	return f(config)
+}
+
+var (
+	secretReadersMu sync.RWMutex
+	secretReaders   = map[string]SecretReader{}
+)
+
+// RegisterSecretReader makes a backend available to VaultSecrets under the
+// given name. It's meant to be called from init() by compiled in backends.
+func RegisterSecretReader(name string, reader SecretReader) {
+	secretReadersMu.Lock()
+	defer secretReadersMu.Unlock()
+	secretReaders[name] = reader
+}
+
+// secretReader returns the reader for the backend, Vault being the default.
+// The Vault reads are cancelled along with ctx.
+func (r *VaultSecretReconciler) secretReader(ctx context.Context, backend string) (SecretReader, error) {
+	if backend == "" || backend == defaultBackend {
+		return SecretReaderFunc(func(config VaultConfig) (*vaultapi.Secret, error) {
+			return r.VaultReadSecret(ctx, config)
+		}), nil
+	}
+
+	secretReadersMu.RLock()
+	defer secretReadersMu.RUnlock()
+	reader, ok := secretReaders[backend]
+	if !ok {
+		return nil, errors.New("unsupported secret backend: " + backend)
+	}
+
+	return reader, nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var _ = Describe("SecretReader backends", func() {
+	var (
+		ctx context.Context
+		r   *VaultSecretReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		r = &VaultSecretReconciler{Client: k8sClient, Scheme: scheme.Scheme, Recorder: record.NewFakeRecorder(100)}
+	})
+
+	It("reads the data through the registered backend", func() {
+		var requested VaultConfig
+		RegisterSecretReader("fake", SecretReaderFunc(func(config VaultConfig) (*vaultapi.Secret, error) {
+			requested = config
+			return &vaultapi.Secret{Data: map[string]interface{}{
+				"data": map[string]interface{}{"token": "from-fake"},
+			}}, nil
+		}))
+
+		vs := newVaultSecret("fake-backend", "", "custom/app")
+		vs.Spec.Backend = "fake"
+		Expect(k8sClient.Create(ctx, vs)).To(Succeed())
+
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requested.Path).To(Equal("custom/app"))
+
+		secret := &core.Secret{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}, secret)).To(Succeed())
+		Expect(secret.Data).To(HaveKeyWithValue("token", []byte("from-fake")))
+	})
+
+	It("rejects an unknown backend", func() {
+		_, err := r.secretReader(ctx, "missing")
+		Expect(err).To(HaveOccurred())
+	})
+})
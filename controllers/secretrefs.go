@@ -0,0 +1,66 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// referencedSecret returns the Secret of the name referenced by a VaultSecret,
+// described by what in the errors. The referenced Secrets are always read in
+// the namespace of the VaultSecret, a namespace/name reference is rejected
+// rather than looked up as a name.
+func (r *VaultSecretReconciler) referencedSecret(ctx context.Context, namespace, what, name string) (*core.Secret, error) {
+	if strings.Contains(name, "/") {
+		return nil, fmt.Errorf("the %s %s can't be in another namespace, the referenced Secrets are read in the %s namespace of the VaultSecret", what, name, namespace)
+	}
+
+	key := types.NamespacedName{Name: name, Namespace: namespace}
+	secret := &core.Secret{}
+	if err := r.Get(ctx, key, secret); err != nil {
+		return nil, fmt.Errorf("can't get the %s %s: %w", what, key, err)
+	}
+
+	return secret, nil
+}
+
+// secretKeyValue returns the value of the key of the Secret selected in the
+// namespace of the VaultSecret. A missing key is an error unless the
+// selector is optional, as is a missing Secret.
+func (r *VaultSecretReconciler) secretKeyValue(ctx context.Context, namespace, what string, selector core.SecretKeySelector) ([]byte, error) {
+	optional := selector.Optional != nil && *selector.Optional
+	secret, err := r.referencedSecret(ctx, namespace, what, selector.Name)
+	if err != nil {
+		if optional && apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	value, ok := secret.Data[selector.Key]
+	if !ok && !optional {
+		return nil, fmt.Errorf("the %s %s has no %s key", what, types.NamespacedName{Name: selector.Name, Namespace: namespace}, selector.Key)
+	}
+
+	return value, nil
+}
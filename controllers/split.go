@@ -0,0 +1,140 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// splitSecrets returns the Secrets of the Split of the VaultSecret, each
+// holding its keys of the rendered Secret
+func (r *VaultSecretReconciler) splitSecrets(vs *appsv1.VaultSecret, secret *core.Secret) ([]*core.Secret, error) {
+	var splits []*core.Secret
+	for _, s := range vs.Spec.Split {
+		split := &core.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        s.Name,
+				Namespace:   secret.Namespace,
+				Annotations: map[string]string{dataHashAnnotation: secret.Annotations[dataHashAnnotation]},
+			},
+			Data: map[string][]byte{},
+		}
+		for _, key := range s.Keys {
+			value, ok := secret.Data[key]
+			if !ok {
+				return nil, fmt.Errorf("the key %s of the split Secret %s isn't in the Secret", key, s.Name)
+			}
+			split.Data[key] = value
+		}
+		if err := ctrl.SetControllerReference(vs, split, r.Scheme); err != nil {
+			return nil, err
+		}
+		splits = append(splits, split)
+	}
+
+	return splits, nil
+}
+
+// syncSplits creates or updates the split Secrets and deletes the ones no
+// longer in the Split of the VaultSecret. The SplitSecrets status follows
+// them.
+func (r *VaultSecretReconciler) syncSplits(ctx context.Context, vs *appsv1.VaultSecret, splits []*core.Secret) error {
+	return r.syncOwnedSecrets(ctx, vs, "split", splits, &vs.Status.SplitSecrets)
+}
+
+// syncOwnedSecrets creates or updates the Secrets of the VaultSecret other
+// than its child Secret, and deletes the ones of the names it wrote last that
+// it no longer writes. The names follow the written Secrets, sorted.
+func (r *VaultSecretReconciler) syncOwnedSecrets(ctx context.Context, vs *appsv1.VaultSecret, kind string, secrets []*core.Secret, names *[]string) error {
+	written := map[string]bool{}
+	for _, secret := range secrets {
+		if err := r.applyOwnedSecret(ctx, vs, kind, secret); err != nil {
+			log.FromContext(ctx).Error(err, "failed to write the "+kind+" Secret", "secret", secret.Name)
+			return err
+		}
+		written[secret.Name] = true
+	}
+
+	for _, name := range *names {
+		if written[name] {
+			continue
+		}
+		found := &core.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: vs.Namespace}, found)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !metav1.IsControlledBy(found, vs) {
+			continue
+		}
+		log.FromContext(ctx).Info("deleting the stale "+kind+" Secret", "secret", name)
+		if err := r.Delete(ctx, found); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	*names = nil
+	for name := range written {
+		*names = append(*names, name)
+	}
+	sort.Strings(*names)
+
+	return nil
+}
+
+// applyOwnedSecret creates or updates the Secret, refusing to overwrite a
+// Secret the VaultSecret doesn't control
+func (r *VaultSecretReconciler) applyOwnedSecret(ctx context.Context, vs *appsv1.VaultSecret, kind string, secret *core.Secret) error {
+	found := &core.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, found)
+	if apierrors.IsNotFound(err) {
+		log.FromContext(ctx).Info("deploying a new "+kind+" Secret", "secret", secret.Name)
+		return r.Create(ctx, secret)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !metav1.IsControlledBy(found, vs) {
+		return errors.New("Secret " + found.Name + " already exists and is not managed by this VaultSecret")
+	}
+	if equality.Semantic.DeepEqual(found.Data, secret.Data) &&
+		found.Annotations[dataHashAnnotation] == secret.Annotations[dataHashAnnotation] {
+		return nil
+	}
+
+	metav1.SetMetaDataAnnotation(&found.ObjectMeta, dataHashAnnotation, secret.Annotations[dataHashAnnotation])
+	found.Data = secret.Data
+	log.FromContext(ctx).Info("updating the "+kind+" Secret", "secret", found.Name)
+	return r.Update(ctx, found)
+}
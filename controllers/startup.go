@@ -0,0 +1,87 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// startupTracker tells apart the VaultSecrets seen for the first time within
+// the startup window. The window starts with the first reconcile, once the
+// cache of the manager is synced. It's safe for concurrent use.
+type startupTracker struct {
+	mu      sync.Mutex
+	started time.Time
+	seen    map[types.NamespacedName]bool
+}
+
+// firstSight reports whether the VaultSecret is seen for the first time,
+// within the window from the start
+func (t *startupTracker) firstSight(vs types.NamespacedName, now time.Time, window time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.started.IsZero() {
+		t.started = now
+		t.seen = map[types.NamespacedName]bool{}
+	}
+	if t.seen == nil || now.Sub(t.started) >= window {
+		t.seen = nil
+		return false
+	}
+	if t.seen[vs] {
+		return false
+	}
+	t.seen[vs] = true
+
+	return true
+}
+
+// delayStartup requeues the VaultSecrets seen first within the StartupJitter
+// window after a random delay within it, so that a restart of the operator
+// spreads their Vault logins and reads instead of sending them all at once.
+// The deletions aren't delayed.
+func (r *VaultSecretReconciler) delayStartup(ctx context.Context, vs *appsv1.VaultSecret) (ctrl.Result, bool) {
+	if r.StartupJitter <= 0 || !vs.DeletionTimestamp.IsZero() ||
+		!r.startup.firstSight(types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}, r.now(), r.StartupJitter) {
+		return ctrl.Result{}, false
+	}
+
+	delay := r.randomDelay(r.StartupJitter)
+	log.FromContext(ctx).V(1).Info("delaying the first reconcile since the startup", "after", delay.String())
+
+	return ctrl.Result{RequeueAfter: delay}, true
+}
+
+// randomDelay returns a random delay below d, from the jitter of the tests
+// when set
+func (r *VaultSecretReconciler) randomDelay(d time.Duration) time.Duration {
+	if r.jitter != nil {
+		return r.jitter(d)
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
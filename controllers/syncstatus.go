@@ -0,0 +1,257 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	// conditionReady is true when the last reconcile synced the Vault data
+	conditionReady = "Ready"
+
+	// conditionVaultReachable is false while the Vault can't be reached or
+	// fails with server side errors
+	conditionVaultReachable = "VaultReachable"
+
+	// conditionAuthSucceeded is false when the last Vault login failed
+	conditionAuthSucceeded = "AuthSucceeded"
+
+	// repeatedErrorThreshold is the number of identical errors in a row past
+	// which a VaultSecret is backed off
+	repeatedErrorThreshold = 3
+
+	// repeatedErrorInterval and maxRepeatedErrorInterval bound the backoff
+	repeatedErrorInterval    = 30 * time.Second
+	maxRepeatedErrorInterval = time.Hour
+
+	// vaultFailureInterval and maxVaultFailureInterval bound the backoff of
+	// the Vault failures
+	vaultFailureInterval    = 5 * time.Second
+	maxVaultFailureInterval = 10 * time.Minute
+)
+
+// recordSync records a successful sync of the rendered Secret in the
+// VaultSecret status, along with the next refresh the result schedules, and
+// clears the last error
+func (r *VaultSecretReconciler) recordSync(ctx context.Context, vs *appsv1.VaultSecret, secret *core.Secret, keys int, result ctrl.Result) (ctrl.Result, error) {
+	now := r.now()
+	vs.Status.Ready = true
+	vs.Status.LastSyncTime = &metav1.Time{Time: now}
+	vs.Status.ForceSyncedValue = vs.Annotations[forceSyncAnnotation]
+	vs.Status.SyncedGeneration = vs.Generation
+	vs.Status.SyncedVaultVersion, _ = strconv.Atoi(secret.Annotations[versionAnnotation])
+	vs.Status.PendingRotationVersion = 0
+	vs.Status.RotationConfirmTime = nil
+	vs.Status.SourceCreatedTime = nil
+	if created, err := time.Parse(time.RFC3339Nano, secret.Annotations[createdTimeAnnotation]); err == nil {
+		vs.Status.SourceCreatedTime = &metav1.Time{Time: created}
+	}
+	vs.Status.NextRefreshTime = nil
+	if result.RequeueAfter > 0 {
+		vs.Status.NextRefreshTime = &metav1.Time{Time: now.Add(result.RequeueAfter)}
+	}
+	vs.Status.DataKeys = keys
+	countSync(nil)
+	recordLastSync(vs)
+	vs.Status.LastError = ""
+	vs.Status.ErrorCount = 0
+	vs.Status.VaultFailures = 0
+	setCondition(vs, conditionReady, metav1.ConditionTrue, "Synced", "the Secret is in sync with the Vault")
+	setCondition(vs, conditionVaultReachable, metav1.ConditionTrue, "Reachable", "the Vault served the secret")
+	setCondition(vs, conditionAuthSucceeded, metav1.ConditionTrue, "LoggedIn", "the Vault login succeeded")
+
+	if err := r.Status().Update(ctx, vs); err != nil {
+		log.FromContext(ctx).Error(err, "failed to update the status")
+		return ctrl.Result{}, err
+	}
+	if err := r.clearBypassCache(ctx, vs); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// recordError records the error of a failed reconcile in the VaultSecret
+// status along with the number of times in a row it happened. Once the same
+// error repeats repeatedErrorThreshold times the VaultSecret is requeued on a
+// lengthening backoff instead, and the error is only logged when it changes.
+// The failed Vault logins and reads are requeued on a jittered backoff from
+// the first one, so that the VaultSecrets don't all retry at once when the
+// Vault recovers.
+func (r *VaultSecretReconciler) recordError(ctx context.Context, vs *appsv1.VaultSecret, err error) (ctrl.Result, error) {
+	if vs.Status.LastError == err.Error() {
+		vs.Status.ErrorCount++
+	} else {
+		vs.Status.LastError = err.Error()
+		vs.Status.ErrorCount = 1
+	}
+	vs.Status.Ready = false
+	reason := errorEventReason(err)
+	vaultFailure := reason == "LoginFailed" || reason == "ReadFailed"
+	if vaultFailure {
+		vs.Status.VaultFailures++
+	} else {
+		vs.Status.VaultFailures = 0
+	}
+	setErrorConditions(vs, err)
+	r.Recorder.Event(vs, core.EventTypeWarning, reason, err.Error())
+	countSync(err)
+	recordLastSync(vs)
+
+	if err := r.Status().Update(ctx, vs); err != nil {
+		log.FromContext(ctx).Error(err, "failed to record the last error")
+	}
+
+	if vaultFailure {
+		delay := r.vaultFailureBackoff(vs.Status.VaultFailures)
+		log.FromContext(ctx).Info("retrying after the Vault failure", "after", delay.String(), "failures", vs.Status.VaultFailures)
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	if vs.Status.ErrorCount < repeatedErrorThreshold {
+		return ctrl.Result{}, err
+	}
+	if vs.Status.ErrorCount == repeatedErrorThreshold {
+		log.FromContext(ctx).Info("backing off, failing with the same error", "error", err.Error())
+	}
+
+	return ctrl.Result{RequeueAfter: repeatedErrorBackoff(vs.Status.ErrorCount)}, nil
+}
+
+// setErrorConditions sets the conditions of the failed reconcile. The Vault
+// conditions are only changed when the error tells about them.
+func setErrorConditions(vs *appsv1.VaultSecret, err error) {
+	reason := "SyncFailed"
+	var deletedErr *deletedSecretError
+	var emptyErr *emptySecretError
+	var timeoutErr *reconcileTimeoutError
+	switch {
+	case errors.As(err, &deletedErr):
+		reason = "VaultSecretDeleted"
+	case errors.As(err, &emptyErr):
+		reason = "VaultSecretEmpty"
+	case errors.As(err, &timeoutErr):
+		reason = "ReconcileTimedOut"
+	}
+	setCondition(vs, conditionReady, metav1.ConditionFalse, reason, err.Error())
+
+	var loginErr *loginError
+	isLogin := errors.As(err, &loginErr)
+	if isLogin {
+		setCondition(vs, conditionAuthSucceeded, metav1.ConditionFalse, "LoginFailed", err.Error())
+	}
+
+	var respErr *vaultapi.ResponseError
+	switch {
+	case isVaultUnreachable(err):
+		setCondition(vs, conditionVaultReachable, metav1.ConditionFalse, "VaultUnreachable", err.Error())
+	case isLogin || errors.As(err, &respErr):
+		setCondition(vs, conditionVaultReachable, metav1.ConditionTrue, "Reachable", "the Vault answered the request")
+	}
+}
+
+// errorEventReason returns the reason of the Warning event of the error
+func errorEventReason(err error) string {
+	var loginErr *loginError
+	var respErr *vaultapi.ResponseError
+	var deletedErr *deletedSecretError
+	var emptyErr *emptySecretError
+	var panicErr *panicError
+	var timeoutErr *reconcileTimeoutError
+	switch {
+	case errors.As(err, &deletedErr):
+		return "VaultSecretDeleted"
+	case errors.As(err, &emptyErr):
+		return "VaultSecretEmpty"
+	case errors.As(err, &panicErr):
+		return "ReconcilePanicked"
+	case errors.As(err, &timeoutErr):
+		return "ReconcileTimedOut"
+	case errors.As(err, &loginErr):
+		return "LoginFailed"
+	case isVaultUnreachable(err) || errors.As(err, &respErr):
+		return "ReadFailed"
+	}
+
+	return "SyncFailed"
+}
+
+// setCondition sets the condition in the status of the VaultSecret, written
+// along with the rest of the status
+func setCondition(vs *appsv1.VaultSecret, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&vs.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: vs.Generation,
+	})
+}
+
+// isVaultUnreachable reports whether the error is a network error or a
+// server side error of the Vault
+func isVaultUnreachable(err error) bool {
+	var respErr *vaultapi.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= http.StatusInternalServerError
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// repeatedErrorBackoff returns the requeue delay after count identical errors,
+// doubling from repeatedErrorInterval up to maxRepeatedErrorInterval
+func repeatedErrorBackoff(count int) time.Duration {
+	backoff := repeatedErrorInterval
+	for i := repeatedErrorThreshold; i < count && backoff < maxRepeatedErrorInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRepeatedErrorInterval {
+		backoff = maxRepeatedErrorInterval
+	}
+
+	return backoff
+}
+
+// vaultFailureBackoff returns the requeue delay after count Vault failures in
+// a row. It doubles from vaultFailureInterval up to maxVaultFailureInterval,
+// and half of it is random.
+func (r *VaultSecretReconciler) vaultFailureBackoff(count int) time.Duration {
+	backoff := vaultFailureInterval
+	for i := 1; i < count && backoff < maxVaultFailureInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > maxVaultFailureInterval {
+		backoff = maxVaultFailureInterval
+	}
+
+	return backoff/2 + r.randomDelay(backoff/2)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// defaultTargetFieldPath is the field of the TargetRef object holding the data
+const defaultTargetFieldPath = "spec.data"
+
+// targetKindAllowed reports whether the kind is in the allowlist, given as
+// "Kind.group" entries, or "Kind" for the core group
+func (r *VaultSecretReconciler) targetKindAllowed(gvk schema.GroupVersionKind) bool {
+	name := gvk.Kind
+	if gvk.Group != "" {
+		name += "." + gvk.Group
+	}
+	for _, allowed := range r.AllowedTargetKinds {
+		if allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reconcileTarget materializes the Vault data of a VaultSecret with a
+// TargetRef into the owned object of the target kind
+func (r *VaultSecretReconciler) reconcileTarget(ctx context.Context, reader SecretReader, config VaultConfig, vs *appsv1.VaultSecret) (ctrl.Result, error) {
+	ref := vs.Spec.TargetRef
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	gvk := gv.WithKind(ref.Kind)
+	if !r.targetKindAllowed(gvk) {
+		return ctrl.Result{}, fmt.Errorf("the target kind %s is not allowed", gvk)
+	}
+
+	secData, err := reader.ReadSecret(config)
+	if errors.Is(err, errLoginThrottled) {
+		log.FromContext(ctx).Info("Vault logins are throttled, requeueing", "after", loginRetryInterval.String())
+		return ctrl.Result{RequeueAfter: loginRetryInterval}, nil
+	}
+	if err != nil {
+		log.FromContext(ctx).Error(err, "can't read the data from the Vault")
+		return ctrl.Result{}, err
+	}
+
+	secret, err := r.makeSecret(ctx, reader, config, vs, secData)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "failed to generate the target data")
+		return ctrl.Result{}, err
+	}
+	data := map[string]interface{}{}
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+
+	fieldPath := ref.FieldPath
+	if fieldPath == "" {
+		fieldPath = defaultTargetFieldPath
+	}
+	fields := strings.Split(fieldPath, ".")
+
+	target := &unstructured.Unstructured{}
+	target.SetGroupVersionKind(gvk)
+	err = r.Get(ctx, types.NamespacedName{Name: vs.SecretNameOrDefault(), Namespace: vs.Namespace}, target)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	if apierrors.IsNotFound(err) {
+		target.SetName(vs.SecretNameOrDefault())
+		target.SetNamespace(vs.Namespace)
+		if err := unstructured.SetNestedField(target.Object, data, fields...); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := ctrl.SetControllerReference(vs, target, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		log.FromContext(ctx).Info("deploying a new target", "kind", gvk.Kind)
+		if err := r.Create(ctx, target); err != nil {
+			log.FromContext(ctx).Error(err, "failed to deploy the target", "kind", gvk.Kind)
+			return ctrl.Result{}, err
+		}
+
+		return r.recordSync(ctx, vs, secret, len(data), r.refreshResult(vs, true))
+	}
+
+	// Refuse to overwrite an object the VaultSecret doesn't control, as for
+	// the Secrets
+	if !metav1.IsControlledBy(target, vs) {
+		msg := gvk.Kind + " " + target.GetName() + " already exists and is not controlled by this VaultSecret"
+		log.FromContext(ctx).Info("refusing to update the target", "kind", gvk.Kind, "reason", msg)
+		return ctrl.Result{}, r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionNameCollision,
+			Status:  metav1.ConditionTrue,
+			Reason:  "TargetNotOwned",
+			Message: msg,
+		})
+	}
+	if meta.IsStatusConditionTrue(vs.Status.Conditions, conditionNameCollision) {
+		err := r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionNameCollision,
+			Status:  metav1.ConditionFalse,
+			Reason:  "TargetOwned",
+			Message: gvk.Kind + " " + target.GetName() + " is managed by this VaultSecret",
+		})
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	current, _, _ := unstructured.NestedFieldNoCopy(target.Object, fields...)
+	if equality.Semantic.DeepEqual(current, data) {
+		return r.recordSync(ctx, vs, secret, len(data), r.refreshResult(vs, false))
+	}
+
+	if err := unstructured.SetNestedField(target.Object, data, fields...); err != nil {
+		return ctrl.Result{}, err
+	}
+	log.FromContext(ctx).Info("updating the target", "kind", gvk.Kind)
+	if err := r.Update(ctx, target); err != nil {
+		log.FromContext(ctx).Error(err, "failed to update the target", "kind", gvk.Kind)
+		return ctrl.Result{}, err
+	}
+
+	return r.recordSync(ctx, vs, secret, len(data), r.refreshResult(vs, true))
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// templateDeps records which Secrets the Templates of each VaultSecret read
+// through the secrets function, so that their changes are propagated. Keys
+// and values are in the same namespace, both are named after VaultSecrets
+// since child Secrets share their name. It's safe for concurrent use.
+type templateDeps struct {
+	mu   sync.Mutex
+	uses map[types.NamespacedName]map[types.NamespacedName]bool
+
+	// secrets are the child Secrets of the VaultSecrets not named after
+	// their VaultSecret
+	secrets map[types.NamespacedName]types.NamespacedName
+}
+
+// set replaces the dependencies of the VaultSecret
+func (d *templateDeps) set(vs types.NamespacedName, secrets map[types.NamespacedName]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.uses == nil {
+		d.uses = map[types.NamespacedName]map[types.NamespacedName]bool{}
+	}
+	if len(secrets) == 0 {
+		delete(d.uses, vs)
+		return
+	}
+	d.uses[vs] = secrets
+}
+
+// name records the child Secret of the VaultSecret, for the reaches through
+// it
+func (d *templateDeps) name(vs, secret types.NamespacedName) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if secret == vs {
+		delete(d.secrets, vs)
+		return
+	}
+	if d.secrets == nil {
+		d.secrets = map[types.NamespacedName]types.NamespacedName{}
+	}
+	d.secrets[vs] = secret
+}
+
+// forget drops the uses and the child Secret of the deleted VaultSecret
+func (d *templateDeps) forget(vs types.NamespacedName) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.uses, vs)
+	delete(d.secrets, vs)
+}
+
+// owner returns the VaultSecret of the child Secret, the one it's named
+// after unless it's recorded with another name
+func (d *templateDeps) owner(secret types.NamespacedName) types.NamespacedName {
+	for vs, named := range d.secrets {
+		if named == secret {
+			return vs
+		}
+	}
+
+	return secret
+}
+
+// dependents returns the VaultSecrets whose templates read the Secret
+func (d *templateDeps) dependents(secret types.NamespacedName) []types.NamespacedName {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var dependents []types.NamespacedName
+	for vs, secrets := range d.uses {
+		if secrets[secret] {
+			dependents = append(dependents, vs)
+		}
+	}
+
+	return dependents
+}
+
+// reaches reports whether the VaultSecret of the Secret from depends on the
+// VaultSecret to, directly or not
+func (d *templateDeps) reaches(from, to types.NamespacedName) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := map[types.NamespacedName]bool{}
+	stack := []types.NamespacedName{from}
+	for len(stack) > 0 {
+		current := d.owner(stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+		if current == to {
+			return true
+		}
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+		for next := range d.uses[current] {
+			stack = append(stack, next)
+		}
+	}
+
+	return false
+}
+
+// renderTemplates adds the Templates of the VaultSecret to the Secret data.
+// The templates see the Secret data as their dot, and can read keys of the
+// other Secrets managed by VaultSecrets of the namespace with
+// {{ secrets "<name>" "<key>" }} besides the valueFuncs.
+func (r *VaultSecretReconciler) renderTemplates(ctx context.Context, es *appsv1.VaultSecret, data map[string][]byte) error {
+	self := types.NamespacedName{Name: es.Name, Namespace: es.Namespace}
+	selfSecret := types.NamespacedName{Name: es.SecretNameOrDefault(), Namespace: es.Namespace}
+	r.deps.name(self, selfSecret)
+	if len(es.Spec.Templates) == 0 {
+		r.deps.set(self, nil)
+		return nil
+	}
+
+	values := make(map[string]string, len(data))
+	for k, v := range data {
+		values[k] = string(v)
+	}
+
+	used := map[types.NamespacedName]bool{}
+	funcs := valueFuncs()
+	funcs["secrets"] = func(name, key string) (string, error) {
+		ref := types.NamespacedName{Name: name, Namespace: es.Namespace}
+		if ref == selfSecret || r.deps.reaches(ref, self) {
+			return "", errors.New("template dependency cycle between " + es.Name + " and " + name)
+		}
+
+		secret, err := r.referencedSecret(ctx, es.Namespace, "Secret", name)
+		if err != nil {
+			return "", err
+		}
+		if owner := metav1.GetControllerOf(secret); owner == nil || owner.APIVersion != appsv1.GroupVersion.String() || owner.Kind != "VaultSecret" {
+			return "", errors.New("Secret " + name + " isn't managed by a VaultSecret")
+		}
+		v, ok := secret.Data[key]
+		if !ok {
+			return "", errors.New("key " + key + " not found in the Secret " + name)
+		}
+
+		used[ref] = true
+		return string(v), nil
+	}
+
+	for _, key := range sortedTemplateKeys(es.Spec.Templates) {
+		out, err := renderTemplate(key, es.Spec.Templates[key], funcs, values)
+		if err != nil {
+			return err
+		}
+		data[key] = out
+	}
+
+	r.deps.set(self, used)
+	return nil
+}
+
+// renderTemplateData renders the Data of the Template of the VaultSecret,
+// whose output replaces the Secret data. The templates see the Secret data as
+// their dot.
+func renderTemplateData(templates map[string]string, data map[string][]byte) (map[string][]byte, error) {
+	values := make(map[string]string, len(data))
+	for k, v := range data {
+		values[k] = string(v)
+	}
+
+	funcs := valueFuncs()
+	out := make(map[string][]byte, len(templates))
+	for _, key := range sortedTemplateKeys(templates) {
+		value, err := renderTemplate(key, templates[key], funcs, values)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = value
+	}
+
+	return out, nil
+}
+
+// renderTemplate parses and executes the template of a Secret key
+func renderTemplate(key, text string, funcs template.FuncMap, dot interface{}) ([]byte, error) {
+	tmpl, err := template.New(key).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse the template %s: %w", key, err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, dot); err != nil {
+		return nil, fmt.Errorf("can't render the template %s: %w", key, err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// valueFuncs returns the functions the templates of the Secret values share.
+// The sprig spellings base64encode, base64decode and toJson are aliases.
+func valueFuncs() template.FuncMap {
+	toJSON := func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	base64Encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	base64Decode := func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		return string(b), err
+	}
+
+	return template.FuncMap{
+		"toJSON": toJSON,
+		"toJson": toJSON,
+		"toJSONPretty": func(v interface{}) (string, error) {
+			b, err := json.MarshalIndent(v, "", "  ")
+			return string(b), err
+		},
+		"base64Encode": base64Encode,
+		"base64encode": base64Encode,
+		"base64Decode": base64Decode,
+		"base64decode": base64Decode,
+		"toUpper":      strings.ToUpper,
+		"toLower":      strings.ToLower,
+		"trimSpace":    strings.TrimSpace,
+	}
+}
+
+// templateDependents maps a Secret to the VaultSecrets whose templates read it
+func (r *VaultSecretReconciler) templateDependents(obj client.Object) []reconcile.Request {
+	var requests []reconcile.Request
+	for _, vs := range r.deps.dependents(types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}) {
+		requests = append(requests, reconcile.Request{NamespacedName: vs})
+	}
+
+	return requests
+}
+
+func sortedTemplateKeys(templates map[string]string) []string {
+	keys := make([]string, 0, len(templates))
+	for k := range templates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
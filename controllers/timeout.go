@@ -0,0 +1,58 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// reconcileTimeoutError is a reconcile aborted by its ReconcileTimeout
+type reconcileTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *reconcileTimeoutError) Error() string {
+	return "the reconcile didn't complete within the reconcileTimeout of " + e.timeout.String()
+}
+
+// reconcileTimeout returns the ReconcileTimeout of the VaultSecret, or else
+// the default of the operator
+func (r *VaultSecretReconciler) reconcileTimeout(vs *appsv1.VaultSecret) time.Duration {
+	if vs.Spec.ReconcileTimeout != nil {
+		return vs.Spec.ReconcileTimeout.Duration
+	}
+
+	return r.DefaultReconcileTimeout
+}
+
+// timeoutReconcile turns the outcome of the reconcile whose context ran past
+// the ReconcileTimeout into its error, whatever the aborted Vault requests
+// and status updates failed with. It must be deferred by Reconcile.
+func timeoutReconcile(ctx context.Context, timeout time.Duration, err *error) {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return
+	}
+
+	log.FromContext(ctx).Info("aborted the reconcile running past its timeout", "timeout", timeout.String())
+	*err = &reconcileTimeoutError{timeout: timeout}
+}
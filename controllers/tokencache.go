@@ -0,0 +1,274 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// tokenKey identifies the Vault tokens obtained by the operator
+type tokenKey struct {
+	addr           string
+	vaultNamespace string
+	authPath       string
+	role           string
+
+	// authSecret is the namespaced name of the Secret holding the login
+	// credentials, if any
+	authSecret string
+
+	// jwtPath is the JWT file logged in with, if set by the VaultSecret
+	jwtPath string
+
+	// audience and serviceAccount are the Audience and the ServiceAccount of
+	// the requested token logged in with, if any
+	audience       string
+	serviceAccount string
+}
+
+func configTokenKey(config VaultConfig) tokenKey {
+	key := tokenKey{
+		addr:           config.Addr,
+		vaultNamespace: config.VaultNamespace,
+		authPath:       config.AuthPath,
+		role:           config.Role,
+		jwtPath:        config.JWTPath,
+	}
+	if config.Audience != "" {
+		key.audience = config.Audience
+		key.serviceAccount = config.ServiceAccount.String()
+	}
+	if config.AuthSecret != "" {
+		key.authSecret = config.Namespace + "/" + config.AuthSecret
+	}
+
+	return key
+}
+
+// vaultToken is a token obtained by a Vault login
+type vaultToken struct {
+	token string
+
+	// ttl is zero for tokens without a lease
+	ttl time.Duration
+
+	// uses is the num_uses limit of the token, zero for unlimited tokens
+	uses int
+
+	// renewable tokens may have their lease extended instead of logging in
+	// again
+	renewable bool
+}
+
+type cachedToken struct {
+	token string
+
+	// expires is zero for tokens without a lease
+	expires time.Time
+
+	// leaseEnd is the end of the lease of a renewable token, it's kept past
+	// expires until then for a renewal
+	leaseEnd time.Time
+
+	// uses is the number of uses left, zero for unlimited tokens
+	uses int
+}
+
+// pendingLogin is a login in progress, shared by all the reads of its group
+type pendingLogin struct {
+	done  chan struct{}
+	token vaultToken
+	err   error
+}
+
+// tokenCache keeps the Vault tokens obtained by logging in, so that the
+// VaultSecrets sharing a Vault role don't log in on every read. Tokens are
+// dropped a tenth of their lease before it ends, renewable ones are kept until
+// the end for a renewal, and num_uses limited tokens once every use is handed
+// out. It also coordinates the logins, the concurrent
+// reads of a group without a token wait for a single login instead of each
+// doing their own. It's safe for concurrent use.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[tokenKey]cachedToken
+	logins map[tokenKey]*pendingLogin
+
+	// configs are the configs the tokens were logged in with, for their
+	// renewals in the background
+	configs map[tokenKey]VaultConfig
+}
+
+// getOrLogin returns the cached token of the group or the one obtained by a
+// login, which runs once for all the concurrent callers. Every call takes one
+// use of the token. The returned bool is true for a token taken from the
+// cache, as such it may have been revoked.
+func (c *tokenCache) getOrLogin(key tokenKey, login func() (vaultToken, error)) (string, bool, error) {
+	if token, ok := c.get(key); ok {
+		return token, true, nil
+	}
+
+	c.mu.Lock()
+	if pending, ok := c.logins[key]; ok {
+		c.mu.Unlock()
+		<-pending.done
+		// The uses of a limited token are shared through the cache
+		if pending.err == nil && pending.token.uses > 0 {
+			return c.getOrLogin(key, login)
+		}
+		return pending.token.token, false, pending.err
+	}
+	if c.logins == nil {
+		c.logins = map[tokenKey]*pendingLogin{}
+	}
+	pending := &pendingLogin{done: make(chan struct{})}
+	c.logins[key] = pending
+	c.mu.Unlock()
+
+	pending.token, pending.err = login()
+	if pending.err == nil {
+		c.put(key, pending.token)
+	}
+
+	c.mu.Lock()
+	delete(c.logins, key)
+	c.mu.Unlock()
+	close(pending.done)
+
+	return pending.token.token, false, pending.err
+}
+
+func (c *tokenCache) get(key tokenKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.tokens[key]
+	if !ok {
+		return "", false
+	}
+	if !t.expires.IsZero() && !time.Now().Before(t.expires) {
+		if !time.Now().Before(t.leaseEnd) {
+			delete(c.tokens, key)
+			delete(c.configs, key)
+		}
+		return "", false
+	}
+
+	if t.uses > 0 {
+		t.uses--
+		if t.uses == 0 {
+			delete(c.tokens, key)
+		} else {
+			c.tokens[key] = t
+		}
+	}
+
+	return t.token, true
+}
+
+// put caches the token obtained by a login, less the use taken by the caller
+func (c *tokenCache) put(key tokenKey, token vaultToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if token.uses == 1 {
+		delete(c.tokens, key)
+		return
+	}
+
+	if c.tokens == nil {
+		c.tokens = map[tokenKey]cachedToken{}
+	}
+	t := cachedToken{token: token.token}
+	if token.ttl > 0 {
+		t.expires = time.Now().Add(token.ttl - token.ttl/10)
+		// The uses of a limited token would be spent by the renewals
+		if token.renewable && token.uses == 0 {
+			t.leaseEnd = time.Now().Add(token.ttl)
+		}
+	}
+	if token.uses > 1 {
+		t.uses = token.uses - 1
+	}
+	c.tokens[key] = t
+}
+
+// renewable returns the cached token of the group due for a renewal, that is
+// past its expiry but still within its lease
+func (c *tokenCache) renewable(key tokenKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.tokens[key]
+	if !ok || !time.Now().Before(t.leaseEnd) {
+		return "", false
+	}
+
+	return t.token, true
+}
+
+func (c *tokenCache) invalidate(key tokenKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, key)
+	delete(c.configs, key)
+}
+
+// remember records the config the token of the group is logged in with
+func (c *tokenCache) remember(key tokenKey, config VaultConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.configs == nil {
+		c.configs = map[tokenKey]VaultConfig{}
+	}
+	c.configs[key] = config
+}
+
+// dueToken is a cached renewable token expiring soon
+type dueToken struct {
+	key    tokenKey
+	token  string
+	config VaultConfig
+}
+
+// dueForRenewal returns the renewable tokens expiring before the deadline,
+// still within their lease, whose config is remembered
+func (c *tokenCache) dueForRenewal(deadline time.Time) []dueToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var due []dueToken
+	for key, t := range c.tokens {
+		config, ok := c.configs[key]
+		if !ok || !time.Now().Before(t.leaseEnd) || !t.expires.Before(deadline) {
+			continue
+		}
+		due = append(due, dueToken{key: key, token: t.token, config: config})
+	}
+
+	return due
+}
+
+// isPermissionDenied reports whether the Vault refused the request token
+func isPermissionDenied(err error) bool {
+	var respErr *vaultapi.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+const (
+	tokenFileAuthMethod = "token_file"
+
+	// tokenFileEnvVar is the token file of the VaultSecrets without a
+	// TokenPath, such as the sink of a Vault Agent sidecar of the operator
+	tokenFileEnvVar = "VAULT_TOKEN_FILE"
+)
+
+func init() {
+	RegisterAuthenticator(tokenFileAuthMethod, tokenFileAuthenticator{})
+}
+
+// tokenFileAuthenticator uses the token a Vault Agent keeps fresh in a file,
+// the TokenPath of the VaultSecret or else the one of VAULT_TOKEN_FILE. The
+// file isn't cached, the agent rewrites it as it renews the token.
+type tokenFileAuthenticator struct{}
+
+func (tokenFileAuthenticator) UsesRole() bool {
+	return false
+}
+
+func (tokenFileAuthenticator) LoginData(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (map[string]interface{}, error) {
+	return nil, errors.New("the token_file auth method doesn't log in")
+}
+
+func (tokenFileAuthenticator) ReadToken(ctx context.Context, r *VaultSecretReconciler, vaultConfig VaultConfig) (string, error) {
+	file := vaultConfig.TokenPath
+	if file != "" && !appsv1.FileInDirs(file, r.TokenDirs) {
+		return "", fmt.Errorf("the token file %s is outside of the directories allowed by the operator", file)
+	}
+	if file == "" {
+		file = os.Getenv(tokenFileEnvVar)
+	}
+	if file == "" {
+		return "", errors.New("the token_file auth method needs a tokenPath or " + tokenFileEnvVar)
+	}
+
+	// The agent may not have written the file yet, the reconcile is retried
+	// as for any failed login
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("the token file %s isn't written yet", file)
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't read the token file %s: %w", file, err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("the token file %s is empty", file)
+	}
+
+	return token, nil
+}
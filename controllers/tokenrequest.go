@@ -0,0 +1,56 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tokenRequestSeconds is the lifetime of the ServiceAccount tokens requested
+// for the logins, the shortest the API server issues
+const tokenRequestSeconds = 600
+
+// serviceAccountToken requests a token of the ServiceAccount bound to the
+// Audience with the TokenRequest API
+func (r *VaultSecretReconciler) serviceAccountToken(ctx context.Context, vaultConfig VaultConfig) (string, error) {
+	sa := vaultConfig.ServiceAccount
+	if sa.Name == "" {
+		return "", errors.New("no ServiceAccount to request a token of the audience " + vaultConfig.Audience + " for")
+	}
+	if r.KubeClient == nil {
+		return "", errors.New("the operator can't request ServiceAccount tokens")
+	}
+
+	expiration := int64(tokenRequestSeconds)
+	request := &authv1.TokenRequest{
+		Spec: authv1.TokenRequestSpec{
+			Audiences:         []string{vaultConfig.Audience},
+			ExpirationSeconds: &expiration,
+		},
+	}
+	response, err := r.KubeClient.CoreV1().ServiceAccounts(sa.Namespace).CreateToken(ctx, sa.Name, request, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("can't request a token of the ServiceAccount %s: %w", sa, err)
+	}
+
+	return response.Status.Token, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		ctx   context.Context
+		vault *fakeVault
+		r     *VaultSecretReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		vault = newFakeVault()
+		r = &VaultSecretReconciler{Client: k8sClient, Scheme: scheme.Scheme, Recorder: record.NewFakeRecorder(100)}
+	})
+
+	AfterEach(func() {
+		vault.Close()
+	})
+
+	It("nests the login, the read and the Secret write in the reconcile", func() {
+		// The tracer follows the first global provider only, no other spec
+		// sets one
+		exporter := tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+		vault.setKV2("secret/data/traced", map[string]interface{}{"password": "one"})
+		vs := newVaultSecret("traced", vault.URL, "secret/data/traced")
+		Expect(k8sClient.Create(ctx, vs)).To(Succeed())
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: vs.Name, Namespace: vs.Namespace}})
+		Expect(err).NotTo(HaveOccurred())
+
+		spans := map[string]*sdktrace.SpanSnapshot{}
+		for _, span := range exporter.GetSpans() {
+			spans[span.Name] = span
+		}
+		Expect(spans).To(HaveKey("vaultsecret.reconcile"))
+		Expect(spans).To(HaveKey("vault.read_secret"))
+		Expect(spans).To(HaveKey("vault.login"))
+		Expect(spans).To(HaveKey("vault.read"))
+		Expect(spans).To(HaveKey("secret.write"))
+
+		reconcileSpan := spans["vaultsecret.reconcile"].SpanContext.SpanID()
+		Expect(spans["vault.read_secret"].Parent.SpanID()).To(Equal(reconcileSpan))
+		Expect(spans["secret.write"].Parent.SpanID()).To(Equal(reconcileSpan))
+		readSecretSpan := spans["vault.read_secret"].SpanContext.SpanID()
+		Expect(spans["vault.login"].Parent.SpanID()).To(Equal(readSecretSpan))
+		Expect(spans["vault.read"].Parent.SpanID()).To(Equal(readSecretSpan))
+	})
+})
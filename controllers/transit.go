@@ -0,0 +1,78 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// transitDecrypt replaces the ciphertexts of the data with their plaintext,
+// decrypted by <mount>/decrypt/<keyName>. The data is left untouched unless
+// every value decrypts, no partial plaintext makes it to the Secret.
+func (r *VaultSecretReconciler) transitDecrypt(ctx context.Context, config VaultConfig, transit *appsv1.TransitDecryption, data map[string][]byte) error {
+	keys := transit.Keys
+	if len(keys) == 0 {
+		keys = sortedKeys(data)
+	}
+	mount := strings.Trim(stringOr(transit.Mount, appsv1.DefaultTransitMount), "/")
+	path := mount + "/decrypt/" + url.PathEscape(transit.KeyName)
+
+	log.FromContext(ctx).Info("decrypting the Vault keys with the transit key", "mount", mount, "keyName", transit.KeyName, "keys", len(keys))
+	plaintexts := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		ciphertext, ok := data[key]
+		if !ok {
+			return errors.New("the Vault key " + key + " to decrypt doesn't exist at the path")
+		}
+		plaintext, err := r.decryptValue(ctx, config, path, string(ciphertext))
+		if err != nil {
+			return fmt.Errorf("can't decrypt the Vault key %s with the transit key %s: %w", key, transit.KeyName, err)
+		}
+		plaintexts[key] = plaintext
+	}
+	for key, plaintext := range plaintexts {
+		data[key] = plaintext
+	}
+
+	return nil
+}
+
+// decryptValue returns the base64 decoded plaintext of the ciphertext
+func (r *VaultSecretReconciler) decryptValue(ctx context.Context, config VaultConfig, path, ciphertext string) ([]byte, error) {
+	secret, err := r.vaultWriteSecret(ctx, config, path, map[string]interface{}{"ciphertext": strings.TrimSpace(ciphertext)})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("no plaintext in the decrypt response")
+	}
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, errors.New("no plaintext in the decrypt response")
+	}
+
+	return base64.StdEncoding.DecodeString(plaintext)
+}
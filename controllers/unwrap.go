@@ -0,0 +1,137 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// wrappingTokenKey is the key of the data holding the wrapping token, when
+// the read response isn't wrapped itself
+const wrappingTokenKey = "token"
+
+// unwrapError is a failed unwrap of a response-wrapping token. The tokens
+// are single-use, a failed unwrap isn't retried with the same token.
+type unwrapError struct {
+	path string
+	err  error
+}
+
+func (e *unwrapError) Error() string {
+	return "can't unwrap the single-use wrapping token read from " + e.path + ", it may have been unwrapped already: " + e.err.Error()
+}
+
+func (e *unwrapError) Unwrap() error {
+	return e.err
+}
+
+// unwrapKey identifies the path a wrapping token was read from
+type unwrapKey struct {
+	addr           string
+	vaultNamespace string
+	path           string
+}
+
+// unwrapped is the payload of the last wrapping token of a path
+type unwrapped struct {
+	tokenHash string
+	secret    *vaultapi.Secret
+}
+
+// unwrapCache keeps the payload of the last wrapping token unwrapped for
+// each path. A token stored in a path is read again on every refresh, it
+// can't be unwrapped twice. It's safe for concurrent use.
+type unwrapCache struct {
+	mu       sync.Mutex
+	payloads map[unwrapKey]unwrapped
+}
+
+// get returns the payload of the token if it's the last one of the path
+func (c *unwrapCache) get(key unwrapKey, tokenHash string) (*vaultapi.Secret, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	payload, ok := c.payloads[key]
+	if !ok || payload.tokenHash != tokenHash {
+		return nil, false
+	}
+
+	return payload.secret, true
+}
+
+// put replaces the payload of the path
+func (c *unwrapCache) put(key unwrapKey, tokenHash string, secret *vaultapi.Secret) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.payloads == nil {
+		c.payloads = map[unwrapKey]unwrapped{}
+	}
+	c.payloads[key] = unwrapped{tokenHash: tokenHash, secret: secret}
+}
+
+// wrappingToken returns the wrapping token of the read response, either its
+// wrap info or the token key of its data, KV v2 or not
+func wrappingToken(secret *vaultapi.Secret) (string, bool) {
+	if secret == nil {
+		return "", false
+	}
+	if secret.WrapInfo != nil && secret.WrapInfo.Token != "" {
+		return secret.WrapInfo.Token, true
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	token, ok := data[wrappingTokenKey].(string)
+
+	return token, ok && token != ""
+}
+
+// unwrapSecret unwraps the wrapping token read from the path with
+// sys/wrapping/unwrap, unless it's the token unwrapped last
+func (r *VaultSecretReconciler) unwrapSecret(ctx context.Context, logical VaultLogical, vaultConfig VaultConfig, secret *vaultapi.Secret) (*vaultapi.Secret, error) {
+	token, ok := wrappingToken(secret)
+	if !ok {
+		return nil, &unwrapError{path: vaultConfig.Path, err: errors.New("no wrapping token in the response")}
+	}
+
+	key := unwrapKey{addr: vaultConfig.Addr, vaultNamespace: vaultConfig.VaultNamespace, path: vaultConfig.Path}
+	sum := sha256.Sum256([]byte(token))
+	tokenHash := hex.EncodeToString(sum[:])
+	if payload, ok := r.unwraps.get(key, tokenHash); ok {
+		return payload, nil
+	}
+
+	log.FromContext(ctx).Info("unwrapping the wrapping token read from the path", "path", vaultConfig.Path)
+	payload, err := logical.Write(ctx, "sys/wrapping/unwrap", map[string]interface{}{"token": token})
+	if err != nil {
+		return nil, &unwrapError{path: vaultConfig.Path, err: err}
+	}
+	if payload == nil {
+		return nil, &unwrapError{path: vaultConfig.Path, err: errors.New("no payload in the unwrap response")}
+	}
+	r.unwraps.put(key, tokenHash, payload)
+
+	return payload, nil
+}
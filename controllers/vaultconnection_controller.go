@@ -0,0 +1,116 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	appsv1 "github.com/mink0/vault-operator/api/v1"
+)
+
+// connectionCheckInterval is the period the Vaults of the VaultConnections
+// are checked at
+const connectionCheckInterval = time.Minute
+
+// VaultConnectionReconciler reconciles a VaultConnection object, checking
+// that its Vault is reachable and reporting it in its Ready condition
+type VaultConnectionReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Vault is the VaultSecretReconciler the Vault clients of the checks are
+	// made by, with its TLS setup and rate limits
+	Vault *VaultSecretReconciler
+}
+
+//+kubebuilder:rbac:groups=apps.vault.op,resources=vaultconnections,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps.vault.op,resources=vaultconnections/status,verbs=get;update;patch
+
+// Reconcile checks the Vault of the VaultConnection in sys/health, with its
+// TLS settings, and records the outcome in its status. The check is repeated
+// every connectionCheckInterval, the VaultSecrets using the connection are
+// left to their own retries.
+func (r *VaultConnectionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	conn := &appsv1.VaultConnection{}
+	if err := r.Get(ctx, req.NamespacedName, conn); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	condition := metav1.Condition{
+		Type:               conditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "VaultReachable",
+		Message:            "the Vault is initialized and unsealed",
+		ObservedGeneration: conn.Generation,
+	}
+	if err := r.checkConnection(ctx, conn); err != nil {
+		log.FromContext(ctx).Error(err, "the Vault of the VaultConnection isn't ready", "vaultAddr", conn.Spec.VaultAddress)
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "VaultUnreachable"
+		condition.Message = err.Error()
+	}
+	meta.SetStatusCondition(&conn.Status.Conditions, condition)
+	conn.Status.Ready = condition.Status == metav1.ConditionTrue
+	now := metav1.NewTime(r.Vault.now())
+	conn.Status.LastCheckTime = &now
+
+	if err := r.Status().Update(ctx, conn); err != nil {
+		log.FromContext(ctx).Error(err, "unable to update the VaultConnection status")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: connectionCheckInterval}, nil
+}
+
+// checkConnection checks the Vault of the VaultConnection as the
+// VaultHealthCheck does
+func (r *VaultConnectionReconciler) checkConnection(ctx context.Context, conn *appsv1.VaultConnection) error {
+	config := VaultConfig{
+		Addr:           conn.Spec.VaultAddress,
+		VaultNamespace: conn.Spec.VaultNamespace,
+		TLSServerName:  conn.Spec.TLSServerName,
+		ClientTimeout:  healthCheckTimeout,
+	}
+	if conn.Spec.TLSSecret != nil {
+		if conn.Spec.TLSSecret.Namespace == "" {
+			return fmt.Errorf("the tlsSecret of the VaultConnection %s names no namespace", conn.Name)
+		}
+		config.TLSSecret = conn.Spec.TLSSecret.Name
+		config.TLSNamespace = conn.Spec.TLSSecret.Namespace
+	}
+
+	return r.Vault.vaultHealth(ctx, config)
+}
+
+// SetupWithManager sets up the controller with the Manager. The status
+// writes of the checks don't trigger new ones, only the spec changes do.
+func (r *VaultConnectionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&appsv1.VaultConnection{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// VaultLogical is the part of the Vault API the operator talks to the Vault
+// with. The reconciler wraps its Vault clients into one with NewVaultLogical,
+// which tests may point to a fake. The requests are cancelled along with
+// their context, within the timeout of the client.
+type VaultLogical interface {
+	// SetToken sets the token of the following requests
+	SetToken(token string)
+
+	// ReadWithData reads the path with the query parameters of data
+	ReadWithData(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error)
+
+	// Write writes the data to the path
+	Write(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error)
+
+	// Login logs in with the data on the login endpoint, such as
+	// auth/kubernetes/login
+	Login(ctx context.Context, path string, data map[string]interface{}) (*VaultLogin, error)
+}
+
+// VaultLogin is the auth of a Vault login response
+type VaultLogin struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+	NumUses       int    `json:"num_uses"`
+}
+
+// vaultLogical returns the VaultLogical of the Vault client
+func (r *VaultSecretReconciler) vaultLogical(client *vaultapi.Client) VaultLogical {
+	if r.NewVaultLogical != nil {
+		return r.NewVaultLogical(client)
+	}
+
+	return apiLogical{client: client}
+}
+
+// apiLogical is the VaultLogical of a vaultapi client. The requests are sent
+// raw as the vaultapi.Logical of this version takes no context.
+type apiLogical struct {
+	client *vaultapi.Client
+}
+
+func (l apiLogical) SetToken(token string) {
+	l.client.SetToken(token)
+}
+
+func (l apiLogical) ReadWithData(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error) {
+	req := l.client.NewRequest(http.MethodGet, "/v1/"+path)
+	if len(data) > 0 {
+		req.Params = url.Values(data)
+	}
+
+	return l.send(ctx, req)
+}
+
+func (l apiLogical) Write(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	req := l.client.NewRequest(http.MethodPut, "/v1/"+path)
+	if err := req.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+
+	return l.send(ctx, req)
+}
+
+// send sends the request and parses the secret of the response. As with
+// vaultapi.Logical, a secret not found reads as nil, and the not found
+// responses carrying data or warnings are returned as is.
+func (l apiLogical) send(ctx context.Context, req *vaultapi.Request) (*vaultapi.Secret, error) {
+	resp, err := l.client.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		secret, parseErr := vaultapi.ParseSecret(resp.Body)
+		switch {
+		case parseErr == io.EOF:
+			return nil, nil
+		case parseErr != nil:
+			return nil, parseErr
+		case secret != nil && (len(secret.Warnings) > 0 || len(secret.Data) > 0):
+			return secret, nil
+		case req.Method == http.MethodGet:
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return vaultapi.ParseSecret(resp.Body)
+}
+
+// Login sends the login raw, the num_uses of the token isn't part of the
+// vaultapi.SecretAuth
+func (l apiLogical) Login(ctx context.Context, path string, data map[string]interface{}) (*VaultLogin, error) {
+	req := l.client.NewRequest(http.MethodPut, "/v1/"+path)
+	if err := req.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	resp, err := l.client.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var login struct {
+		Auth *VaultLogin `json:"auth"`
+	}
+	if err := resp.DecodeJSON(&login); err != nil {
+		return nil, err
+	}
+	if login.Auth == nil {
+		return nil, errors.New("no auth in the Vault login response")
+	}
+
+	return login.Auth, nil
+}
@@ -17,51 +17,292 @@ limitations under the License.
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/jsonpath"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	vaultapi "github.com/hashicorp/vault/api"
 	appsv1 "github.com/mink0/vault-operator/api/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 // VaultSecretReconciler reconciles a VaultSecret object
 type VaultSecretReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// ServiceAccount is the operator's own ServiceAccount, its role annotation
+	// is the last fallback for VaultSecrets without a role
+	ServiceAccount types.NamespacedName
+
+	// KubeClient requests the ServiceAccount tokens of the VaultSecrets
+	// logging in with an Audience, the TokenRequest subresource being out of
+	// reach of the controller-runtime client
+	KubeClient kubernetes.Interface
+
+	// JWTDirs are the directories the JWTPath of the VaultSecrets may point
+	// into, no JWTPath is read without them
+	JWTDirs []string
+
+	// TokenDirs are the directories the TokenPath of the VaultSecrets may
+	// point into, no TokenPath is read without them
+	TokenDirs []string
+
+	// DefaultVaultAddress and DefaultRole are the operator wide fallbacks of
+	// the VaultAddress and Role the VaultSecrets leave empty. DefaultRole
+	// gives way to the role of a ServiceAccountName. The default AuthPath is
+	// appsv1.DefaultAuthPath, the webhook defaults it too.
+	DefaultVaultAddress string
+	DefaultRole         string
+
+	// DefaultReadRetries and DefaultRetryDelay are the ReadRetries and
+	// RetryDelay of the VaultSecrets without them
+	DefaultReadRetries int
+	DefaultRetryDelay  time.Duration
+
+	// DefaultReconcileTimeout is the ReconcileTimeout of the VaultSecrets
+	// without one, zero means no bound
+	DefaultReconcileTimeout time.Duration
+
+	// MaxConcurrentLogins caps the number of Vault logins in flight across
+	// all the reconciles, zero means no cap
+	MaxConcurrentLogins int
+
+	// MaxVaultResponseBytes caps the size of the Vault responses, zero means
+	// no cap
+	MaxVaultResponseBytes int64
+
+	// VaultQPS and VaultBurst shape the Vault requests of all the reconciles
+	// with a token bucket, a zero VaultQPS means no limit. VaultBurst defaults
+	// to VaultQPS.
+	VaultQPS   float64
+	VaultBurst int
+
+	// ForwardToActive asks the performance standbys to forward the Vault
+	// requests to the active node rather than serve them, for the clusters
+	// behind a load balancer whose standbys lag behind. The reads of the
+	// ReadAddr replicas are served locally still.
+	ForwardToActive bool
+
+	// MaxConcurrentReconciles is the number of VaultSecrets reconciled at
+	// once, one when zero
+	MaxConcurrentReconciles int
+
+	// AllowedTargetKinds lists the kinds, as "Kind.group", VaultSecrets may
+	// materialize their data into with a TargetRef
+	AllowedTargetKinds []string
+
+	// TokenRenewInterval is the period the cached renewable Vault tokens
+	// are renewed at in the background, ahead of their expiry. Zero leaves
+	// the renewals to the reconciles.
+	TokenRenewInterval time.Duration
+
+	// RefreshJitter is the fraction of the refresh interval the refreshes
+	// are moved by at random either way, zero refreshes the VaultSecrets on
+	// their interval exactly
+	RefreshJitter float64
+
+	// ServerSideApply writes the child Secrets with a server-side apply of
+	// their operator owned fields, so that the changes of other managers
+	// to them surface as conflicts rather than being overwritten
+	ServerSideApply bool
+
+	// StartupJitter is the window the first reconciles of the VaultSecrets
+	// after the start of the operator are spread over at random, zero
+	// reconciles them all right away
+	StartupJitter time.Duration
+
+	// WatchNamespaces are the namespaces the cache of the manager is
+	// restricted to, all of them when empty. The Secrets are only copied
+	// into these.
+	WatchNamespaces []string
+
+	// CopyNamespaces are the namespaces the Secrets may be copied into, "*"
+	// allowing all of them, no copies are made without them
+	CopyNamespaces []string
+
+	// NewVaultLogical wraps the Vault clients into the VaultLogical the
+	// Vault is talked to with, the vaultapi client itself when nil
+	NewVaultLogical func(client *vaultapi.Client) VaultLogical
+
+	reads   readTracker
+	jwts    jwtCache
+	tokens  tokenCache
+	unwraps unwrapCache
+	mounts  kvMountCache
+	logins  loginLimiter
+	limiter vaultRateLimiter
+	deps    templateDeps
+	startup startupTracker
+
+	// clock returns the current time, time.Now when nil
+	clock func() time.Time
+
+	// jitter returns a random delay below d, uniformly distributed when nil
+	jitter func(d time.Duration) time.Duration
 }
 
 type VaultConfig struct {
-	Addr          string
-	AuthMethod    string
-	AuthPath      string
-	Role          string
-	Path          string
-	SkipVerify    bool
-	TLSSecret     string
-	ClientTimeout time.Duration
+	Addr             string
+	ReadAddr         string
+	VaultNamespace   string
+	AuthMethod       string
+	AuthPath         string
+	AuthSecret       string
+	JWTPath          string
+	Audience         string
+	ServiceAccount   types.NamespacedName
+	TokenPath        string
+	Role             string
+	Path             string
+	KVVersion        string
+	Version          int
+	ReadRetries      int
+	RetryDelay       time.Duration
+	Namespace        string
+	SkipVerify       bool
+	TLSSecret        string
+	TLSNamespace     string
+	TLSServerName    string
+	ClientCertSecret string
+	ClientTimeout    time.Duration
+	Unwrap           bool
+	List             bool
 }
 
 const (
-	defaultJWTAuthMethod = "jwt"
-	defaultJWTFile       = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultJWTFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// dataHashAnnotation holds the hash of the tracked child Secret keys
+	dataHashAnnotation = "apps.vault.op/data-hash"
+
+	// forceSyncAnnotation on a VaultSecret triggers a re-sync whenever its
+	// value changes, e.g. to a timestamp. The Secret is rewritten from a fresh
+	// read, whether the Vault data changed or not.
+	forceSyncAnnotation = "apps.vault.op/force-sync"
+
+	// adoptAnnotation set to "true" on a pre-existing Secret lets the
+	// VaultSecret of the same name take it over, as AdoptExisting does
+	adoptAnnotation = "apps.vault.op/adopt"
+
+	// bypassCacheAnnotation set to "true" on a VaultSecret makes the
+	// reconciles log in again instead of using a cached token until one of
+	// them syncs
+	bypassCacheAnnotation = "apps.vault.op/bypass-cache"
+
+	// vaultPathAnnotation and vaultAddressAnnotation on the child Secret link
+	// it to its Vault source for external tooling, such as the Secrets Store
+	// CSI driver
+	vaultPathAnnotation    = "apps.vault.op/vault-path"
+	vaultAddressAnnotation = "apps.vault.op/vault-address"
+
+	// managedByLabel set to managedByValue, vaultSecretNameLabel and
+	// vaultSecretNamespaceLabel on the child Secret let the GitOps pruning
+	// tools and label selectors tell the Secrets managed by the operator,
+	// and their VaultSecret, apart
+	managedByLabel            = "app.kubernetes.io/managed-by"
+	managedByValue            = "vault-operator"
+	vaultSecretNameLabel      = "apps.vault.op/vaultsecret-name"
+	vaultSecretNamespaceLabel = "apps.vault.op/vaultsecret-namespace"
+
+	// defaultClientTimeout bounds the Vault requests without a ClientTimeout
+	defaultClientTimeout = 30 * time.Second
+
+	// forwardHeader set to forwardActiveNode has the performance standbys
+	// forward the request to the active node, when the Vault allows it
+	forwardHeader     = "X-Vault-Forward"
+	forwardActiveNode = "active-node"
+
+	// tlsSecretCAKey is the key of the TLSSecret holding the Vault CA bundle
+	tlsSecretCAKey = "ca.crt"
+
+	// roleAnnotation on a ServiceAccount provides the Vault role
+	roleAnnotation = "vault.hashicorp.com/role"
+
+	// keyTransformEnvVar turns Secret keys into environment variable names
+	keyTransformEnvVar = "EnvVar"
+
+	// conditionInvalidEnvKey is set when ValidateEnvNames is on and some
+	// Secret keys aren't valid environment variable names
+	conditionInvalidEnvKey = "InvalidEnvKey"
+
+	// conditionMissingKeys is set when some VaultKeys of the Data are
+	// missing from the Vault secret and RequireAllKeys is on
+	conditionMissingKeys = "MissingKeys"
+
+	// conditionPathMissing is set when the Path of an Optional VaultSecret
+	// doesn't exist in the Vault
+	conditionPathMissing = "PathMissing"
+
+	// conditionNameCollision is set when the target Secret exists but isn't
+	// managed by the VaultSecret
+	conditionNameCollision = "NameCollision"
+
+	// conditionUnexpectedNesting is set when the Vault secret data had to be
+	// unwrapped from extra nested "data" fields
+	conditionUnexpectedNesting = "UnexpectedNesting"
+
+	// maxDataNesting is the number of extra nested "data" fields unwrapped
+	maxDataNesting = 3
+
+	// readRetryDelay is the delay between the retries of a Vault login or
+	// read without a RetryDelay
+	readRetryDelay = 250 * time.Millisecond
 )
 
 //+kubebuilder:rbac:groups=apps.vault.op,resources=vaultsecrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps.vault.op,resources=vaultsecrets/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=apps.vault.op,resources=vaultsecrets/finalizers,verbs=update
+//+kubebuilder:rbac:groups=apps.vault.op,resources=vaultconnections,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -72,164 +313,1939 @@ const (
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.11.0/pkg/reconcile
-func (r *VaultSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
-
-	log.Log.Info("starting vaultSecretReconciler for: '" + req.Name + "'")
+func (r *VaultSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	ctx, span := tracer.Start(ctx, "vaultsecret.reconcile", trace.WithAttributes(
+		attribute.String("vaultsecret.namespace", req.Namespace),
+		attribute.String("vaultsecret.name", req.Name),
+	))
+	defer func() { endSpan(span, err) }()
+	log.FromContext(ctx).V(1).Info("reconciling the VaultSecret")
 
 	var vaultSecret appsv1.VaultSecret
 	if err := r.Get(ctx, req.NamespacedName, &vaultSecret); err != nil {
-		log.Log.Error(err, "unable to get vaultSecret resource")
+		if apierrors.IsNotFound(err) {
+			log.FromContext(ctx).V(1).Info("the VaultSecret is gone")
+			r.reads.forget(req.NamespacedName)
+			r.deps.forget(req.NamespacedName)
+			forgetLastSync(req.NamespacedName)
+		} else {
+			log.FromContext(ctx).Error(err, "unable to get the VaultSecret")
+		}
 		// we'll ignore not-found errors, since they can't be fixed by an immediate
 		// requeue (we'll need to wait for a new notification), and we can get them
 		// on deleted requests.
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	// The errors are recorded past the ReconcileTimeout as well
+	statusCtx := ctx
+	defer func() {
+		if err != nil {
+			result, err = r.recordError(statusCtx, &vaultSecret, err)
+		}
+	}()
+	defer recoverReconcile(ctx, &err)
 
-	// Init Vault config
-	config := VaultConfig{}
-	config.Addr = vaultSecret.Spec.VaultAddress
-	config.Path = vaultSecret.Spec.Path
-	config.Role = vaultSecret.Spec.Role
-	config.AuthMethod = defaultJWTAuthMethod
-	config.AuthPath = "kubernetes"
-	if len(vaultSecret.Spec.AuthPath) > 0 {
-		config.AuthPath = vaultSecret.Spec.AuthPath
+	if timeout := r.reconcileTimeout(&vaultSecret); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		defer timeoutReconcile(ctx, timeout, &err)
+	}
+
+	if result, delayed := r.delayStartup(ctx, &vaultSecret); delayed {
+		return result, nil
+	}
+
+	// A paused VaultSecret is left alone, but for its finalizer
+	if vaultSecret.Spec.Paused && vaultSecret.DeletionTimestamp.IsZero() {
+		return r.recordPaused(ctx, &vaultSecret)
+	}
+
+	// The deletion doesn't wait on the dependencies of the Vault config, they
+	// may be gone already along with the namespace
+	if !vaultSecret.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.finalize(ctx, &vaultSecret)
+	}
+
+	config, err := r.vaultConfig(ctx, &vaultSecret)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// The log lines of the reconcile carry the Vault address and path, the
+	// name and namespace are set by the controller
+	logger := log.FromContext(ctx).WithValues("vaultAddr", config.Addr, "path", config.Path)
+	ctx = log.IntoContext(ctx, logger)
+
+	if err := r.addFinalizer(ctx, &vaultSecret); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	reader, err := r.secretReader(ctx, vaultSecret.Spec.Backend)
+	if err != nil {
+		logger.Error(err, "can't select the secret backend", "backend", vaultSecret.Spec.Backend)
+		return ctrl.Result{}, err
+	}
+	reader = instrumentReader(reader, vaultSecret.Spec.Backend)
+
+	if err := r.setEffectiveConfig(ctx, &vaultSecret, config); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	r.bypassCache(ctx, &vaultSecret, config)
+
+	if vaultSecret.Spec.DryRun {
+		return r.dryRun(ctx, reader, config, &vaultSecret)
+	}
+
+	if vaultSecret.Spec.TargetRef != nil {
+		return r.reconcileTarget(ctx, reader, config, &vaultSecret)
+	}
+	if vaultSecret.Spec.TargetKind == appsv1.TargetKindConfigMap {
+		return r.reconcileConfigMap(ctx, reader, config, &vaultSecret)
+	}
+	if vaultSecret.Spec.PathPrefix != "" {
+		return r.reconcilePrefix(ctx, reader, config, &vaultSecret)
 	}
 
 	// Check if the vaultSecret's child Secret already exists, if not create a new one
 	found := &core.Secret{}
-	err := r.Get(ctx, types.NamespacedName{Name: vaultSecret.Name, Namespace: vaultSecret.Namespace}, found)
+	err = r.Get(ctx, types.NamespacedName{Name: vaultSecret.SecretNameOrDefault(), Namespace: vaultSecret.Namespace}, found)
 	if err != nil && !apierrors.IsNotFound(err) {
-		log.Log.Error(err, "unable to get child Secret for the", vaultSecret.Name)
+		logger.Error(err, "unable to get the child Secret")
 		return ctrl.Result{}, err
 	}
 
 	if apierrors.IsNotFound(err) {
-		// Fetch the Secret data
-		secData, err := r.VaultReadSecret(config)
-		if err != nil {
-			log.Log.Error(err, "can't read the data from the Vault")
+		rendered, result, err := r.renderSecret(ctx, reader, config, &vaultSecret, nil)
+		if rendered == nil || err != nil {
+			return result, err
 		}
+		secret, chunks, keys := rendered.secret, rendered.chunks, rendered.keys
 
-		secret, err := r.SecretMake(&vaultSecret, secData)
+		r.markRotated(&vaultSecret, secret)
+
+		logger.Info("deploying a new child Secret", "secret", secret.Name)
+		err = r.writeSecret(ctx, &vaultSecret, secret, true)
 		if err != nil {
-			log.Log.Error(err, "Failed to generate a Secret resource for the "+secret.Name)
+			logger.Error(err, "failed to deploy the child Secret", "secret", secret.Name)
 			return ctrl.Result{}, err
 		}
 
-		log.Log.Info("deploying a new child Secret: " + secret.Name + " at " + secret.Namespace + " namespace")
-		err = r.Client.Create(ctx, secret)
-		if err != nil {
-			log.Log.Error(err, "failed to deploy a child Secret "+secret.Name+" at "+secret.Namespace+" namespace")
+		if err := r.applyChunks(ctx, &vaultSecret, chunks, nil); err != nil {
+			logger.Error(err, "failed to deploy the child Secret chunks", "secret", secret.Name)
+			return ctrl.Result{}, err
+		}
+		if err := r.syncSplits(ctx, &vaultSecret, rendered.splits); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Event(&vaultSecret, core.EventTypeNormal, "Created", fmt.Sprintf("created the Secret %s with %d keys", secret.Name, keys))
+		if err := r.syncCopies(ctx, &vaultSecret, secret); err != nil {
 			return ctrl.Result{}, err
 		}
 
 		// Child Secret is created successfully, return and requeue
-		return ctrl.Result{Requeue: true}, nil
+		return r.recordSync(ctx, &vaultSecret, secret, keys, ctrl.Result{Requeue: true})
 	}
 
-	return ctrl.Result{}, nil
-}
+	// Refuse to overwrite a Secret we don't manage unless asked to adopt it,
+	// by the VaultSecret or the Secret itself. The Secrets controlled by
+	// another object are never adopted.
+	adopted := false
+	if !metav1.IsControlledBy(found, &vaultSecret) {
+		if owner := metav1.GetControllerOf(found); owner != nil {
+			msg := "Secret " + found.Name + " already exists and is controlled by the " + owner.Kind + " " + owner.Name
+			logger.Info("refusing to update the child Secret", "secret", found.Name, "reason", msg)
+			return ctrl.Result{}, r.setStatusCondition(ctx, &vaultSecret, metav1.Condition{
+				Type:    conditionNameCollision,
+				Status:  metav1.ConditionTrue,
+				Reason:  "SecretControlled",
+				Message: msg,
+			})
+		}
+		if !vaultSecret.Spec.AdoptExisting && found.Annotations[adoptAnnotation] != "true" {
+			msg := "Secret " + found.Name + " already exists and is not managed by this VaultSecret, " +
+				"set adoptExisting or annotate the Secret with " + adoptAnnotation + "=true to adopt it"
+			logger.Info("refusing to update the child Secret", "secret", found.Name, "reason", msg)
+			return ctrl.Result{}, r.setStatusCondition(ctx, &vaultSecret, metav1.Condition{
+				Type:    conditionNameCollision,
+				Status:  metav1.ConditionTrue,
+				Reason:  "SecretNotOwned",
+				Message: msg,
+			})
+		}
 
-// newVaultClient returns initialized Vault client
-func (r *VaultSecretReconciler) newVaultClient(vaultConfig VaultConfig) (*vaultapi.Client, error) {
-	clientConfig := vaultapi.DefaultConfig()
-	if clientConfig.Error != nil {
-		return nil, clientConfig.Error
+		logger.Info("adopting the existing Secret", "secret", found.Name)
+		if err := ctrl.SetControllerReference(&vaultSecret, found, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+		// The keys already in the adopted Secret aren't ours, the ones the
+		// Vault doesn't provide are kept
+		if _, ok := found.Annotations[managedKeysAnnotation]; !ok {
+			metav1.SetMetaDataAnnotation(&found.ObjectMeta, managedKeysAnnotation, "")
+		}
+		adopted = true
 	}
 
-	clientConfig.Address = vaultConfig.Addr
+	if meta.IsStatusConditionTrue(vaultSecret.Status.Conditions, conditionNameCollision) {
+		err := r.setStatusCondition(ctx, &vaultSecret, metav1.Condition{
+			Type:    conditionNameCollision,
+			Status:  metav1.ConditionFalse,
+			Reason:  "SecretOwned",
+			Message: "Secret " + found.Name + " is managed by this VaultSecret",
+		})
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
-	tlsConfig := vaultapi.TLSConfig{Insecure: vaultConfig.SkipVerify}
-	err := clientConfig.ConfigureTLS(&tlsConfig)
+	// Revoke the replaced leases once their overlap window has ended
+	revokeAt, err := r.revokeDueLeases(ctx, config, &vaultSecret, found)
 	if err != nil {
-		return nil, err
+		return ctrl.Result{}, err
 	}
 
-	return vaultapi.NewClient(clientConfig)
-}
+	// Leased credentials are renewed rather than read again while they can be,
+	// unless a new force-sync value asks for a fresh read
+	forced := forceSyncPending(&vaultSecret)
+	var renewAt time.Time
+	renewed := false
+	if !forced {
+		renewAt, renewed, err = r.renewLease(ctx, config, &vaultSecret, found)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if renewed {
+		if err := r.syncCopies(ctx, &vaultSecret, found); err != nil {
+			return ctrl.Result{}, err
+		}
+		return r.recordSync(ctx, &vaultSecret, found, vaultSecret.Status.DataKeys, r.scheduleResult(ctrl.Result{}, earliest(renewAt, revokeAt)))
+	}
 
-// VaultReadSecret reads secret data from the Vault server
-func (r *VaultSecretReconciler) VaultReadSecret(vaultConfig VaultConfig) (*vaultapi.Secret, error) {
-	log.Log.Info("fetching Vault secret '" + vaultConfig.Path + "' from the " + vaultConfig.Addr)
+	// Child Secret exists, refresh it only when the tracked data has changed.
+	// After a spec change it's read again from the new spec.
+	if specChanged(&vaultSecret) {
+		logger.Info("the spec changed, reading the Vault data again", "generation", vaultSecret.Generation, "syncedGeneration", vaultSecret.Status.SyncedGeneration)
+	}
+	rendered, result, err := r.renderSecret(ctx, reader, config, &vaultSecret, found)
+	if rendered == nil || err != nil {
+		return result, err
+	}
+	secret, chunks, keys := rendered.secret, rendered.chunks, rendered.keys
 
-	client, err := r.newVaultClient(vaultConfig)
+	// The type of a Secret is immutable, the Secret is replaced instead
+	if found.Type != secret.Type {
+		logger.Info("replacing the child Secret of another type", "secret", found.Name, "type", found.Type, "newType", secret.Type)
+		if err := r.Client.Delete(ctx, found); err != nil {
+			logger.Error(err, "failed to delete the child Secret", "secret", found.Name)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	rotate, next, err := r.rotationDue(&vaultSecret, found)
 	if err != nil {
-		return nil, err
+		logger.Error(err, "can't parse the ForceRotateSchedule", "schedule", vaultSecret.Spec.ForceRotateSchedule)
+		return ctrl.Result{}, err
 	}
 
-	if vaultConfig.AuthMethod != defaultJWTAuthMethod {
-		return nil, errors.New("unsupported Auth method: " + vaultConfig.AuthMethod)
+	next = earliest(next, secretLeaseRenewAt(secret))
+	hash := secret.Annotations[dataHashAnnotation]
+	if !adopted && !rotate && !forced && found.Annotations[dataHashAnnotation] == hash && !sourceChanged(found, secret) &&
+		!templateMetadataChanged(&vaultSecret, found) && !dataDrifted(ctx, &vaultSecret, found) && isImmutable(found) == isImmutable(secret) {
+		if err := r.syncSplits(ctx, &vaultSecret, rendered.splits); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.syncCopies(ctx, &vaultSecret, secret); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.rollOut(ctx, &vaultSecret, hash, false); err != nil {
+			return ctrl.Result{}, err
+		}
+		return r.recordSync(ctx, &vaultSecret, secret, keys, r.scheduleResult(r.refreshResult(&vaultSecret, specChanged(&vaultSecret)), earliest(next, revokeAt)))
+	}
+
+	if found.Annotations == nil {
+		found.Annotations = map[string]string{}
 	}
+	changed := found.Annotations[dataHashAnnotation] != hash
+	// Only the keys written by the operator are replaced, read before the
+	// annotations are
+	data := mergeManagedData(found, secret.Data)
+	diff := secretDataDiff(managedData(found), secret.Data)
 
-	jwtFile := defaultJWTFile
-	if file := os.Getenv("KUBERNETES_SERVICE_ACCOUNT_TOKEN"); file != "" {
-		jwtFile = file
-	} else if file := os.Getenv("VAULT_JWT_FILE"); file != "" {
-		jwtFile = file
+	// The data of an immutable Secret can't change and it can't be made
+	// mutable again, the Secret is recreated instead
+	if isImmutable(found) && (!isImmutable(secret) || !equality.Semantic.DeepEqual(found.Data, data)) {
+		return r.recreateSecret(ctx, &vaultSecret, found, rendered, data, diff, changed, earliest(next, revokeAt))
 	}
+	previousChunks := recordedChunks(found)
+	if _, ok := secret.Annotations[chunksAnnotation]; !ok {
+		delete(found.Annotations, chunksAnnotation)
+	}
+	for k := range found.Annotations {
+		if _, ok := secret.Annotations[k]; !ok && (isProvenanceAnnotation(k) || isLeaseAnnotation(k)) {
+			delete(found.Annotations, k)
+		}
+	}
+	revokeAt = earliest(revokeAt, r.overlapLease(ctx, config, &vaultSecret, found, secret))
+	for k, v := range secret.Annotations {
+		found.Annotations[k] = v
+	}
+	for k, v := range secret.Labels {
+		if found.Labels == nil {
+			found.Labels = map[string]string{}
+		}
+		found.Labels[k] = v
+	}
+	r.markRotated(&vaultSecret, found)
+	found.Data = data
+	found.Immutable = secret.Immutable
+
+	logger.Info("updating the child Secret", "secret", found.Name)
+	if err := r.writeSecret(ctx, &vaultSecret, found, false); err != nil {
+		logger.Error(err, "failed to update the child Secret", "secret", found.Name)
+		return ctrl.Result{}, err
+	}
+
+	if err := r.applyChunks(ctx, &vaultSecret, chunks, previousChunks); err != nil {
+		logger.Error(err, "failed to update the child Secret chunks", "secret", found.Name)
+		return ctrl.Result{}, err
+	}
+	if err := r.syncSplits(ctx, &vaultSecret, rendered.splits); err != nil {
+		return ctrl.Result{}, err
+	}
+	switch {
+	case rotate:
+		r.Recorder.Event(&vaultSecret, core.EventTypeNormal, "Rotated", "forced by the ForceRotateSchedule, "+diff)
+	case forced:
+		r.Recorder.Event(&vaultSecret, core.EventTypeNormal, "ForceSynced", "forced by the "+forceSyncAnnotation+" annotation, "+diff)
+	default:
+		r.Recorder.Event(&vaultSecret, core.EventTypeNormal, "Updated", diff)
+	}
+	if err := r.syncCopies(ctx, &vaultSecret, secret); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.rollOut(ctx, &vaultSecret, hash, changed); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return r.recordSync(ctx, &vaultSecret, secret, keys, r.scheduleResult(r.refreshResult(&vaultSecret, true), earliest(next, revokeAt)))
+}
+
+// renderedSecret is a child Secret rendered from the Vault data
+type renderedSecret struct {
+	secret *core.Secret
+	chunks []*core.Secret
+
+	// splits are the Secrets of the Split of the VaultSecret
+	splits []*core.Secret
+
+	// keys is the number of keys of the data, chunks included
+	keys int
+}
 
-	// TODO: SA JWTs do expire, the reading logic should be moved into the loop
-	jwt, err := ioutil.ReadFile(jwtFile)
+// renderSecret reads the Vault data of the VaultSecret and renders its child
+// Secret, for both the create and the update paths. The found Secret is nil
+// on create. A nil rendered Secret ends the reconcile with the result.
+func (r *VaultSecretReconciler) renderSecret(ctx context.Context, reader SecretReader, config VaultConfig, vs *appsv1.VaultSecret, found *core.Secret) (*renderedSecret, ctrl.Result, error) {
+	secData, err := reader.ReadSecret(config)
+	if err == nil && found != nil {
+		var wait time.Duration
+		if wait, err = r.confirmRotation(ctx, vs, found, secData); err == nil && wait > 0 {
+			return nil, ctrl.Result{RequeueAfter: wait}, nil
+		}
+	}
+	if errors.Is(err, errLoginThrottled) {
+		log.FromContext(ctx).Info("Vault logins are throttled, requeueing", "after", loginRetryInterval.String())
+		return nil, ctrl.Result{RequeueAfter: loginRetryInterval}, nil
+	}
 	if err != nil {
-		return nil, err
+		log.FromContext(ctx).Error(err, "can't read the data from the Vault")
+		return nil, ctrl.Result{}, err
+	}
+	if missing, err := r.checkOptionalPath(ctx, config, vs, secData); missing || err != nil {
+		return nil, r.refreshResult(vs, false), err
 	}
 
-	loginData := map[string]interface{}{
-		"jwt":  string(jwt),
-		"role": vaultConfig.Role,
+	if err := checkEmptyRead(vs, found, secData); err != nil {
+		log.FromContext(ctx).Error(err, "refusing to clear the child Secret")
+		return nil, ctrl.Result{}, err
 	}
 
-	secret, err := client.Logical().Write(fmt.Sprintf("auth/%s/login", vaultConfig.AuthPath), loginData)
+	secret, err := r.makeSecret(ctx, reader, config, vs, secData)
+	if err := r.checkMissingKeys(ctx, vs, err); err != nil {
+		return nil, ctrl.Result{}, err
+	}
 	if err != nil {
-		log.Log.Error(err, "failed to authenticate")
-		return nil, err
+		log.FromContext(ctx).Error(err, "failed to generate the child Secret")
+		return nil, ctrl.Result{}, err
 	}
 
-	client.SetToken(secret.Auth.ClientToken)
-	data, err := client.Logical().Read(vaultConfig.Path)
+	if err := checkSecretType(secret); err != nil {
+		return nil, ctrl.Result{}, err
+	}
+
+	if err := r.checkRotationDue(ctx, vs, secData); err != nil {
+		return nil, ctrl.Result{}, err
+	}
+
+	if err := r.checkNesting(ctx, vs, secData); err != nil {
+		return nil, ctrl.Result{}, err
+	}
+
+	if ok, err := r.checkEnvKeys(ctx, vs, secret); !ok || err != nil {
+		return nil, ctrl.Result{}, err
+	}
+
+	splits, err := r.splitSecrets(vs, secret)
 	if err != nil {
-		log.Log.Error(err, "can't read secret '"+vaultConfig.Path+"' from the Vault")
-		return nil, err
+		log.FromContext(ctx).Error(err, "can't split the child Secret")
+		return nil, ctrl.Result{}, err
 	}
 
-	return data, nil
+	keys := len(secret.Data)
+	chunks, ok, err := r.chunkSecret(ctx, vs, secret)
+	if !ok || err != nil {
+		return nil, ctrl.Result{}, err
+	}
+	setManagedKeys(secret)
+
+	return &renderedSecret{secret: secret, chunks: chunks, splits: splits, keys: keys}, ctrl.Result{}, nil
 }
 
-// SecretMake returns a Secret object with predefined name and values provided
-func (r *VaultSecretReconciler) SecretMake(es *appsv1.VaultSecret, secret *vaultapi.Secret) (*core.Secret, error) {
-	secObjData := map[string][]byte{}
-	if secret != nil {
-		for k, v := range secret.Data {
-			if k == "data" {
-				for kk, vv := range v.(map[string]interface{}) {
-					secObjData[kk] = []byte(vv.(string))
-				}
-			}
+// checkOptionalPath reports whether the Path of an Optional VaultSecret is
+// missing from the Vault, the read returning nothing, recording it in the
+// PathMissing condition. The Secret isn't written then, an existing one is
+// left as is.
+func (r *VaultSecretReconciler) checkOptionalPath(ctx context.Context, config VaultConfig, vs *appsv1.VaultSecret, secData *vaultapi.Secret) (bool, error) {
+	if !vs.Spec.Optional {
+		return false, nil
+	}
+
+	if secData == nil {
+		log.FromContext(ctx).Info("the optional Vault path doesn't exist, leaving the Secret out")
+		return true, r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionPathMissing,
+			Status:  metav1.ConditionTrue,
+			Reason:  "OptionalPathMissing",
+			Message: "the optional Vault path " + config.Path + " doesn't exist, the Secret isn't written",
+		})
+	}
+	if meta.IsStatusConditionTrue(vs.Status.Conditions, conditionPathMissing) {
+		return false, r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionPathMissing,
+			Status:  metav1.ConditionFalse,
+			Reason:  "PathFound",
+			Message: "the Vault path exists",
+		})
+	}
+
+	return false, nil
+}
+
+// checkEmptyRead fails with an emptySecretError when the Vault secret has no
+// data while the child Secret has some and PreserveOnEmpty is on. A missing
+// child Secret is still created, there's nothing to preserve.
+func checkEmptyRead(vs *appsv1.VaultSecret, found *core.Secret, secData *vaultapi.Secret) error {
+	if !vs.Spec.PreservesOnEmpty() || found == nil || len(found.Data) == 0 {
+		return nil
+	}
+	// The parse errors are left to makeSecret
+	kv, err := parseVaultSecret(vs, secData)
+	if err != nil || len(kv.Data) > 0 {
+		return nil
+	}
+
+	return &emptySecretError{}
+}
+
+// vaultSecretPath returns the Vault path to read for the VaultSecret. The
+// namespace the kubernetes auth backend binds policies to comes from the
+// ServiceAccount token itself, so the templated path only has to agree with it.
+// The path of a VaultSecret listing a PathPrefix is the prefix, a Path holding
+// a Go template is rendered.
+func vaultSecretPath(vs *appsv1.VaultSecret) (string, error) {
+	if vs.Spec.PathPrefix != "" {
+		return vs.Spec.PathPrefix, nil
+	}
+	if vs.Spec.PathTemplate == "" {
+		return renderPath(vs)
+	}
+
+	return strings.NewReplacer(
+		"{{namespace}}", vs.Namespace,
+		"{{name}}", vs.Name,
+	).Replace(vs.Spec.PathTemplate), nil
+}
+
+// resolveRole returns the Vault role of the VaultSecret. When the spec doesn't
+// set one, it's taken from the role annotation of the referenced ServiceAccount
+// or, without a reference, the DefaultRole or the role annotation of the
+// operator's ServiceAccount.
+func (r *VaultSecretReconciler) resolveRole(ctx context.Context, vs *appsv1.VaultSecret) (string, error) {
+	if vs.Spec.Role != "" {
+		return vs.Spec.Role, nil
+	}
+	if vs.Spec.ServiceAccountName == "" && r.DefaultRole != "" {
+		return r.DefaultRole, nil
+	}
+
+	key := r.ServiceAccount
+	if vs.Spec.ServiceAccountName != "" {
+		key = types.NamespacedName{Name: vs.Spec.ServiceAccountName, Namespace: vs.Namespace}
+	}
+	if key.Name == "" {
+		return "", errors.New("no Vault role set and no ServiceAccount to look it up")
+	}
+
+	sa := &core.ServiceAccount{}
+	if err := r.Get(ctx, key, sa); err != nil {
+		return "", err
+	}
+
+	role := sa.Annotations[roleAnnotation]
+	if role == "" {
+		return "", errors.New("ServiceAccount " + key.String() + " has no " + roleAnnotation + " annotation")
+	}
+
+	return role, nil
+}
+
+// setStatusCondition records the condition in the VaultSecret status. The status
+// is only written when the condition actually changes.
+func (r *VaultSecretReconciler) setStatusCondition(ctx context.Context, vs *appsv1.VaultSecret, condition metav1.Condition) error {
+	current := meta.FindStatusCondition(vs.Status.Conditions, condition.Type)
+	if current != nil && current.Status == condition.Status &&
+		current.Reason == condition.Reason && current.Message == condition.Message {
+		return nil
+	}
+
+	condition.ObservedGeneration = vs.Generation
+	meta.SetStatusCondition(&vs.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, vs); err != nil {
+		log.FromContext(ctx).Error(err, "failed to update the status", "condition", condition.Type)
+		return err
+	}
+
+	return nil
+}
+
+// setEffectiveConfig records the resolved Vault config in the VaultSecret
+// status. The status is only written when the config actually changes.
+func (r *VaultSecretReconciler) setEffectiveConfig(ctx context.Context, vs *appsv1.VaultSecret, config VaultConfig) error {
+	backend := vs.Spec.Backend
+	if backend == "" {
+		backend = defaultBackend
+	}
+
+	effective := &appsv1.EffectiveConfig{
+		VaultAddress:        config.Addr,
+		ReadAddress:         config.ReadAddr,
+		VaultNamespace:      config.VaultNamespace,
+		AuthMethod:          config.AuthMethod,
+		AuthPath:            config.AuthPath,
+		Role:                config.Role,
+		Path:                config.Path,
+		Backend:             backend,
+		RefreshInterval:     &metav1.Duration{Duration: refreshInterval(vs)},
+		PostRotationDelay:   vs.Spec.PostRotationDelay,
+		ForceRotateSchedule: vs.Spec.ForceRotateSchedule,
+	}
+	if equality.Semantic.DeepEqual(vs.Status.EffectiveConfig, effective) {
+		return nil
+	}
+
+	vs.Status.EffectiveConfig = effective
+	if err := r.Status().Update(ctx, vs); err != nil {
+		log.FromContext(ctx).Error(err, "failed to update the effective config status")
+		return err
+	}
+
+	return nil
+}
+
+// vaultConfig returns the Vault config of the VaultSecret, the connection
+// settings may come from the ConfigRef and the ConnectionRef
+func (r *VaultSecretReconciler) vaultConfig(ctx context.Context, vs *appsv1.VaultSecret) (VaultConfig, error) {
+	spec, tlsNamespace, err := r.connectionSpec(ctx, vs)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "can't read the connection settings of the ConfigRef or the ConnectionRef")
+		return VaultConfig{}, err
+	}
+	config := VaultConfig{}
+	config.Addr = stringOr(spec.VaultAddress, r.DefaultVaultAddress)
+	config.ReadAddr = vs.Spec.ReadAddress
+	config.VaultNamespace = stringOr(spec.VaultNamespace, os.Getenv(vaultapi.EnvVaultNamespace))
+	config.ReadRetries = vs.Spec.ReadRetries
+	if config.ReadRetries == 0 {
+		config.ReadRetries = r.DefaultReadRetries
+	}
+	config.RetryDelay = r.DefaultRetryDelay
+	if vs.Spec.RetryDelay != nil {
+		config.RetryDelay = vs.Spec.RetryDelay.Duration
+	}
+	config.Namespace = vs.Namespace
+	config.TLSSecret = spec.TLSSecret
+	config.TLSNamespace = tlsNamespace
+	config.TLSServerName = spec.TLSServerName
+	config.ClientCertSecret = vs.Spec.ClientCertSecret
+	if vs.Spec.ClientTimeout != nil {
+		config.ClientTimeout = vs.Spec.ClientTimeout.Duration
+	}
+	// A Path that can't be rendered doesn't hold the finalizer
+	path, pathErr := vaultSecretPath(vs)
+	if pathErr != nil && vs.DeletionTimestamp.IsZero() {
+		log.FromContext(ctx).Error(pathErr, "can't render the Vault path")
+		return VaultConfig{}, pathErr
+	}
+	config.Path = path
+	config.KVVersion = vs.Spec.KVVersion
+
+	config.AuthMethod = spec.AuthMethodOrDefault()
+	method, ok := authenticator(config.AuthMethod)
+	if !ok {
+		err := errors.New("unsupported Auth method: " + config.AuthMethod)
+		log.FromContext(ctx).Error(err, "can't select the Vault auth method")
+		return VaultConfig{}, err
+	}
+	if method.UsesRole() {
+		config.Role = spec.Role
+	}
+	if method.UsesRole() && config.Role == "" {
+		role, err := r.resolveRole(ctx, vs)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "can't resolve the Vault role")
+			return VaultConfig{}, err
 		}
+		config.Role = role
 	}
+	config.AuthSecret = vs.Spec.SecretRef
+	config.JWTPath = vs.Spec.JWTPath
+	if vs.Spec.Audience != "" {
+		config.Audience = vs.Spec.Audience
+		config.ServiceAccount = r.ServiceAccount
+		if vs.Spec.ServiceAccountName != "" {
+			config.ServiceAccount = types.NamespacedName{Name: vs.Spec.ServiceAccountName, Namespace: vs.Namespace}
+		}
+	}
+	config.TokenPath = vs.Spec.TokenPath
+	config.Unwrap = vs.Spec.Unwrap
+	config.AuthPath = spec.AuthPathOrDefault()
 
-	s := &core.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      es.Name,
-			Namespace: es.Namespace,
-			Annotations: map[string]string{
-				es.APIVersion: es.Kind,
-			},
-		},
+	return config, nil
+}
 
-		Data: secObjData,
+// bypassCache handles the one-shot bypass-cache annotation: the cached token
+// of the VaultSecret is dropped, so that the coming read does a fresh login.
+// The annotation is only removed by clearBypassCache once the sync succeeded,
+// a failed read bypasses the cache again on the retry.
+func (r *VaultSecretReconciler) bypassCache(ctx context.Context, vs *appsv1.VaultSecret, config VaultConfig) {
+	if vs.Annotations[bypassCacheAnnotation] == "true" {
+		log.FromContext(ctx).Info("bypassing the Vault token cache")
+		r.tokens.invalidate(configTokenKey(config))
 	}
+}
 
-	// establish ownership to make it deleted with the ExtSecret
-	ctrl.SetControllerReference(es, s, r.Scheme)
-	return s, nil
+// clearBypassCache removes the bypass-cache annotation of the VaultSecret
+// after a successful sync
+func (r *VaultSecretReconciler) clearBypassCache(ctx context.Context, vs *appsv1.VaultSecret) error {
+	if _, ok := vs.Annotations[bypassCacheAnnotation]; !ok {
+		return nil
+	}
+
+	patch := client.MergeFrom(vs.DeepCopy())
+	delete(vs.Annotations, bypassCacheAnnotation)
+	if err := r.Patch(ctx, vs, patch); err != nil {
+		log.FromContext(ctx).Error(err, "failed to remove the bypass-cache annotation")
+		return err
+	}
+
+	return nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
-func (r *VaultSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&appsv1.VaultSecret{}).
-		Complete(r)
+// forceSyncPending reports whether the force-sync annotation of the
+// VaultSecret holds a value no sync was forced by yet
+func forceSyncPending(vs *appsv1.VaultSecret) bool {
+	value, ok := vs.Annotations[forceSyncAnnotation]
+
+	return ok && value != vs.Status.ForceSyncedValue
+}
+
+// newVaultClient returns initialized Vault client
+func (r *VaultSecretReconciler) newVaultClient(ctx context.Context, vaultConfig VaultConfig) (*vaultapi.Client, error) {
+	clientConfig := vaultapi.DefaultConfig()
+	if clientConfig.Error != nil {
+		return nil, clientConfig.Error
+	}
+
+	clientConfig.Address = vaultConfig.Addr
+	// The clones for the replica reads and the renewals keep the namespace
+	clientConfig.CloneHeaders = true
+	clientConfig.Timeout = defaultClientTimeout
+	if vaultConfig.ClientTimeout > 0 {
+		clientConfig.Timeout = vaultConfig.ClientTimeout
+	}
+
+	tlsConfig := vaultapi.TLSConfig{Insecure: vaultConfig.SkipVerify, TLSServerName: vaultConfig.TLSServerName}
+	err := clientConfig.ConfigureTLS(&tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if vaultConfig.TLSSecret != "" {
+		pool, err := r.tlsSecretCAs(ctx, vaultConfig)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+	}
+	if vaultConfig.ClientCertSecret != "" {
+		cert, err := r.clientCertificate(ctx, vaultConfig)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// The TLS setup expects the default transport, it's wrapped afterwards
+	if r.MaxVaultResponseBytes > 0 {
+		clientConfig.HttpClient.Transport = &limitTransport{
+			next: clientConfig.HttpClient.Transport,
+			max:  r.MaxVaultResponseBytes,
+		}
+	}
+	if limiter := r.limiter.get(r.VaultQPS, r.VaultBurst); limiter != nil {
+		clientConfig.HttpClient.Transport = &rateLimitTransport{
+			next:    clientConfig.HttpClient.Transport,
+			limiter: limiter,
+		}
+	}
+
+	client, err := vaultapi.NewClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	if vaultConfig.VaultNamespace != "" {
+		client.SetNamespace(vaultConfig.VaultNamespace)
+	}
+	if r.ForwardToActive {
+		client.AddHeader(forwardHeader, forwardActiveNode)
+	}
+
+	return client, nil
+}
+
+// tlsSecretCAs returns the CA bundle of the ca.crt key of the TLSSecret, in
+// place of the system roots
+func (r *VaultSecretReconciler) tlsSecretCAs(ctx context.Context, vaultConfig VaultConfig) (*x509.CertPool, error) {
+	selector := core.SecretKeySelector{LocalObjectReference: core.LocalObjectReference{Name: vaultConfig.TLSSecret}, Key: tlsSecretCAKey}
+	namespace := stringOr(vaultConfig.TLSNamespace, vaultConfig.Namespace)
+	ca, err := r.secretKeyValue(ctx, namespace, "TLS Secret", selector)
+	if err != nil {
+		return nil, err
+	}
+	name := types.NamespacedName{Name: vaultConfig.TLSSecret, Namespace: namespace}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("the %s key of the TLS Secret %s holds no PEM certificate", tlsSecretCAKey, name)
+	}
+
+	return pool, nil
+}
+
+// clientCertificate returns the client certificate of the tls.crt and tls.key
+// keys of the ClientCertSecret, presented to a Vault requiring mutual TLS
+func (r *VaultSecretReconciler) clientCertificate(ctx context.Context, vaultConfig VaultConfig) (tls.Certificate, error) {
+	secret, err := r.referencedSecret(ctx, vaultConfig.Namespace, "client certificate Secret", vaultConfig.ClientCertSecret)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	name := types.NamespacedName{Name: vaultConfig.ClientCertSecret, Namespace: vaultConfig.Namespace}
+
+	for _, key := range []string{core.TLSCertKey, core.TLSPrivateKeyKey} {
+		if _, ok := secret.Data[key]; !ok {
+			return tls.Certificate{}, fmt.Errorf("the client certificate Secret %s has no %s key", name, key)
+		}
+	}
+	cert, err := tls.X509KeyPair(secret.Data[core.TLSCertKey], secret.Data[core.TLSPrivateKeyKey])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("the client certificate Secret %s holds no key pair: %w", name, err)
+	}
+
+	return cert, nil
+}
+
+// VaultReadSecret reads secret data from the Vault server
+func (r *VaultSecretReconciler) VaultReadSecret(ctx context.Context, vaultConfig VaultConfig) (*vaultapi.Secret, error) {
+	ctx, span := tracer.Start(ctx, "vault.read_secret", trace.WithAttributes(
+		attribute.String("vault.address", vaultConfig.Addr),
+		attribute.String("vault.path", vaultConfig.Path),
+	))
+	secret, err := r.vaultReadSecret(ctx, vaultConfig)
+	endSpan(span, err)
+
+	return secret, err
+}
+
+// vaultReadSecret is the VaultReadSecret within its span, the logins and the
+// reads nesting their own
+func (r *VaultSecretReconciler) vaultReadSecret(ctx context.Context, vaultConfig VaultConfig) (*vaultapi.Secret, error) {
+	logger := log.FromContext(ctx).WithValues("vaultAddr", vaultConfig.Addr, "path", vaultConfig.Path)
+	logger.Info("fetching the Vault secret")
+
+	client, err := r.newVaultClient(ctx, vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := authenticator(vaultConfig.AuthMethod); !ok {
+		return nil, errors.New("unsupported Auth method: " + vaultConfig.AuthMethod)
+	}
+
+	// The retries of the logins and reads replace the ones of the Vault
+	// client
+	if vaultConfig.ReadRetries > 0 {
+		client.SetMaxRetries(0)
+	}
+
+	key := configTokenKey(vaultConfig)
+	login := r.loginFunc(ctx, client, vaultConfig)
+
+	readClient := client
+	if vaultConfig.ReadAddr != "" {
+		logger.Info("reading the Vault secret from the replica", "readAddr", vaultConfig.ReadAddr)
+		if readClient, err = client.Clone(); err != nil {
+			return nil, err
+		}
+		if err := readClient.SetAddress(vaultConfig.ReadAddr); err != nil {
+			return nil, err
+		}
+		headers := readClient.Headers()
+		headers.Del(forwardHeader)
+		readClient.SetHeaders(headers)
+	}
+	logical := r.vaultLogical(readClient)
+
+	// detected is the KVVersion of the mount looked up for the auto
+	// KVVersion, empty when unknown
+	var detected string
+
+	// Every read takes a token use of its own, so that a num_uses limited
+	// token is replaced by a new login once spent
+	read := func() (*vaultapi.Secret, error) {
+		// The paths of KV v2 mounts missing their data/ segment are read
+		// with it
+		switch vaultConfig.KVVersion {
+		case kvVersion1:
+		case kvVersionAuto:
+			mount, err := r.kvMount(ctx, logical, vaultConfig, key, login)
+			if err != nil {
+				return nil, err
+			}
+			detected = mount.version
+			vaultConfig.Path = mount.dataPath(ctx, vaultConfig.Path, vaultConfig.List)
+		default:
+			path, err := r.kvDataPath(ctx, logical, vaultConfig, key, login)
+			if err != nil {
+				return nil, err
+			}
+			vaultConfig.Path = path
+		}
+
+		token, cached, err := r.tokens.getOrLogin(key, login)
+		if err != nil {
+			return nil, err
+		}
+		logical.SetToken(token)
+		data, err := vaultRead(ctx, logical, vaultConfig)
+
+		// The cached token may have been revoked since, retry once with a new one
+		if cached && isPermissionDenied(err) {
+			logger.Info("the cached Vault token was denied, logging in again")
+			r.tokens.invalidate(key)
+			if token, _, err = r.tokens.getOrLogin(key, login); err != nil {
+				return nil, err
+			}
+			logical.SetToken(token)
+			data, err = vaultRead(ctx, logical, vaultConfig)
+		}
+
+		return data, err
+	}
+
+	data, err := readRetry(ctx, vaultConfig, read)
+	if err != nil {
+		logger.Error(err, "can't read the Vault secret")
+		return nil, err
+	}
+
+	// The wrapping tokens are single-use, the unwrap isn't retried
+	if vaultConfig.Unwrap && data != nil {
+		token, _, err := r.tokens.getOrLogin(key, login)
+		if err != nil {
+			return nil, err
+		}
+		logical.SetToken(token)
+		if data, err = r.unwrapSecret(ctx, logical, vaultConfig, data); err != nil {
+			logger.Error(err, "can't unwrap the Vault secret")
+			return nil, err
+		}
+	}
+
+	// The KV v1 payloads are parsed alike the KV v2 ones by the auto
+	// KVVersion, the unknown mounts are taken as KV v2 ones
+	if detected == kvVersion1 && !vaultConfig.List {
+		data = wrapKVv1(data)
+	}
+
+	return data, nil
+}
+
+// loginFunc returns the login of the token cache. A cached token due for a
+// renewal is renewed, otherwise it waits for a slot under MaxConcurrentLogins
+// and logs in. The token of a tokenReader is read instead, single-use so that
+// the cache doesn't keep it.
+func (r *VaultSecretReconciler) loginFunc(ctx context.Context, client *vaultapi.Client, vaultConfig VaultConfig) func() (vaultToken, error) {
+	return func() (vaultToken, error) {
+		method, _ := authenticator(vaultConfig.AuthMethod)
+		if reader, ok := method.(tokenReader); ok {
+			token, err := reader.ReadToken(ctx, r, vaultConfig)
+			if err != nil {
+				return vaultToken{}, &loginError{err: err}
+			}
+			return vaultToken{token: token, uses: 1}, nil
+		}
+
+		if token, ok := r.tokens.renewable(configTokenKey(vaultConfig)); ok {
+			renewed, err := r.renewToken(ctx, client, token)
+			if err == nil {
+				return renewed, nil
+			}
+			log.FromContext(ctx).Info("can't renew the Vault token, logging in again", "error", err.Error())
+		}
+
+		release, err := r.logins.acquire(r.MaxConcurrentLogins, loginWaitTimeout)
+		if err != nil {
+			return vaultToken{}, err
+		}
+		defer release()
+		loginCtx, span := tracer.Start(ctx, "vault.login", trace.WithAttributes(
+			attribute.String("vault.auth_method", vaultConfig.AuthMethod),
+			attribute.String("vault.auth_path", vaultConfig.AuthPath),
+		))
+		token, err := r.vaultLogin(loginCtx, client, vaultConfig)
+		endSpan(span, err)
+		if err == nil && token.renewable && token.uses == 0 {
+			r.tokens.remember(configTokenKey(vaultConfig), vaultConfig)
+		}
+		return token, err
+	}
+}
+
+// vaultLogin logs in to the Vault with the configured auth method and returns
+// the obtained token along with its lease and num_uses limit
+func (r *VaultSecretReconciler) vaultLogin(ctx context.Context, client *vaultapi.Client, vaultConfig VaultConfig) (vaultToken, error) {
+	method, ok := authenticator(vaultConfig.AuthMethod)
+	if !ok {
+		return vaultToken{}, errors.New("unsupported Auth method: " + vaultConfig.AuthMethod)
+	}
+
+	token, err := r.sendLogin(ctx, client, vaultConfig, method)
+	// The credentials may have gone stale since they were read, such as a
+	// rotated ServiceAccount JWT, retry once with fresh ones
+	if forgetter, ok := method.(credentialsForgetter); ok && isPermissionDenied(err) {
+		log.FromContext(ctx).Info("the Vault login was denied, retrying with fresh credentials", "authMethod", vaultConfig.AuthMethod)
+		forgetter.ForgetCredentials(r, vaultConfig)
+		token, err = r.sendLogin(ctx, client, vaultConfig, method)
+	}
+	if err != nil {
+		log.FromContext(ctx).Error(err, "failed to authenticate", "authMethod", vaultConfig.AuthMethod, "authPath", vaultConfig.AuthPath)
+		return vaultToken{}, &loginError{err: err}
+	}
+
+	return token, nil
+}
+
+// sendLogin sends a login request with the credentials of the auth method
+func (r *VaultSecretReconciler) sendLogin(ctx context.Context, client *vaultapi.Client, vaultConfig VaultConfig, method Authenticator) (vaultToken, error) {
+	loginData, err := method.LoginData(ctx, r, vaultConfig)
+	if err != nil {
+		return vaultToken{}, err
+	}
+
+	path := "auth/" + vaultConfig.AuthPath + "/login"
+	if pather, ok := method.(loginPather); ok {
+		path = "auth/" + vaultConfig.AuthPath + "/" + pather.LoginPath(loginData)
+	}
+
+	start := time.Now()
+	login, err := r.vaultLogical(client).Login(ctx, path, loginData)
+	loginDuration.WithLabelValues(metricsAuthMethod(vaultConfig.AuthMethod)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return vaultToken{}, err
+	}
+	if login.ClientToken == "" {
+		return vaultToken{}, errors.New("no token in the Vault login response")
+	}
+
+	return vaultToken{
+		token:     login.ClientToken,
+		ttl:       time.Duration(login.LeaseDuration) * time.Second,
+		uses:      login.NumUses,
+		renewable: login.Renewable,
+	}, nil
+}
+
+// renewToken extends the lease of the token with auth/token/renew-self
+func (r *VaultSecretReconciler) renewToken(ctx context.Context, client *vaultapi.Client, token string) (vaultToken, error) {
+	client, err := client.Clone()
+	if err != nil {
+		return vaultToken{}, err
+	}
+	logical := r.vaultLogical(client)
+	logical.SetToken(token)
+
+	secret, err := logical.Write(ctx, "auth/token/renew-self", nil)
+	if err != nil {
+		return vaultToken{}, err
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return vaultToken{}, errors.New("no token in the Vault renewal response")
+	}
+
+	return vaultToken{
+		token:     secret.Auth.ClientToken,
+		ttl:       time.Duration(secret.Auth.LeaseDuration) * time.Second,
+		renewable: secret.Auth.Renewable,
+	}, nil
+}
+
+// vaultRead reads the configured path, at the configured KV v2 version if any,
+// or lists it
+func vaultRead(ctx context.Context, logical VaultLogical, vaultConfig VaultConfig) (secret *vaultapi.Secret, err error) {
+	ctx, span := tracer.Start(ctx, "vault.read", trace.WithAttributes(attribute.String("vault.path", vaultConfig.Path)))
+	defer func() { endSpan(span, err) }()
+
+	// The LIST requests are sent as reads with the list parameter, as Vault
+	// takes both
+	if vaultConfig.List {
+		return logical.ReadWithData(ctx, vaultConfig.Path, map[string][]string{"list": {"true"}})
+	}
+	if vaultConfig.Version > 0 {
+		return logical.ReadWithData(ctx, vaultConfig.Path, map[string][]string{
+			"version": {strconv.Itoa(vaultConfig.Version)},
+		})
+	}
+
+	return logical.ReadWithData(ctx, vaultConfig.Path, nil)
+}
+
+// readRetry runs the read, its login included, retrying it up to ReadRetries
+// times RetryDelay apart on retryable errors
+func readRetry(ctx context.Context, vaultConfig VaultConfig, read func() (*vaultapi.Secret, error)) (*vaultapi.Secret, error) {
+	delay := vaultConfig.RetryDelay
+	if delay <= 0 {
+		delay = readRetryDelay
+	}
+
+	data, err := read()
+	for i := 0; i < vaultConfig.ReadRetries && isRetryable(err); i++ {
+		log.FromContext(ctx).Info("retrying the read of the Vault secret", "path", vaultConfig.Path, "attempt", i+1, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		data, err = read()
+	}
+
+	return data, err
+}
+
+// isRetryable reports whether a failed Vault request, a login or a read, may
+// succeed when sent again, that is on server side, rate limit and network
+// errors, and the 412 of the performance standbys not caught up with the
+// active node, which the retries of the Vault client cover as well. The
+// denied and missing ones fail right away.
+func isRetryable(err error) bool {
+	var respErr *vaultapi.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= http.StatusInternalServerError ||
+			respErr.StatusCode == http.StatusTooManyRequests ||
+			respErr.StatusCode == http.StatusPreconditionFailed
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// makeSecret renders the child Secret of the VaultSecret from the data read
+// from the Vault, including the version history and key transformation
+func (r *VaultSecretReconciler) makeSecret(ctx context.Context, reader SecretReader, config VaultConfig, es *appsv1.VaultSecret, secData *vaultapi.Secret) (*core.Secret, error) {
+	secret, err := r.SecretMake(ctx, es, secData)
+	if err != nil {
+		return nil, err
+	}
+	secret.Annotations[vaultAddressAnnotation] = config.Addr
+
+	prefix := es.Spec.KeyPrefix
+	if prefix != "" {
+		secret.Data = prefixKeys(secret.Data, prefix)
+	}
+	sources := provenance{}
+	sources.added(nil, secret.Data, func(k string) string { return config.Path + "#" + strings.TrimPrefix(k, prefix) })
+	if err := r.mergePaths(reader, config, es, secret.Data, sources); err != nil {
+		return nil, err
+	}
+	if es.Spec.Transit != nil {
+		if err := r.transitDecrypt(ctx, config, es.Spec.Transit, secret.Data); err != nil {
+			return nil, err
+		}
+	}
+	if len(es.Spec.Data) > 0 {
+		if secret.Data, err = projectKeys(secret.Data, es.Spec.Data, es.Spec.RequiresAllKeys()); err != nil {
+			return nil, err
+		}
+		origins := sources
+		sources = provenance{}
+		for _, mapping := range es.Spec.Data {
+			if _, ok := secret.Data[mapping.TargetKey()]; ok {
+				sources[mapping.TargetKey()] = origins[mapping.VaultKey]
+			}
+		}
+	}
+
+	if es.Spec.DropEmptyValues {
+		for k, v := range secret.Data {
+			if len(v) == 0 {
+				delete(secret.Data, k)
+			}
+		}
+	}
+
+	for _, key := range es.Spec.ExplodeKeys {
+		before := keySet(secret.Data)
+		if err := explodeKey(secret.Data, key); err != nil {
+			return nil, err
+		}
+		sources.added(before, secret.Data, func(string) string { return config.Path + "#" + key })
+	}
+
+	before := keySet(secret.Data)
+	if err := r.addVersionHistory(reader, config, es, secData, secret); err != nil {
+		return nil, err
+	}
+	sources.added(before, secret.Data, func(k string) string { return versionedSource(config.Path, k) })
+
+	if es.Spec.KeyTransform != "" {
+		if secret.Data, err = transformKeys(secret.Data, es.Spec.KeyTransform); err != nil {
+			return nil, err
+		}
+		sources = sources.renamed(envVarName)
+	}
+
+	if err := r.renderTemplates(ctx, es, secret.Data); err != nil {
+		return nil, err
+	}
+	for k := range es.Spec.Templates {
+		sources[k] = templateSource
+	}
+
+	if es.Spec.KubeconfigOutput != nil {
+		if err := renderKubeconfig(es.Spec.KubeconfigOutput, secret.Data); err != nil {
+			return nil, err
+		}
+		sources[stringOr(es.Spec.KubeconfigOutput.Key, appsv1.DefaultKubeconfigKey)] = config.Path
+	}
+
+	if es.Spec.Template != nil && len(es.Spec.Template.Data) > 0 {
+		if secret.Data, err = renderTemplateData(es.Spec.Template.Data, secret.Data); err != nil {
+			return nil, err
+		}
+		for k := range secret.Data {
+			sources[k] = templateSource
+		}
+	}
+
+	if es.Spec.DockerConfigOutput != nil {
+		if err := renderDockerConfig(es.Spec.DockerConfigOutput, secret); err != nil {
+			return nil, err
+		}
+		sources[core.DockerConfigJsonKey] = config.Path
+	}
+
+	if format := es.Spec.Format; format != nil {
+		var out []byte
+		if format.Type == "" || format.Type == appsv1.SecretFormatTemplate {
+			out, err = formatSecret(reader, config, format, secData)
+		} else {
+			out, err = encodeSecret(secret.Data, format.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		secret.Data = map[string][]byte{format.Key: out}
+		sources[format.Key] = config.Path
+	}
+
+	if key := es.Spec.IncludePathKey; key != "" {
+		if _, ok := secret.Data[key]; ok {
+			return nil, errors.New("the IncludePathKey " + key + " collides with a key of the Vault secret")
+		}
+		secret.Data[key] = []byte(config.Path)
+		sources[key] = config.Path
+	}
+
+	if es.Spec.IncludeProvenance {
+		sources.annotate(ctx, secret)
+	}
+
+	secret.Annotations[dataHashAnnotation] = secretDataHash(secret.Data, es.Spec.ChangeDetectionKeys)
+	return secret, nil
+}
+
+// secretTypeKeys are the keys required by the Secret types
+var secretTypeKeys = map[core.SecretType][]string{
+	core.SecretTypeTLS:              {core.TLSCertKey, core.TLSPrivateKeyKey},
+	core.SecretTypeDockerConfigJson: {core.DockerConfigJsonKey},
+	core.SecretTypeDockercfg:        {core.DockerConfigKey},
+	core.SecretTypeSSHAuth:          {core.SSHAuthPrivateKey},
+}
+
+// checkSecretType returns an error when the Secret lacks a key its type
+// requires, which the API server would reject
+func checkSecretType(secret *core.Secret) error {
+	for _, key := range secretTypeKeys[secret.Type] {
+		if _, ok := secret.Data[key]; !ok {
+			return fmt.Errorf("a %s Secret needs a %s key", secret.Type, key)
+		}
+	}
+
+	return nil
+}
+
+// checkEnvKeys reports whether the Secret keys are usable as environment
+// variable names when the VaultSecret asks for it, recording the outcome in
+// the InvalidEnvKey condition
+func (r *VaultSecretReconciler) checkEnvKeys(ctx context.Context, vs *appsv1.VaultSecret, secret *core.Secret) (bool, error) {
+	if !vs.Spec.ValidateEnvNames {
+		return true, nil
+	}
+
+	var invalid []string
+	for k := range secret.Data {
+		if !envNameRegexp.MatchString(k) {
+			invalid = append(invalid, k)
+		}
+	}
+
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		msg := "keys are not valid environment variable names: " + strings.Join(invalid, ",")
+		log.FromContext(ctx).Info("refusing to write the child Secret", "secret", secret.Name, "reason", msg)
+		return false, r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionInvalidEnvKey,
+			Status:  metav1.ConditionTrue,
+			Reason:  "InvalidKeyName",
+			Message: msg,
+		})
+	}
+
+	if meta.IsStatusConditionTrue(vs.Status.Conditions, conditionInvalidEnvKey) {
+		return true, r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionInvalidEnvKey,
+			Status:  metav1.ConditionFalse,
+			Reason:  "ValidKeyNames",
+			Message: "all keys are valid environment variable names",
+		})
+	}
+
+	return true, nil
+}
+
+// checkNesting reports extra "data" levels unwrapped from the Vault secret in
+// the UnexpectedNesting condition. The Secret is written regardless.
+func (r *VaultSecretReconciler) checkNesting(ctx context.Context, vs *appsv1.VaultSecret, secData *vaultapi.Secret) error {
+	kv, err := parseVaultSecret(vs, secData)
+	if err != nil {
+		return err
+	}
+	if depth := kv.Nesting; depth > 0 {
+		msg := "unwrapped " + strconv.Itoa(depth) + " nested data levels of the Vault secret, check the KV version of the path"
+		log.FromContext(ctx).Info(msg, "depth", depth)
+		return r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionUnexpectedNesting,
+			Status:  metav1.ConditionTrue,
+			Reason:  "NestedData",
+			Message: msg,
+		})
+	}
+
+	if meta.IsStatusConditionTrue(vs.Status.Conditions, conditionUnexpectedNesting) {
+		return r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionUnexpectedNesting,
+			Status:  metav1.ConditionFalse,
+			Reason:  "FlatData",
+			Message: "the Vault secret data isn't nested",
+		})
+	}
+
+	return nil
+}
+
+// projectKeys returns the keys of the mappings, renamed, decoded and
+// extracted. The keys missing from the data fail with a missingKeysError when
+// all of them are required, and are left out otherwise.
+func projectKeys(data map[string][]byte, mappings []appsv1.KeyMapping, requireAll bool) (map[string][]byte, error) {
+	var missing []string
+	for _, mapping := range mappings {
+		if _, ok := data[mapping.VaultKey]; !ok {
+			missing = append(missing, mapping.VaultKey)
+		}
+	}
+	if len(missing) > 0 && requireAll {
+		return nil, &missingKeysError{keys: missing}
+	}
+
+	projected := make(map[string][]byte, len(mappings))
+	for _, mapping := range mappings {
+		value, ok := data[mapping.VaultKey]
+		if !ok {
+			continue
+		}
+		if mapping.Decode == appsv1.KeyDecodeBase64 {
+			decoded, err := decodeBase64(value)
+			if err != nil {
+				return nil, fmt.Errorf("the mapped Vault key %s is not valid base64: %w", mapping.VaultKey, err)
+			}
+			value = decoded
+		}
+		if mapping.JSONPath != "" {
+			extracted, err := extractJSONPath(value, mapping.JSONPathTemplate())
+			if err != nil {
+				return nil, fmt.Errorf("can't extract %s from the mapped Vault key %s: %w", mapping.JSONPath, mapping.VaultKey, err)
+			}
+			value = extracted
+		}
+		projected[mapping.TargetKey()] = value
+	}
+
+	return projected, nil
+}
+
+// missingKeysError lists the mapped Vault keys missing from the Vault secret
+type missingKeysError struct {
+	keys []string
+}
+
+func (e *missingKeysError) Error() string {
+	if len(e.keys) == 1 {
+		return "the mapped Vault key " + e.keys[0] + " doesn't exist at the path"
+	}
+
+	return "the mapped Vault keys " + strings.Join(e.keys, ", ") + " don't exist at the path"
+}
+
+// checkMissingKeys reports the mapped Vault keys missing from the Vault secret
+// in the MissingKeys condition, from the error of makeSecret
+func (r *VaultSecretReconciler) checkMissingKeys(ctx context.Context, vs *appsv1.VaultSecret, err error) error {
+	var missingErr *missingKeysError
+	if errors.As(err, &missingErr) {
+		log.FromContext(ctx).Info("refusing to write the incomplete child Secret", "missingKeys", missingErr.keys)
+		return r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionMissingKeys,
+			Status:  metav1.ConditionTrue,
+			Reason:  "KeysMissing",
+			Message: "missing Vault keys: " + strings.Join(missingErr.keys, ","),
+		})
+	}
+
+	if err == nil && meta.IsStatusConditionTrue(vs.Status.Conditions, conditionMissingKeys) {
+		return r.setStatusCondition(ctx, vs, metav1.Condition{
+			Type:    conditionMissingKeys,
+			Status:  metav1.ConditionFalse,
+			Reason:  "AllKeysFound",
+			Message: "all the mapped Vault keys exist",
+		})
+	}
+
+	return nil
+}
+
+// decodeBase64 decodes the standard base64 value, wrapped over several lines
+// or not
+func decodeBase64(value []byte) ([]byte, error) {
+	stripped := bytes.Map(func(c rune) rune {
+		if unicode.IsSpace(c) {
+			return -1
+		}
+		return c
+	}, value)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(stripped)))
+	n, err := base64.StdEncoding.Decode(decoded, stripped)
+	if err != nil {
+		return nil, err
+	}
+
+	return decoded[:n], nil
+}
+
+// extractJSONPath returns the single value the JSONPath template matches in
+// the JSON document. Strings are returned as is, the other values as their
+// canonical JSON.
+func extractJSONPath(value []byte, template string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("the value is not JSON: %w", err)
+	}
+
+	path := jsonpath.New("jsonPath")
+	if err := path.Parse(template); err != nil {
+		return nil, err
+	}
+	results, err := path.FindResults(doc)
+	if err != nil {
+		return nil, err
+	}
+	var matches []interface{}
+	for _, result := range results {
+		for _, match := range result {
+			matches = append(matches, match.Interface())
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, errors.New("the expression matches no value")
+	case len(matches) > 1:
+		return nil, fmt.Errorf("the expression matches %d values", len(matches))
+	}
+
+	switch match := matches[0].(type) {
+	case string:
+		return []byte(match), nil
+	case json.Number:
+		return []byte(match.String()), nil
+	default:
+		return json.Marshal(match)
+	}
+}
+
+// explodeKey replaces the JSON object stored under key with one "<key>.<field>"
+// key per top-level field. String fields are stored as is, other values as
+// their JSON representation with sorted object keys, so that the output only
+// depends on the Vault data and not on its formatting.
+func explodeKey(data map[string][]byte, key string) error {
+	value, ok := data[key]
+	if !ok {
+		return errors.New("key to explode not found: " + key)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return fmt.Errorf("can't explode key %s, value is not a JSON object: %w", key, err)
+	}
+
+	delete(data, key)
+	for field, raw := range fields {
+		var str string
+		if err := json.Unmarshal(raw, &str); err == nil {
+			data[key+"."+field] = []byte(str)
+			continue
+		}
+
+		canonical, err := canonicalJSON(raw)
+		if err != nil {
+			return fmt.Errorf("can't explode key %s: %w", key, err)
+		}
+		data[key+"."+field] = canonical
+	}
+
+	return nil
+}
+
+// canonicalJSON re-encodes a JSON value compactly with sorted object keys.
+// Numbers are kept as written.
+func canonicalJSON(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// transformKeys renames the Secret keys according to the transform. Two keys
+// mapping to the same name are reported as an error.
+func transformKeys(data map[string][]byte, transform string) (map[string][]byte, error) {
+	if transform != keyTransformEnvVar {
+		return nil, errors.New("unsupported key transform: " + transform)
+	}
+
+	transformed := make(map[string][]byte, len(data))
+	for _, k := range sortedKeys(data) {
+		name := envVarName(k)
+		if _, ok := transformed[name]; ok {
+			return nil, errors.New("keys collide after the " + transform + " transform: " + name)
+		}
+		transformed[name] = data[k]
+	}
+
+	return transformed, nil
+}
+
+// envVarName upper-cases the key and replaces the characters not allowed in
+// environment variable names with underscores
+func envVarName(key string) string {
+	name := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z':
+			return c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			return c
+		default:
+			return '_'
+		}
+	}, key)
+
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// isImmutable reports whether the Secret is immutable
+func isImmutable(secret *core.Secret) bool {
+	return secret.Immutable != nil && *secret.Immutable
+}
+
+// recreateSecret replaces the immutable child Secret found with the rendered
+// one holding the data. The Secret is missing in between.
+func (r *VaultSecretReconciler) recreateSecret(ctx context.Context, vs *appsv1.VaultSecret, found *core.Secret, rendered *renderedSecret, data map[string][]byte, diff string, changed bool, next time.Time) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	secret, chunks, keys := rendered.secret, rendered.chunks, rendered.keys
+	previousChunks := recordedChunks(found)
+
+	logger.Info("recreating the immutable child Secret", "secret", found.Name)
+	if err := r.Client.Delete(ctx, found, client.Preconditions{UID: &found.UID}); err != nil && !apierrors.IsNotFound(err) {
+		logger.Error(err, "failed to delete the immutable child Secret", "secret", found.Name)
+		return ctrl.Result{}, err
+	}
+	r.markRotated(vs, secret)
+	secret.Data = data
+	if err := r.writeSecret(ctx, vs, secret, true); err != nil {
+		logger.Error(err, "failed to recreate the immutable child Secret", "secret", secret.Name)
+		return ctrl.Result{}, err
+	}
+
+	if err := r.applyChunks(ctx, vs, chunks, previousChunks); err != nil {
+		logger.Error(err, "failed to update the child Secret chunks", "secret", secret.Name)
+		return ctrl.Result{}, err
+	}
+	if err := r.syncSplits(ctx, vs, rendered.splits); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Event(vs, core.EventTypeNormal, "Recreated", "the immutable Secret was recreated, "+diff)
+	if err := r.syncCopies(ctx, vs, secret); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.rollOut(ctx, vs, secret.Annotations[dataHashAnnotation], changed); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return r.recordSync(ctx, vs, secret, keys, r.scheduleResult(r.refreshResult(vs, true), next))
+}
+
+// SecretMake returns a Secret object with predefined name and values provided
+func (r *VaultSecretReconciler) SecretMake(ctx context.Context, es *appsv1.VaultSecret, secret *vaultapi.Secret) (*core.Secret, error) {
+	kv, err := parseVaultSecret(es, secret)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range kv.Warnings {
+		log.FromContext(ctx).Info("Vault warning", "warning", warning)
+	}
+	secObjData, err := secretData(kv)
+	if err != nil {
+		return nil, err
+	}
+	path, err := vaultSecretPath(es)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      es.SecretNameOrDefault(),
+			Namespace: es.Namespace,
+			Annotations: map[string]string{
+				appsv1.GroupVersion.String(): "VaultSecret",
+				dataHashAnnotation:           secretDataHash(secObjData, es.Spec.ChangeDetectionKeys),
+				vaultPathAnnotation:          path,
+				vaultAddressAnnotation:       stringOr(es.Spec.VaultAddress, r.DefaultVaultAddress),
+			},
+		},
+
+		Data: secObjData,
+		Type: core.SecretTypeOpaque,
+	}
+	if es.Spec.SecretType != "" {
+		s.Type = core.SecretType(es.Spec.SecretType)
+	}
+	if es.Spec.Immutable {
+		immutable := true
+		s.Immutable = &immutable
+	}
+	applyTemplateMetadata(es, s)
+	setOwnerLabels(es, s)
+
+	if version, ok := kv.version(); ok {
+		s.Annotations[versionAnnotation] = strconv.Itoa(version)
+		if kv.Metadata.CreatedTime != "" {
+			s.Annotations[createdTimeAnnotation] = kv.Metadata.CreatedTime
+		}
+	}
+	if secret != nil && secret.LeaseID != "" {
+		r.setLease(s, secret)
+	}
+
+	// establish ownership to make it deleted with the ExtSecret
+	ctrl.SetControllerReference(es, s, r.Scheme)
+	return s, nil
+}
+
+// applyTemplateMetadata merges the labels and annotations of the Template
+// onto the Secret, leaving the reserved annotations alone
+func applyTemplateMetadata(vs *appsv1.VaultSecret, secret *core.Secret) {
+	if vs.Spec.Template == nil {
+		return
+	}
+
+	for k, v := range vs.Spec.Template.Metadata.Labels {
+		if secret.Labels == nil {
+			secret.Labels = map[string]string{}
+		}
+		secret.Labels[k] = v
+	}
+	for k, v := range vs.Spec.Template.Metadata.Annotations {
+		if _, ok := secret.Annotations[k]; ok || isReservedAnnotation(k) {
+			continue
+		}
+		secret.Annotations[k] = v
+	}
+}
+
+// setOwnerLabels stamps the managedByLabel and the labels naming the
+// VaultSecret on the Secret, over the ones of the Template. The VaultSecret
+// names too long for a label value are left out.
+func setOwnerLabels(vs *appsv1.VaultSecret, secret *core.Secret) {
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[managedByLabel] = managedByValue
+	secret.Labels[vaultSecretNamespaceLabel] = vs.Namespace
+	if len(validation.IsValidLabelValue(vs.Name)) == 0 {
+		secret.Labels[vaultSecretNameLabel] = vs.Name
+	}
+}
+
+// templateMetadataChanged reports whether the found Secret lacks some labels
+// or annotations of the Template
+func templateMetadataChanged(vs *appsv1.VaultSecret, found *core.Secret) bool {
+	if vs.Spec.Template == nil {
+		return false
+	}
+
+	for k, v := range vs.Spec.Template.Metadata.Labels {
+		if found.Labels[k] != v {
+			return true
+		}
+	}
+	for k, v := range vs.Spec.Template.Metadata.Annotations {
+		if !isReservedAnnotation(k) && found.Annotations[k] != v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isReservedAnnotation reports whether the annotation belongs to the
+// bookkeeping of the operator
+func isReservedAnnotation(name string) bool {
+	return strings.HasPrefix(name, appsv1.GroupVersion.Group+"/")
+}
+
+// sourceChanged reports whether the Vault source or provenance annotations,
+// or the owner labels, of the rendered Secret differ from the ones of the
+// existing Secret
+func sourceChanged(found, secret *core.Secret) bool {
+	for _, k := range []string{vaultPathAnnotation, vaultAddressAnnotation} {
+		if found.Annotations[k] != secret.Annotations[k] {
+			return true
+		}
+	}
+	for _, k := range []string{managedByLabel, vaultSecretNameLabel, vaultSecretNamespaceLabel} {
+		if found.Labels[k] != secret.Labels[k] {
+			return true
+		}
+	}
+	for _, annotations := range []map[string]string{found.Annotations, secret.Annotations} {
+		for k := range annotations {
+			if isProvenanceAnnotation(k) && found.Annotations[k] != secret.Annotations[k] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// secretData returns the key/value pairs of the Vault secret payload
+func secretData(kv *kvSecret) (map[string][]byte, error) {
+	secObjData := map[string][]byte{}
+	for kk, vv := range kv.Data {
+		value, err := secretValue(vv)
+		if err != nil {
+			return nil, fmt.Errorf("can't store the Vault key %q: %w", kk, err)
+		}
+		secObjData[kk] = value
+	}
+
+	return secObjData, nil
+}
+
+// secretValue returns the Secret value of a Vault payload value. Numbers and
+// booleans are stringified, objects and arrays are stored as JSON and nulls
+// as empty values.
+func secretValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case nil:
+		return []byte{}, nil
+	case json.Number:
+		return []byte(v.String()), nil
+	case bool:
+		return []byte(strconv.FormatBool(v)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case map[string]interface{}, []interface{}:
+		return json.Marshal(v)
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// addVersionHistory stores the previous versions of a KV v2 secret in the
+// Secret under version-suffixed keys. Only the last versions requested by the
+// VaultSecret are kept, older ones are pruned along with the rest of the data
+// on update. Deleted or destroyed versions are skipped.
+func (r *VaultSecretReconciler) addVersionHistory(reader SecretReader, config VaultConfig, es *appsv1.VaultSecret, current *vaultapi.Secret, s *core.Secret) error {
+	n := es.Spec.IncludeVersionHistory
+	if n <= 0 || current == nil {
+		return nil
+	}
+
+	kv, err := parseVaultSecret(es, current)
+	if err != nil {
+		return err
+	}
+	latest, ok := kv.version()
+	if !ok {
+		return errors.New("can't read the version history, secret '" + config.Path + "' has no KV v2 version metadata")
+	}
+
+	for version := latest; version > 0 && version > latest-n; version-- {
+		if version != latest {
+			config.Version = version
+			data, err := reader.ReadSecret(config)
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				continue
+			}
+			var deletedErr *deletedSecretError
+			kv, err = parseVaultSecret(es, data)
+			if errors.As(err, &deletedErr) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		data, err := secretData(kv)
+		if err != nil {
+			return err
+		}
+		for k, v := range data {
+			s.Data[k+".v"+strconv.Itoa(version)] = v
+		}
+	}
+
+	return nil
+}
+
+// dataDrifted reports whether the managed data of the child Secret no longer
+// matches its hash annotation, such as after a manual edit, the Secret is
+// then rewritten. Chunked Secrets hold a part of the data only, they aren't
+// checked.
+func dataDrifted(ctx context.Context, vs *appsv1.VaultSecret, found *core.Secret) bool {
+	if _, ok := found.Annotations[chunksAnnotation]; ok {
+		return false
+	}
+	if secretDataHash(managedData(found), vs.Spec.ChangeDetectionKeys) == found.Annotations[dataHashAnnotation] {
+		return false
+	}
+
+	log.FromContext(ctx).Info("the data of the child Secret drifted from its hash, rewriting it", "secret", found.Name)
+	return true
+}
+
+// secretDataHash returns a SHA-256 over the given keys of the Secret data, or
+// over all of them when keys is empty. Keys are hashed in sorted order so the
+// result doesn't depend on map iteration.
+func secretDataHash(data map[string][]byte, keys []string) string {
+	if len(keys) == 0 {
+		keys = sortedKeys(data)
+	} else {
+		keys = append([]string(nil), keys...)
+		sort.Strings(keys)
+	}
+
+	h := sha256.New()
+	for _, k := range keys {
+		v, ok := data[k]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(h, "%d:%s%d:", len(k), k, len(v))
+		h.Write(v)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sortedKeys returns the keys of the Secret data in sorted order
+func sortedKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// secretDataDiff describes which keys were changed, added and removed between
+// the old and the new Secret data. Only key names are reported, never values.
+func secretDataDiff(old, new map[string][]byte) string {
+	var changed, added, removed []string
+	for k, v := range new {
+		if ov, ok := old[k]; !ok {
+			added = append(added, k)
+		} else if !bytes.Equal(ov, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	diff := "keys"
+	for _, section := range []struct {
+		name string
+		keys []string
+	}{{"changed", changed}, {"added", added}, {"removed", removed}} {
+		if len(section.keys) > 0 {
+			sort.Strings(section.keys)
+			diff += " " + section.name + ": " + strings.Join(section.keys, ",")
+		}
+	}
+
+	return diff
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *VaultSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("vaultsecret-controller")
+	}
+	if r.TokenRenewInterval > 0 {
+		if err := mgr.Add(manager.RunnableFunc(r.runTokenRenewals)); err != nil {
+			return err
+		}
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&appsv1.VaultSecret{}, builder.WithPredicates(vaultSecretPredicate())).
+		Owns(&core.Secret{}, builder.WithPredicates(ownedSecretPredicate())).
+		Owns(&core.ConfigMap{}, builder.WithPredicates(ownedSecretPredicate())).
+		Watches(&source.Kind{Type: &core.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.templateDependents)).
+		Watches(&source.Kind{Type: &core.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.configRefDependents)).
+		Watches(&source.Kind{Type: &appsv1.VaultConnection{}}, handler.EnqueueRequestsFromMapFunc(r.connectionRefDependents)).
+		Watches(&source.Kind{Type: &core.Namespace{}}, handler.EnqueueRequestsFromMapFunc(r.namespaceDependents), builder.WithPredicates(namespacePredicate())).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Complete(r)
+}
+
+// ownedSecretPredicate only lets the deletions of the child Secrets and
+// ConfigMaps through, so that they're recreated right away. Our own writes
+// would otherwise trigger a new Vault read each.
+func ownedSecretPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		UpdateFunc:  func(event.UpdateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return true },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+}
+
+// namespacePredicate lets the new namespaces and the label changes through,
+// they may be targeted by the TargetNamespaces of a VaultSecret
+func namespacePredicate() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(event.CreateEvent) bool { return true },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return e.ObjectOld != nil && e.ObjectNew != nil &&
+				!equality.Semantic.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels())
+		},
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+}
+
+// vaultSecretPredicate filters out VaultSecret updates that don't require a
+// new Vault read, such as our own status writes. Only spec changes, a new
+// force-sync annotation value and a bypass-cache request get through.
+func vaultSecretPredicate() predicate.Predicate {
+	return predicate.Or(
+		predicate.GenerationChangedPredicate{},
+		predicate.Funcs{
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				if e.ObjectOld == nil || e.ObjectNew == nil {
+					return false
+				}
+				if e.ObjectOld.GetDeletionTimestamp() == nil && e.ObjectNew.GetDeletionTimestamp() != nil {
+					return true
+				}
+				before, after := e.ObjectOld.GetAnnotations(), e.ObjectNew.GetAnnotations()
+				return before[forceSyncAnnotation] != after[forceSyncAnnotation] ||
+					(after[bypassCacheAnnotation] == "true" && before[bypassCacheAnnotation] != "true")
+			},
+			CreateFunc:  func(event.CreateEvent) bool { return false },
+			DeleteFunc:  func(event.DeleteEvent) bool { return false },
+			GenericFunc: func(event.GenericEvent) bool { return false },
+		},
+	)
 }
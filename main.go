@@ -17,17 +17,29 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -52,11 +64,89 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maxConcurrentLogins int
+	var maxVaultResponseBytes int64
+	var allowedTargetKinds string
+	var vaultAddress string
+	var defaultAuthPath string
+	var defaultRole string
+	var readRetries int
+	var retryDelay time.Duration
+	var reconcileTimeout time.Duration
+	var maxConcurrentReconciles int
+	var vaultQPS float64
+	var vaultBurst int
+	var forwardToActive bool
+	var jwtDirs string
+	var tokenDirs string
+	var watchNamespaces string
+	var copyNamespaces string
+	var tokenRenewInterval time.Duration
+	var startupJitter time.Duration
+	var serverSideApply bool
+	var refreshJitter float64
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&maxConcurrentLogins, "max-concurrent-logins", 0,
+		"The maximum number of Vault logins in flight across all reconciles. Zero means no limit.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The maximum number of VaultSecrets reconciled at once.")
+	flag.Float64Var(&vaultQPS, "vault-qps", 0,
+		"The maximum rate of the Vault requests across all reconciles, per second. Zero means no limit.")
+	flag.IntVar(&vaultBurst, "vault-burst", 0,
+		"The burst of Vault requests allowed over vault-qps. Zero means vault-qps rounded up.")
+	flag.BoolVar(&forwardToActive, "vault-forward-to-active", false,
+		"Ask the Vault performance standbys to forward the requests to the active node rather than serve them. "+
+			"The Vault has to allow it, the reads of the readAddr replicas are left to them.")
+	flag.Int64Var(&maxVaultResponseBytes, "max-vault-response-bytes", 0,
+		"The maximum size of a Vault response body. Zero means no limit.")
+	flag.StringVar(&allowedTargetKinds, "allowed-target-kinds", "",
+		"The comma separated kinds, as Kind.group, VaultSecrets may write their data into with a targetRef. "+
+			"The operator needs to be granted access to them.")
+	flag.StringVar(&vaultAddress, "vault-address", os.Getenv("VAULT_ADDR"),
+		"The address of the Vault of the VaultSecrets without a vaultAddress, VAULT_ADDR by default. "+
+			"The readiness check probes it with sys/health, empty disables the check.")
+	flag.StringVar(&defaultAuthPath, "default-auth-path", "",
+		"The mount path of the auth method of the VaultSecrets without an authMethod and an authPath. "+
+			"Empty means the default mount of the method.")
+	flag.StringVar(&defaultRole, "default-role", "",
+		"The Vault role of the VaultSecrets without a role and a serviceAccountName, "+
+			"ahead of the role annotation of the operator ServiceAccount.")
+	flag.StringVar(&jwtDirs, "jwt-dirs", "",
+		"The comma separated directories of the operator the jwtPath of the VaultSecrets may point into, "+
+			"such as the mounts of the projected ServiceAccount tokens. Empty refuses all jwtPaths.")
+	flag.StringVar(&tokenDirs, "token-dirs", "",
+		"The comma separated directories of the operator the tokenPath of the VaultSecrets may point into, "+
+			"such as the sink of a Vault Agent sidecar. Empty refuses all tokenPaths.")
+	flag.IntVar(&readRetries, "read-retries", 0,
+		"The number of times a failed Vault login or read is retried within a reconcile, "+
+			"for the VaultSecrets without readRetries. Zero leaves the retries to the Vault client.")
+	flag.DurationVar(&retryDelay, "retry-delay", 0,
+		"The delay between the Vault retries of the VaultSecrets without retryDelay. Zero means 250ms.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 0,
+		"The longest a reconcile of the VaultSecrets without reconcileTimeout may run before it's aborted and requeued. "+
+			"Zero means no bound.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"The comma separated namespaces the VaultSecrets are reconciled in, and their Secrets copied into. "+
+			"Empty means all of them. The namespace of the operator has to be listed for the role annotation of its ServiceAccount.")
+	flag.StringVar(&copyNamespaces, "copy-namespaces", "",
+		"The comma separated namespaces the targetNamespaces of the VaultSecrets may copy their Secrets into, "+
+			"* allowing all of them. Empty refuses all targetNamespaces.")
+	flag.DurationVar(&startupJitter, "startup-jitter", 0,
+		"The window the first reconciles of the VaultSecrets after the start are spread over at random, "+
+			"so that a restart doesn't send all their Vault logins at once. Zero reconciles them right away.")
+	flag.Float64Var(&refreshJitter, "refresh-jitter", 0.1,
+		"The fraction of the refresh interval the refreshes of the VaultSecrets are moved by at random either way, "+
+			"so that the VaultSecrets created together aren't read again all at once. Zero refreshes them on their interval exactly.")
+	flag.BoolVar(&serverSideApply, "server-side-apply", false,
+		"Write the child Secrets with a server-side apply of the fields the operator owns, as the vault-operator field manager, "+
+			"so that the changes other managers made to them fail the sync with a conflict instead of being overwritten.")
+	flag.DurationVar(&tokenRenewInterval, "token-renew-interval", time.Minute,
+		"The period the cached renewable Vault tokens are renewed at in the background, ahead of their expiry. "+
+			"Zero leaves the renewals to the reconciles.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,26 +155,94 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		setupLog.Error(err, "unable to set up the tracing")
+		os.Exit(1)
+	}
+
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "abb30835.vault.op",
-	})
+	}
+	namespaces := splitList(watchNamespaces)
+	switch {
+	case len(namespaces) == 1:
+		options.Namespace = namespaces[0]
+	case len(namespaces) > 1:
+		options.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+	if len(namespaces) > 0 {
+		setupLog.Info("watching the namespaces", "namespaces", namespaces)
+	}
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	kubeClient, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create the Kubernetes client")
+		os.Exit(1)
+	}
+
+	appsv1.DefaultVaultAddress = vaultAddress
+	appsv1.DefaultAuthPath = defaultAuthPath
+	appsv1.JWTDirs = splitList(jwtDirs)
+	appsv1.TokenDirs = splitList(tokenDirs)
+	appsv1.CopyNamespaces = splitList(copyNamespaces)
 
-	if err = (&controllers.VaultSecretReconciler{
+	reconciler := &controllers.VaultSecretReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		KubeClient: kubeClient,
+		ServiceAccount: types.NamespacedName{
+			Name:      os.Getenv("POD_SERVICE_ACCOUNT"),
+			Namespace: os.Getenv("POD_NAMESPACE"),
+		},
+		DefaultVaultAddress:     vaultAddress,
+		DefaultRole:             defaultRole,
+		DefaultReadRetries:      readRetries,
+		DefaultRetryDelay:       retryDelay,
+		DefaultReconcileTimeout: reconcileTimeout,
+		MaxConcurrentLogins:     maxConcurrentLogins,
+		MaxVaultResponseBytes:   maxVaultResponseBytes,
+		VaultQPS:                vaultQPS,
+		VaultBurst:              vaultBurst,
+		ForwardToActive:         forwardToActive,
+		JWTDirs:                 appsv1.JWTDirs,
+		TokenDirs:               appsv1.TokenDirs,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		AllowedTargetKinds:      splitList(allowedTargetKinds),
+		WatchNamespaces:         namespaces,
+		CopyNamespaces:          appsv1.CopyNamespaces,
+		TokenRenewInterval:      tokenRenewInterval,
+		StartupJitter:           startupJitter,
+		ServerSideApply:         serverSideApply,
+		RefreshJitter:           refreshJitter,
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VaultSecret")
+		os.Exit(1)
+	}
+	if err = (&controllers.VaultConnectionReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
+		Vault:  reconciler,
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "VaultSecret")
+		setupLog.Error(err, "unable to create controller", "controller", "VaultConnection")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&appsv1.VaultSecret{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "VaultSecret")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -95,10 +253,58 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if vaultAddress != "" {
+		if err := mgr.AddReadyzCheck("vault", reconciler.VaultHealthCheck(vaultAddress)); err != nil {
+			setupLog.Error(err, "unable to set up the Vault ready check")
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		setupLog.Error(err, "unable to flush the traces")
+	}
+}
+
+// setupTracing exports the spans of the reconciles with OTLP over gRPC when
+// the standard OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// is set, the other OTEL_EXPORTER_OTLP_* variables configuring the exporter.
+// The tracing is a no-op otherwise. The returned func flushes the spans left.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver())
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceNameKey.String("vault-operator")))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	setupLog.Info("exporting the traces with OTLP")
+
+	return provider.Shutdown, nil
+}
+
+// splitList splits a comma separated flag value, dropping the empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
 }